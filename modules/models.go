@@ -2,15 +2,55 @@ package models
 
 import "time"
 
-// Product representa un producto en la tienda
+// Product representa un producto en la tienda. Las etiquetas `validate` declaran
+// las reglas que se aplican a los cuerpos de las peticiones (ver web/validation.go).
 type Product struct {
-	ID          int       `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	Price       float64   `json:"price"`
-	Stock       int       `json:"stock"`
-	CreatedAt   time.Time `json:"createdAt"`
-	UpdatedAt   time.Time `json:"updatedAt"`
+	ID          int        `json:"id" validate:"readonly"`
+	SKU         string     `json:"sku,omitempty" validate:"max=64,chars=sku"` // referencia única opcional; clave de la importación
+	Name        string     `json:"name" validate:"required,max=120,chars=line"`
+	Description string     `json:"description" validate:"max=2000,chars=text"`
+	Price       float64    `json:"price" validate:"min=0,max=1000000"`
+	Stock       int        `json:"stock" validate:"min=0,max=1000000"`
+	CreatedAt   time.Time  `json:"createdAt" validate:"readonly"`
+	UpdatedAt   time.Time  `json:"updatedAt" validate:"readonly"`
+	Version     int        `json:"version" validate:"readonly"`             // se incrementa en cada modificación; base del ETag
+	ImageURL    string     `json:"imageUrl,omitempty" validate:"readonly"`  // miniatura de la imagen principal
+	DeletedAt   *time.Time `json:"deletedAt,omitempty" validate:"readonly"` // en la papelera desde esta fecha
+}
+
+// ProductRevision es el estado de un producto tras uno de sus cambios: hay una por
+// cada versión, así que Version coincide con Product.Version
+type ProductRevision struct {
+	ProductID  int       `json:"productId"`
+	Version    int       `json:"version"`
+	Action     string    `json:"action"` // create, update, delete, restore, image o rollback
+	AuthorID   int       `json:"authorId,omitempty"`
+	AuthorName string    `json:"authorName"`
+	CreatedAt  time.Time `json:"createdAt"`
+	RollbackOf int       `json:"rollbackOf,omitempty"` // versión restaurada (solo en rollback)
+	Product    Product   `json:"product"`
+}
+
+// ProductImage es una imagen de la galería de un producto. El archivo original y sus
+// miniaturas se guardan en el almacén de blobs; aquí solo van los metadatos.
+type ProductImage struct {
+	ID          int               `json:"id"`
+	ProductID   int               `json:"productId"`
+	Filename    string            `json:"filename"`    // nombre del archivo subido
+	ContentType string            `json:"contentType"` // detectado a partir del contenido, no de la cabecera
+	Size        int64             `json:"size"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	Position    int               `json:"position"` // orden en la galería, desde 1
+	Primary     bool              `json:"primary"`
+	URLs        map[string]string `json:"urls"` // "original" y una entrada por tamaño de miniatura
+	CreatedAt   time.Time         `json:"createdAt"`
+}
+
+// Credentials es el cuerpo de registro y login
+type Credentials struct {
+	Username string `json:"username" validate:"required,min=3,max=32,chars=username"`
+	Password string `json:"password" validate:"required,maxbytes=72"` // límite de bcrypt; el resto lo valida la política
 }
 
 // User representa un usuario del sistema
@@ -20,6 +60,17 @@ type User struct {
 	PasswordHash string    `json:"-"` // Ocultar el hash de la contraseña en JSON
 	Role         string    `json:"role"`
 	CreatedAt    time.Time `json:"createdAt"`
+
+	// Autenticación en dos pasos (TOTP)
+	TOTPEnabled       bool     `json:"totpEnabled"`
+	TOTPSecret        string   `json:"-"` // secreto base32 activo
+	TOTPPendingSecret string   `json:"-"` // secreto generado en el alta, pendiente de verificar
+	TOTPLastStep      int64    `json:"-"` // último intervalo aceptado, para impedir reutilizar un código
+	RecoveryCodes     []string `json:"-"` // hashes SHA-256 de los códigos de recuperación sin usar
+
+	// Identidad externa (login OIDC); vacíos en las cuentas locales
+	ExternalIssuer  string `json:"-"`
+	ExternalSubject string `json:"-"`
 }
 
 // SessionID es un tipo para el ID de sesión (UUID)
@@ -31,4 +82,71 @@ type Session struct {
 	UserID    int       `json:"userId"`
 	CreatedAt time.Time `json:"createdAt"`
 	ExpiresAt time.Time `json:"expiresAt"`
+	// MFAPending indica una sesión parcial: la contraseña es correcta pero falta
+	// el segundo factor. Solo sirve para los endpoints de verificación y alta de 2FA.
+	MFAPending bool `json:"mfaPending"`
+}
+
+// PasswordResetToken representa una solicitud de restablecimiento de contraseña.
+// Solo se guarda el hash SHA-256 del token; el valor en claro viaja únicamente
+// en el enlace enviado al usuario.
+type PasswordResetToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"userId"`
+	TokenHash string     `json:"-"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"` // nil mientras el token no se haya usado
+}
+
+// APIToken representa un token de acceso personal para clientes automatizados.
+// Solo se guarda el hash SHA-256; el valor completo se muestra una única vez al crearlo.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"userId"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // primeros caracteres del token, para identificarlo en listados
+	TokenHash  string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"` // nil si no caduca
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// RefreshToken representa un token de refresco del modo de sesión JWT.
+// Cada uso lo rota por uno nuevo de la misma familia; reutilizar uno ya usado
+// revoca la familia completa (detección de robo de tokens).
+type RefreshToken struct {
+	ID        int        `json:"id"`
+	FamilyID  string     `json:"familyId"` // identifica la sesión de login; va en el claim "sid" del access token
+	UserID    int        `json:"userId"`
+	TokenHash string     `json:"-"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// AuditEntry es un registro del historial de auditoría. El historial solo crece:
+// cada registro incluye el hash del anterior, de modo que alterar o borrar uno
+// rompe la cadena a partir de ese punto.
+type AuditEntry struct {
+	ID         int                    `json:"id"`
+	Time       time.Time              `json:"time"`
+	ActorID    int                    `json:"actorId,omitempty"` // 0 si no hay usuario autenticado (p. ej. registro)
+	ActorName  string                 `json:"actorName,omitempty"`
+	Action     string                 `json:"action"` // p. ej. product.delete, user.role_change
+	TargetType string                 `json:"targetType"`
+	TargetID   string                 `json:"targetId,omitempty"`
+	Changes    map[string]AuditChange `json:"changes,omitempty"` // campos que cambiaron
+	IP         string                 `json:"ip,omitempty"`
+	RequestID  string                 `json:"requestId,omitempty"`
+	PrevHash   string                 `json:"prevHash"`
+	Hash       string                 `json:"hash"` // SHA-256 del registro (con Hash vacío)
+}
+
+// AuditChange es el valor de un campo antes y después de la acción
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
 }
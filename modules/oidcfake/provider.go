@@ -0,0 +1,346 @@
+// Package oidcfake implementa un proveedor OpenID Connect mínimo para pruebas sin
+// conexión. Soporta discovery, flujo authorization code con PKCE (S256), id_token
+// firmado con RS256 y publicación de claves JWKS.
+//
+// No realiza autenticación real: la página de autorización lista los usuarios
+// configurados y aprueba al que se elija (o al indicado en login_hint). Lo usan los
+// tests del paquete web y, solo al compilar con -tags oidcfake, el modo de desarrollo
+// TIENDA_OIDC_FAKE; el binario normal no lo incluye.
+package oidcfake
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User es una identidad del proveedor falso
+type User struct {
+	Subject           string   `json:"sub"`
+	PreferredUsername string   `json:"preferred_username"`
+	Email             string   `json:"email"`
+	Name              string   `json:"name"`
+	Groups            []string `json:"groups"`
+}
+
+// Provider es un proveedor OIDC en memoria que se monta como http.Handler
+type Provider struct {
+	Issuer       string // URL pública del proveedor, sin barra final
+	ClientID     string
+	ClientSecret string // vacío para clientes públicos
+	TokenTTL     time.Duration
+
+	// Claims, si no es nil, modifica los claims del id_token antes de firmarlo; permite
+	// a las pruebas emitir tokens con audiencia, azp o nonce incorrectos
+	Claims func(claims map[string]interface{})
+
+	users []User
+	key   *rsa.PrivateKey
+	kid   string
+
+	mu    sync.Mutex
+	codes map[string]authRequest
+}
+
+// authRequest es una autorización aprobada pendiente de canjear en /token
+type authRequest struct {
+	user          User
+	clientID      string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	expiresAt     time.Time
+}
+
+// New crea un proveedor con una clave RSA nueva y los usuarios indicados
+func New(issuer, clientID, clientSecret string, users ...User) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generando clave RSA: %w", err)
+	}
+	return &Provider{
+		Issuer:       strings.TrimRight(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenTTL:     5 * time.Minute,
+		users:        users,
+		key:          key,
+		kid:          randomString(8),
+		codes:        make(map[string]authRequest),
+	}, nil
+}
+
+// Client devuelve un cliente HTTP que atiende las peticiones al proveedor en
+// memoria, sin abrir conexiones de red
+func (p *Provider) Client() *http.Client {
+	return &http.Client{Transport: roundTripper{p}}
+}
+
+type roundTripper struct{ p *Provider }
+
+func (rt roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	rt.p.ServeHTTP(rec, r)
+	resp := rec.Result()
+	resp.Request = r
+	return resp, nil
+}
+
+// ServeHTTP enruta las peticiones según la ruta relativa al emisor
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	base, _ := url.Parse(p.Issuer)
+	path := strings.TrimPrefix(r.URL.Path, strings.TrimRight(base.Path, "/"))
+
+	switch path {
+	case "/.well-known/openid-configuration":
+		p.discovery(w, r)
+	case "/authorize":
+		p.authorize(w, r)
+	case "/token":
+		p.token(w, r)
+	case "/jwks":
+		p.jwks(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.Issuer,
+		"authorization_endpoint":                p.Issuer + "/authorize",
+		"token_endpoint":                        p.Issuer + "/token",
+		"jwks_uri":                              p.Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile", "email", "groups"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+	})
+}
+
+var chooserPage = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<html lang="es"><head><meta charset="UTF-8"><title>Proveedor OIDC de pruebas</title></head>
+<body style="font-family: system-ui; max-width: 30rem; margin: 3rem auto;">
+<h1>Proveedor OIDC de pruebas</h1>
+<p>Elige la identidad con la que quieres entrar:</p>
+<ul>{{range .Users}}<li><a href="{{$.Base}}&login_hint={{.Subject}}">{{.PreferredUsername}}</a> ({{range .Groups}}{{.}} {{end}})</li>{{end}}</ul>
+</body></html>`))
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != p.ClientID {
+		http.Error(w, "client_id desconocido", http.StatusBadRequest)
+		return
+	}
+	redirectURI := q.Get("redirect_uri")
+	target, err := url.Parse(redirectURI)
+	if err != nil || redirectURI == "" {
+		http.Error(w, "redirect_uri inválida", http.StatusBadRequest)
+		return
+	}
+
+	redirectError := func(code string) {
+		params := target.Query()
+		params.Set("error", code)
+		params.Set("state", q.Get("state"))
+		target.RawQuery = params.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	}
+	if q.Get("response_type") != "code" {
+		redirectError("unsupported_response_type")
+		return
+	}
+	if !containsScope(q.Get("scope"), "openid") {
+		redirectError("invalid_scope")
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		redirectError("invalid_request")
+		return
+	}
+
+	// Sin login_hint se muestra la página para elegir identidad
+	hint := q.Get("login_hint")
+	if hint == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		chooserPage.Execute(w, map[string]interface{}{"Users": p.users, "Base": template.URL(p.Issuer + "/authorize?" + q.Encode())})
+		return
+	}
+
+	var user *User
+	for i := range p.users {
+		if p.users[i].Subject == hint || p.users[i].PreferredUsername == hint {
+			user = &p.users[i]
+			break
+		}
+	}
+	if user == nil {
+		redirectError("access_denied")
+		return
+	}
+
+	code := randomString(24)
+	p.mu.Lock()
+	p.codes[code] = authRequest{
+		user:          *user,
+		clientID:      q.Get("client_id"),
+		redirectURI:   redirectURI,
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		expiresAt:     time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+
+	params := target.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	target.RawQuery = params.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+
+	// Autenticación del cliente: client_secret_basic, client_secret_post o ninguna (cliente público)
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.ClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(p.ClientSecret)) != 1 {
+		tokenError(w, "invalid_client")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	req, ok := p.codes[code]
+	delete(p.codes, code) // los códigos son de un solo uso
+	p.mu.Unlock()
+	if !ok || time.Now().After(req.expiresAt) || req.clientID != clientID || req.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	// PKCE: BASE64URL(SHA256(code_verifier)) debe coincidir con el code_challenge
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != req.codeChallenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":                p.Issuer,
+		"sub":                req.user.Subject,
+		"aud":                clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(p.TokenTTL).Unix(),
+		"nonce":              req.nonce,
+		"preferred_username": req.user.PreferredUsername,
+		"email":              req.user.Email,
+		"name":               req.user.Name,
+		"groups":             req.user.Groups,
+	}
+	if p.Claims != nil {
+		p.Claims(claims)
+	}
+	idToken, err := p.sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(24),
+		"token_type":   "Bearer",
+		"expires_in":   int(p.TokenTTL / time.Second),
+		"id_token":     idToken,
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": p.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// sign firma los claims como JWT RS256
+func (p *Provider) sign(claims map[string]interface{}) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": p.kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func containsScope(scopes, want string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	status := http.StatusBadRequest
+	if code == "invalid_client" {
+		status = http.StatusUnauthorized
+	}
+	writeJSON(w, status, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// apiTokenPrefix identifica a simple vista los tokens de esta aplicación (p. ej. en escáneres de secretos)
+const apiTokenPrefix = "tsp_"
+
+var (
+	apiTokens     = make([]models.APIToken, 0)
+	apiTokenIDSeq = 1
+)
+
+// newPrefixedToken genera un token aleatorio de 32 bytes con el prefijo indicado
+func newPrefixedToken(prefix string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// authenticateAPIToken busca un token vigente y su usuario a partir del valor en claro
+func authenticateAPIToken(value string) (*models.APIToken, *models.User) {
+	if !strings.HasPrefix(value, apiTokenPrefix) {
+		return nil, nil
+	}
+	hash := hashToken(value)
+	now := time.Now()
+	for i := range apiTokens {
+		token := &apiTokens[i]
+		if subtle.ConstantTimeCompare([]byte(token.TokenHash), []byte(hash)) != 1 {
+			continue
+		}
+		if token.ExpiresAt != nil && !token.ExpiresAt.After(now) {
+			return nil, nil
+		}
+		for j := range users {
+			if users[j].ID == token.UserID {
+				return token, &users[j]
+			}
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
+
+// Cuerpo de la creación de un token de API
+type apiTokenRequest struct {
+	Name      string     `json:"name" validate:"required,max=100,chars=line"`
+	Scopes    []string   `json:"scopes" validate:"required"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// apiTokenCreated es la respuesta de la creación: el token y su valor completo
+type apiTokenCreated struct {
+	models.APIToken
+	Token string `json:"token"` // solo se devuelve en esta respuesta
+}
+
+// requireSessionUser recupera el usuario autenticado y exige que haya entrado con una
+// sesión: un token no puede usarse para ver, crear o revocar otros tokens
+func requireSessionUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	w.Header().Set("Content-Type", "application/json")
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	if !ok || user == nil {
+		slog.ErrorContext(r.Context(), "Usuario no encontrado en el contexto")
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return nil, false
+	}
+	if authMethod(r) != authMethodSession {
+		writeProblem(w, r, http.StatusForbidden, "session_auth_required")
+		return nil, false
+	}
+	return user, true
+}
+
+// Handler que lista los tokens de API del usuario autenticado
+func listAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireSessionUser(w, r)
+	if !ok {
+		return
+	}
+	list := make([]models.APIToken, 0)
+	for _, t := range apiTokens {
+		if t.UserID == user.ID {
+			list = append(list, t)
+		}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// Handler que crea un token de API para el usuario autenticado
+func createAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireSessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req apiTokenRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	// Los permisos del token deben ser un subconjunto de los del rol del usuario
+	for _, scope := range req.Scopes {
+		if !roleHasPermission(user.Role, scope) {
+			writeValidationProblem(w, r, fieldError("scopes", "token_scope_not_allowed", scope))
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeValidationProblem(w, r, fieldError("expiresAt", "token_expiry_in_past"))
+		return
+	}
+
+	value, err := newPrefixedToken(apiTokenPrefix)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error generando el token de API", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+
+	token := models.APIToken{
+		ID:        apiTokenIDSeq,
+		UserID:    user.ID,
+		Name:      strings.TrimSpace(req.Name),
+		Prefix:    value[:len(apiTokenPrefix)+8],
+		TokenHash: hashToken(value),
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: req.ExpiresAt,
+	}
+	apiTokenIDSeq++
+	apiTokens = append(apiTokens, token)
+	recordAudit(r, user, auditEvent{Action: "api_token.create", TargetType: auditTargetToken, TargetID: strconv.Itoa(token.ID), After: token})
+	slog.InfoContext(r.Context(), "Token de API creado", "token_id", token.ID, "token_name", token.Name, "user_id", user.ID)
+
+	// El valor completo solo se devuelve en esta respuesta
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apiTokenCreated{token, value})
+}
+
+// Handler para revocar un token de API
+func revokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireSessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	id := pathInt(r, "id")
+	for i, t := range apiTokens {
+		// Cada usuario revoca sus tokens; el Admin puede revocar cualquiera
+		if t.ID == id && (t.UserID == user.ID || can(r, user, permAdmin)) {
+			apiTokens = append(apiTokens[:i], apiTokens[i+1:]...)
+			recordAudit(r, user, auditEvent{Action: "api_token.revoke", TargetType: auditTargetToken, TargetID: strconv.Itoa(id), Before: t})
+			slog.InfoContext(r.Context(), "Token de API revocado", "token_id", id, "user_id", user.ID)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Token revocado exitosamente"})
+			return
+		}
+	}
+	writeProblem(w, r, http.StatusNotFound, "token_not_found")
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// Historial de auditoría de las acciones que cambian productos, usuarios, roles y
+// sesiones. Solo se añaden registros; cada uno guarda el hash del anterior, así que
+// modificar o borrar uno deja la cadena rota a partir de él (GET /audit/verify).
+//
+// Las acciones se nombran "tipo.verbo": product.create, user.role_change,
+// session.login... GET /audit filtra por prefijo si el valor termina en punto.
+
+// auditGenesisHash es el PrevHash del primer registro
+var auditGenesisHash = strings.Repeat("0", 64)
+
+var (
+	auditMu    sync.Mutex
+	auditLog   = make([]models.AuditEntry, 0)
+	auditIDSeq = 1
+)
+
+// Tipos de objetivo de los registros de auditoría
+const (
+	auditTargetProduct = "product"
+	auditTargetImage   = "product_image"
+	auditTargetUser    = "user"
+	auditTargetSession = "session"
+	auditTargetToken   = "api_token"
+	auditTargetConfig  = "config"
+)
+
+// auditEvent describe una acción. Before y After son instantáneas del objetivo (nil
+// si no existía antes o ya no existe después); el registro guarda solo los campos
+// de primer nivel que difieren.
+type auditEvent struct {
+	Action     string
+	TargetType string
+	TargetID   string
+	Before     interface{}
+	After      interface{}
+}
+
+// recordAudit añade un registro al historial. Si actor es nil se toma el usuario
+// autenticado de la petición; las acciones sin usuario (registro, restablecimiento
+// de contraseña) quedan con ActorID 0.
+func recordAudit(r *http.Request, actor *models.User, e auditEvent) {
+	if actor == nil {
+		actor, _ = r.Context().Value(userContextKey).(*models.User)
+	}
+	entry := models.AuditEntry{
+		Time:       time.Now().UTC(),
+		Action:     e.Action,
+		TargetType: e.TargetType,
+		TargetID:   e.TargetID,
+		Changes:    auditDiff(e.Before, e.After),
+		IP:         clientIP(r),
+	}
+	entry.RequestID, _ = r.Context().Value(requestIDContextKey).(string)
+	if actor != nil {
+		entry.ActorID, entry.ActorName = actor.ID, actor.Username
+	}
+	appendAudit(r.Context(), entry)
+}
+
+// auditSystemActor es el ActorName de las acciones de tareas en segundo plano
+const auditSystemActor = "system"
+
+// recordSystemAudit registra una acción del propio servidor (p. ej. el purgado de la
+// papelera), sin petición ni usuario
+func recordSystemAudit(ctx context.Context, e auditEvent) {
+	appendAudit(ctx, models.AuditEntry{
+		Time:       time.Now().UTC(),
+		ActorName:  auditSystemActor,
+		Action:     e.Action,
+		TargetType: e.TargetType,
+		TargetID:   e.TargetID,
+		Changes:    auditDiff(e.Before, e.After),
+	})
+}
+
+// appendAudit encadena el registro con el anterior y lo añade al historial
+func appendAudit(ctx context.Context, entry models.AuditEntry) {
+	auditMu.Lock()
+	entry.ID = auditIDSeq
+	auditIDSeq++
+	entry.PrevHash = auditGenesisHash
+	if n := len(auditLog); n > 0 {
+		entry.PrevHash = auditLog[n-1].Hash
+	}
+	entry.Hash = auditHash(entry)
+	auditLog = append(auditLog, entry)
+	auditMu.Unlock()
+
+	slog.InfoContext(ctx, "Auditoría", "audit_id", entry.ID, "action", entry.Action,
+		"target_type", entry.TargetType, "target_id", entry.TargetID, "actor_id", entry.ActorID)
+}
+
+// auditHash calcula el hash de un registro: SHA-256 de su JSON con Hash vacío.
+// encoding/json ordena las claves de los mapas, así que el resultado es estable.
+func auditHash(entry models.AuditEntry) string {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		panic(err) // los registros solo contienen tipos serializables
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditDiff compara dos instantáneas campo a campo. Los campos sensibles (según los
+// mismos nombres que se ocultan en los logs) se guardan como "[REDACTED]".
+func auditDiff(before, after interface{}) map[string]models.AuditChange {
+	old, updated := auditFields(before), auditFields(after)
+	changes := make(map[string]models.AuditChange)
+	for key, value := range updated {
+		if prev, ok := old[key]; !ok || !reflect.DeepEqual(prev, value) {
+			changes[key] = models.AuditChange{Before: prev, After: value}
+		}
+	}
+	for key, prev := range old {
+		if _, ok := updated[key]; !ok {
+			changes[key] = models.AuditChange{Before: prev}
+		}
+	}
+	for key, change := range changes {
+		if isSensitiveLogKey(key) {
+			change.Before, change.After = redactAuditValue(change.Before), redactAuditValue(change.After)
+			changes[key] = change
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+func redactAuditValue(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return redactedValue
+}
+
+// auditFields convierte una instantánea en un mapa con su representación JSON, de
+// modo que el diff use los mismos nombres y valores que la API
+func auditFields(v interface{}) map[string]interface{} {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(data, &fields) != nil {
+		return nil
+	}
+	return fields
+}
+
+// auditPage es la respuesta paginada de GET /audit
+type auditPage struct {
+	Items []models.AuditEntry `json:"items"`
+	Page  int                 `json:"page"`
+	Limit int                 `json:"limit"`
+	Total int                 `json:"total"`
+}
+
+// auditFilter son los filtros de GET /audit
+type auditFilter struct {
+	actorID    int
+	action     string
+	targetType string
+	targetID   string
+	since      time.Time
+	until      time.Time
+}
+
+func (f auditFilter) match(e models.AuditEntry) bool {
+	switch {
+	case f.actorID != 0 && e.ActorID != f.actorID:
+		return false
+	case f.action != "" && strings.HasSuffix(f.action, ".") && !strings.HasPrefix(e.Action, f.action):
+		return false
+	case f.action != "" && !strings.HasSuffix(f.action, ".") && e.Action != f.action:
+		return false
+	case f.targetType != "" && e.TargetType != f.targetType:
+		return false
+	case f.targetID != "" && e.TargetID != f.targetID:
+		return false
+	case !f.since.IsZero() && e.Time.Before(f.since):
+		return false
+	case !f.until.IsZero() && !e.Time.Before(f.until):
+		return false
+	}
+	return true
+}
+
+// parseAuditFilter lee los filtros de la consulta
+func parseAuditFilter(r *http.Request) (auditFilter, []FieldError) {
+	query := r.URL.Query()
+	f := auditFilter{
+		action:     query.Get("action"),
+		targetType: query.Get("targetType"),
+		targetID:   query.Get("targetId"),
+	}
+	var errs []FieldError
+	if value := query.Get("actorId"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			errs = append(errs, fieldError("actorId", "field_too_small", "1"))
+		}
+		f.actorID = n
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &f.since}, {"until", &f.until}} {
+		if value := query.Get(p.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				errs = append(errs, fieldError(p.name, "field_invalid_date"))
+			}
+			*p.dst = t
+		}
+	}
+	return f, errs
+}
+
+// Handler de GET /audit: registros filtrados, del más reciente al más antiguo (solo Admin)
+func listAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permAdmin); !ok {
+		return
+	}
+	filter, errs := parseAuditFilter(r)
+	page, limit, pageErrs := parsePagination(r)
+	if errs = append(errs, pageErrs...); len(errs) > 0 {
+		writeValidationProblem(w, r, errs...)
+		return
+	}
+
+	auditMu.Lock()
+	matched := make([]models.AuditEntry, 0)
+	for i := len(auditLog) - 1; i >= 0; i-- {
+		if filter.match(auditLog[i]) {
+			matched = append(matched, auditLog[i])
+		}
+	}
+	auditMu.Unlock()
+
+	json.NewEncoder(w).Encode(auditPage{Items: paginate(matched, page, limit), Page: page, Limit: limit, Total: len(matched)})
+}
+
+// auditVerification es la respuesta de GET /audit/verify
+type auditVerification struct {
+	Valid    bool `json:"valid"`
+	Entries  int  `json:"entries"`
+	BrokenAt int  `json:"brokenAt,omitempty"` // ID del primer registro que no encaja en la cadena
+}
+
+// verifyAuditChain recorre la cadena y devuelve el ID del primer registro alterado,
+// o 0 si está íntegra
+func verifyAuditChain(entries []models.AuditEntry) int {
+	prev := auditGenesisHash
+	for _, e := range entries {
+		if e.PrevHash != prev || auditHash(e) != e.Hash {
+			return e.ID
+		}
+		prev = e.Hash
+	}
+	return 0
+}
+
+// Handler de GET /audit/verify: comprueba la cadena de hashes (solo Admin)
+func verifyAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permAdmin); !ok {
+		return
+	}
+	auditMu.Lock()
+	broken := verifyAuditChain(auditLog)
+	count := len(auditLog)
+	auditMu.Unlock()
+
+	if broken != 0 {
+		slog.ErrorContext(r.Context(), "Cadena de auditoría rota", "audit_id", broken)
+	}
+	json.NewEncoder(w).Encode(auditVerification{Valid: broken == 0, Entries: count, BrokenAt: broken})
+}
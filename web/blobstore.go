@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// blobStore guarda contenido binario (imágenes de productos) por clave. Las claves
+// usan "/" como separador, p. ej. products/3/7/original.jpg.
+type blobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error // borrar una clave inexistente no es un error
+}
+
+// errBlobNotFound indica que la clave no existe en el almacén
+var errBlobNotFound = errors.New("blob no encontrado")
+
+// errBlobStoreNotConfigured indica que setupBlobStore aún no se ha ejecutado
+var errBlobStoreNotConfigured = errors.New("almacén de imágenes sin configurar")
+
+// imageStore es el almacén de las imágenes de productos (ver setupBlobStore)
+var imageStore blobStore
+
+// setupBlobStore elige el almacén según TIENDA_BLOB_STORE: "local" (por defecto)
+// guarda en disco bajo TIENDA_BLOB_DIR; "memory" no persiste nada entre arranques
+func setupBlobStore() error {
+	switch kind := getEnv("TIENDA_BLOB_STORE", "local"); kind {
+	case "local":
+		dir := getEnv("TIENDA_BLOB_DIR", "web/data/blobs")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		imageStore = tracedBlobStore{&localBlobStore{root: dir}, kind}
+		slog.Info("Imágenes de productos en disco", "dir", dir)
+	case "memory":
+		imageStore = tracedBlobStore{&memoryBlobStore{blobs: make(map[string][]byte)}, kind}
+		slog.Info("Imágenes de productos en memoria (se pierden al reiniciar)")
+	default:
+		return fmt.Errorf("TIENDA_BLOB_STORE desconocido: %s (usa local o memory)", kind)
+	}
+	return nil
+}
+
+// tracedBlobStore mide cada operación del almacén en un span
+type tracedBlobStore struct {
+	store blobStore
+	kind  string
+}
+
+func (s tracedBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	ctx, span := startSpan(ctx, "blobstore.put", "blobstore.kind", s.kind, "blobstore.key", key, "blobstore.bytes", len(data))
+	defer span.end()
+	err := s.store.Put(ctx, key, data)
+	span.recordError(err)
+	return err
+}
+
+func (s tracedBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	ctx, span := startSpan(ctx, "blobstore.get", "blobstore.kind", s.kind, "blobstore.key", key)
+	defer span.end()
+	data, err := s.store.Get(ctx, key)
+	if !errors.Is(err, errBlobNotFound) {
+		span.recordError(err)
+	}
+	return data, err
+}
+
+func (s tracedBlobStore) Delete(ctx context.Context, key string) error {
+	ctx, span := startSpan(ctx, "blobstore.delete", "blobstore.kind", s.kind, "blobstore.key", key)
+	defer span.end()
+	err := s.store.Delete(ctx, key)
+	span.recordError(err)
+	return err
+}
+
+// --- Sistema de archivos local ---
+
+type localBlobStore struct {
+	root string
+}
+
+// path convierte la clave en una ruta bajo root, rechazando claves que salgan de él
+func (s *localBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if clean == "." || filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+		return "", fmt.Errorf("clave de blob inválida: %q", key)
+	}
+	return filepath.Join(s.root, clean), nil
+}
+
+func (s *localBlobStore) Put(_ context.Context, key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Escribir en un temporal y renombrar: un lector nunca ve un archivo a medias
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localBlobStore) Get(_ context.Context, key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return data, err
+}
+
+func (s *localBlobStore) Delete(_ context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Quitar los directorios que hayan quedado vacíos, sin salir de root
+	for dir := filepath.Dir(path); dir != filepath.Clean(s.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// --- En memoria ---
+
+type memoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func (s *memoryBlobStore) Put(_ context.Context, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memoryBlobStore) Get(_ context.Context, key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.blobs[key]
+	if !ok {
+		return nil, errBlobNotFound
+	}
+	return data, nil
+}
+
+func (s *memoryBlobStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
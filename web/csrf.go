@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// csrfHeader es la cabecera en la que la SPA devuelve el token CSRF
+const csrfHeader = "X-CSRF-Token"
+
+// csrfSecret firma los tokens CSRF; se genera en cada arranque
+var csrfSecret = func() []byte {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return buf
+}()
+
+// csrfTokenFor deriva el token CSRF (patrón synchronizer token) de la sesión.
+// Al ser un HMAC del ID de sesión no hace falta guardarlo: cambia con cada login
+// y un atacante no puede calcularlo sin conocer la sesión y el secreto.
+func csrfTokenFor(sessionID string) string {
+	mac := hmac.New(sha256.New, csrfSecret)
+	mac.Write([]byte("csrf:" + sessionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// checkCSRF valida el token CSRF de una petición autenticada por cookie. Los
+// métodos seguros no cambian estado y no se comprueban. Si el token falta o no
+// coincide responde 403 y devuelve false.
+func checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if isSafeMethod(r.Method) {
+		return true
+	}
+	session, _ := sessionFromCookie(r)
+	if session != nil {
+		expected := csrfTokenFor(string(session.ID))
+		if hmac.Equal([]byte(r.Header.Get(csrfHeader)), []byte(expected)) {
+			return true
+		}
+	}
+	slog.WarnContext(r.Context(), "Token CSRF inválido o ausente")
+	writeProblem(w, r, http.StatusForbidden, "csrf_invalid")
+	return false
+}
+
+// Handler que entrega el token CSRF de la sesión actual (también de sesiones parciales de 2FA)
+func csrfTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Configurar CORS
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	session, _ := sessionFromCookie(r)
+	if session == nil {
+		writeProblem(w, r, http.StatusUnauthorized, "session_invalid")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"csrfToken": csrfTokenFor(string(session.ID))})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	models "TiendaSupported/modules"
+
+	"github.com/google/uuid"
+)
+
+// csrfRequests son peticiones que cambian estado, una por método. Apuntan a un producto
+// inexistente o llevan un cuerpo no válido: pasado el control CSRF, el handler las rechaza
+// sin modificar el catálogo.
+var csrfRequests = []struct {
+	method, path string
+	body         interface{}
+}{
+	{http.MethodPost, "/api/v2/products", map[string]string{}},
+	{http.MethodPut, "/api/v2/products/999999", map[string]string{}},
+	{http.MethodPatch, "/api/v2/products/999999", map[string]string{}},
+	{http.MethodDelete, "/api/v2/products/999999", nil},
+}
+
+// jwtSessionCookie emite un access token JWT para un usuario nuevo con el rol dado y
+// devuelve el token y su familia, que hace de ID de sesión para el token CSRF
+func jwtSessionCookie(t *testing.T, role string) (string, string) {
+	t.Helper()
+	user := addTestUser(t, role)
+	family := uuid.New().String()
+	tokens, err := issueTokenPair(httptest.NewRecorder(), &user, family)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens["token"].(string), family
+}
+
+func TestCSRFCookieSessions(t *testing.T) {
+	srv := newTestServer(t)
+	useJWTSessions(t)
+
+	opaque := testSessionCookie(t, "Admin")
+	access, family := jwtSessionCookie(t, "Admin")
+	for _, session := range []struct {
+		name   string
+		cookie *http.Cookie
+		token  string
+	}{
+		{"sesión opaca", opaque, csrfTokenFor(opaque.Value)},
+		{"JWT en cookie", &http.Cookie{Name: "session_token", Value: access}, csrfTokenFor(family)},
+	} {
+		if res := sendJSON(t, http.MethodGet, srv.URL+"/api/v2/products", nil, session.cookie, nil); res.status != http.StatusOK {
+			t.Errorf("%s: GET sin token CSRF = %d %s; los métodos seguros no se comprueban", session.name, res.status, res.code())
+		}
+		for _, req := range csrfRequests {
+			op := session.name + ": " + req.method + " " + req.path
+			for _, header := range []map[string]string{nil, {csrfHeader: "no-es-el-token"}, {csrfHeader: csrfTokenFor("otra-sesion")}} {
+				if res := sendJSON(t, req.method, srv.URL+req.path, req.body, session.cookie, header); res.status != http.StatusForbidden || res.code() != "csrf_invalid" {
+					t.Errorf("%s con cabecera %v: %d %s, se esperaba 403 csrf_invalid", op, header, res.status, res.code())
+				}
+			}
+			if res := sendJSON(t, req.method, srv.URL+req.path, req.body, session.cookie, map[string]string{csrfHeader: session.token}); res.status == http.StatusForbidden {
+				t.Errorf("%s con el token CSRF correcto: %d %s", op, res.status, res.code())
+			}
+		}
+	}
+}
+
+// TestCSRFBearerExempt comprueba que las peticiones con Authorization: Bearer, que un
+// navegador no adjunta por sí solo, no necesitan el token CSRF
+func TestCSRFBearerExempt(t *testing.T) {
+	srv := newTestServer(t)
+	useJWTSessions(t)
+
+	user := addTestUser(t, "Admin")
+	value, err := newPrefixedToken(apiTokenPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := apiTokens
+	t.Cleanup(func() { apiTokens = saved })
+	apiTokens = append(append([]models.APIToken(nil), apiTokens...), models.APIToken{
+		ID: 9000, UserID: user.ID, Name: "csrf", TokenHash: hashToken(value), CreatedAt: time.Now(),
+		Scopes: []string{permProductsRead, permProductsWrite, permProductsDelete},
+	})
+	access, _ := jwtSessionCookie(t, "Admin")
+
+	for name, bearer := range map[string]string{"token de API": value, "access token JWT": access} {
+		for _, req := range csrfRequests {
+			res := sendJSON(t, req.method, srv.URL+req.path, req.body, nil, map[string]string{"Authorization": "Bearer " + bearer})
+			if res.status == http.StatusForbidden || res.status == http.StatusUnauthorized {
+				t.Errorf("%s: %s %s sin token CSRF = %d %s", name, req.method, req.path, res.status, res.code())
+			}
+		}
+	}
+}
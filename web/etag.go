@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	models "TiendaSupported/modules"
+)
+
+// productETag devuelve el ETag fuerte de un producto: su versión entre comillas
+func productETag(p models.Product) string {
+	return `"` + strconv.Itoa(p.Version) + `"`
+}
+
+// etagMatches indica si alguna etiqueta de una cabecera If-Match/If-None-Match
+// coincide con etag. "*" coincide siempre. Con weak se ignora el prefijo W/
+// (comparación débil de If-None-Match, RFC 9110 §8.8.3.2).
+func etagMatches(header, etag string, weak bool) bool {
+	if header == "" {
+		return false
+	}
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch exige que la petición traiga If-Match con la versión actual del
+// producto, para que dos ediciones simultáneas no se pisen. Responde 428 si falta
+// la cabecera y 412 si la versión no coincide; en ambos casos devuelve false.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, current models.Product) bool {
+	etag := productETag(current)
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		writeProblem(w, r, http.StatusPreconditionRequired, "if_match_required")
+		return false
+	}
+	if !etagMatches(header, etag, false) {
+		slog.InfoContext(r.Context(), "Conflicto de versión", "product_id", current.ID, "if_match", header, "etag", etag)
+		w.Header().Set("ETag", etag)
+		writeProblem(w, r, http.StatusPreconditionFailed, "version_conflict")
+		return false
+	}
+	return true
+}
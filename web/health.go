@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Sondas para el orquestador, montadas fuera de /api (sin authMiddleware):
+//
+//	GET /healthz  el proceso está vivo
+//	GET /readyz   puede recibir tráfico: datos inicializados, almacén accesible y no se está apagando
+//	GET /version  metadatos de compilación
+//
+// Sus peticiones se registran en el log de acceso con nivel debug.
+
+// Metadatos de compilación, inyectados al enlazar:
+//
+//	go build -ldflags "-X main.buildVersion=1.4.0 -X main.buildCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./web
+//
+// Si faltan, se usan los datos de VCS que go build incrusta en el binario.
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+	buildDate    = ""
+)
+
+// probePaths son las rutas de las sondas, que no se registran como peticiones normales
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true, "/version": true}
+
+var (
+	// serverReady se activa al terminar la inicialización (datos de ejemplo, almacenes, rutas)
+	serverReady atomic.Bool
+	// shuttingDown se activa al recibir la señal de parada: /readyz responde 503 para que
+	// el balanceador deje de enviar tráfico antes de cerrar las conexiones
+	shuttingDown atomic.Bool
+)
+
+// Parada ordenada: tras SIGTERM/SIGINT, /readyz responde 503 durante shutdownDelay
+// y después se esperan las peticiones en curso hasta shutdownTimeout
+var (
+	shutdownDelay   = envDuration("TIENDA_SHUTDOWN_DELAY", 5*time.Second)
+	shutdownTimeout = envDuration("TIENDA_SHUTDOWN_TIMEOUT", 15*time.Second)
+)
+
+// readinessTimeout limita cuánto puede tardar la comprobación del almacén
+const readinessTimeout = 2 * time.Second
+
+// healthProbePrefix es el prefijo de las claves que /readyz escribe, lee y borra en el
+// almacén de imágenes. Cada sonda usa una clave propia en la raíz del almacén: dos sondas
+// simultáneas no se pisan y al borrarla no queda ningún directorio que limpiar.
+const healthProbePrefix = "readyz-"
+
+// requireGet responde 405 si el método no es GET ni HEAD (rutas montadas fuera del router)
+func requireGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	writeProblem(w, r, http.StatusMethodNotAllowed, "method_not_allowed")
+	return false
+}
+
+// writeProbe escribe la respuesta JSON de una sonda, que nunca se cachea
+func writeProbe(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Handler de GET /healthz: si el proceso responde, está vivo
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+	writeProbe(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Handler de GET /readyz
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+
+	checks := map[string]string{"data": "ok", "blobstore": "ok", "shutdown": "ok"}
+	ready := true
+	if !serverReady.Load() {
+		checks["data"] = "inicialización en curso"
+		ready = false
+	}
+	if shuttingDown.Load() {
+		checks["shutdown"] = "el servidor se está deteniendo"
+		ready = false
+	}
+	// El error concreto (rutas del disco, credenciales del almacén) solo va al log
+	if err := checkBlobStore(r.Context()); err != nil {
+		slog.WarnContext(r.Context(), "El almacén de imágenes no está disponible", "error", err)
+		checks["blobstore"] = "no disponible"
+		ready = false
+	}
+
+	status, body := http.StatusOK, map[string]interface{}{"status": "ready", "checks": checks}
+	if !ready {
+		status, body["status"] = http.StatusServiceUnavailable, "not_ready"
+	}
+	writeProbe(w, status, body)
+}
+
+// checkBlobStore comprueba que el almacén de imágenes admite escrituras y lecturas
+func checkBlobStore(ctx context.Context) error {
+	if imageStore == nil {
+		return errBlobStoreNotConfigured
+	}
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	key := healthProbePrefix + uuid.New().String()
+	if err := imageStore.Put(ctx, key, []byte("ok")); err != nil {
+		return err
+	}
+	if _, err := imageStore.Get(ctx, key); err != nil {
+		return err
+	}
+	return imageStore.Delete(ctx, key)
+}
+
+// buildInfo son los metadatos que devuelve /version
+type buildInfo struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit,omitempty"`
+	BuildDate string    `json:"buildDate,omitempty"`
+	Modified  bool      `json:"modified,omitempty"` // compilado con cambios sin confirmar
+	GoVersion string    `json:"goVersion"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// currentBuildInfo combina las variables del enlazador con los datos de VCS del binario
+func currentBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   buildVersion,
+		Commit:    buildCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		StartedAt: processStartTime.UTC(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			case s.Key == "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// Handler de GET /version
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+	writeProbe(w, http.StatusOK, currentBuildInfo())
+}
+
+// runServer atiende peticiones hasta recibir SIGINT o SIGTERM y entonces se detiene
+// de forma ordenada. Devuelve nil si la parada fue limpia.
+func runServer(srv *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe() }()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	stop() // una segunda señal termina el proceso sin esperar
+
+	shuttingDown.Store(true)
+	slog.Info("Señal de parada recibida; dejando de aceptar tráfico", "delay", shutdownDelay.String())
+	time.Sleep(shutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
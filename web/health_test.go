@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useBlobStore sustituye el almacén de imágenes durante la prueba
+func useBlobStore(t *testing.T, store blobStore) {
+	t.Helper()
+	previous, ready := imageStore, serverReady.Load()
+	imageStore = store
+	serverReady.Store(true)
+	t.Cleanup(func() { imageStore = previous; serverReady.Store(ready) })
+}
+
+func readyz(t *testing.T) (int, map[string]string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body struct {
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("respuesta no válida: %s", rec.Body)
+	}
+	return rec.Code, body.Checks
+}
+
+// TestReadyzConcurrentProbes lanza varias sondas a la vez contra el almacén local: todas
+// deben pasar y no dejar nada en el almacén
+func TestReadyzConcurrentProbes(t *testing.T) {
+	root := t.TempDir()
+	useBlobStore(t, &localBlobStore{root: root})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if status, checks := readyz(t); status != http.StatusOK {
+					t.Errorf("/readyz = %d %v", status, checks)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("las sondas han dejado %d entradas en el almacén", len(entries))
+	}
+}
+
+// TestReadyzHidesStoreErrors comprueba que un fallo del almacén no expone rutas del disco
+func TestReadyzHidesStoreErrors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "no-es-un-directorio")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useBlobStore(t, &localBlobStore{root: file})
+
+	status, checks := readyz(t)
+	if status != http.StatusServiceUnavailable || checks["blobstore"] != "no disponible" {
+		t.Errorf("/readyz = %d %v; se esperaba 503 con blobstore no disponible", status, checks)
+	}
+	if strings.Contains(checks["blobstore"], file) {
+		t.Errorf("el estado expone la ruta del almacén: %q", checks["blobstore"])
+	}
+}
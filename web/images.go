@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // registra el decodificador GIF para image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	models "TiendaSupported/modules"
+)
+
+// Almacenamiento en memoria de los metadatos de las imágenes
+var (
+	productImages     []models.ProductImage
+	productImageIDSeq = 1
+)
+
+// Límites de subida: tamaño del archivo y número de píxeles, que acota la memoria
+// necesaria para decodificarla (una imagen pequeña comprimida puede ocupar gigas)
+var (
+	maxImageBytes  = int64(envInt("TIENDA_IMAGE_MAX_BYTES", 5<<20))
+	maxImagePixels = envInt("TIENDA_IMAGE_MAX_PIXELS", 40_000_000)
+)
+
+// imageExtensions son los formatos aceptados, por tipo detectado en el contenido
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// thumbnailSizes son las miniaturas que se generan al subir una imagen, de mayor a
+// menor: cada una se calcula a partir de la anterior. MaxSide es el lado mayor.
+var thumbnailSizes = []struct {
+	Name    string
+	MaxSide int
+}{
+	{"large", 1024},
+	{"medium", 480},
+	{"small", 160},
+}
+
+// Miniatura que se muestra como imagen del producto (Product.ImageURL)
+const productThumbnailSize = "small"
+
+// imageUploadForm describe el formulario multipart de subida; solo se usa para
+// generar la especificación OpenAPI
+type imageUploadForm struct {
+	Image   []byte `json:"image" validate:"required"` // archivo JPEG, PNG o GIF
+	Primary bool   `json:"primary"`                   // marcarla como imagen principal
+}
+
+// imageUpdateRequest es el cuerpo de PATCH sobre una imagen: posición en la galería
+// y/o marcarla como principal
+type imageUpdateRequest struct {
+	Position *int  `json:"position" validate:"min=1"`
+	Primary  *bool `json:"primary"`
+}
+
+// --- Claves y URLs ---
+
+// thumbnailContentType es el formato de las miniaturas: JPEG para fotos JPEG y PNG
+// para el resto, para conservar la transparencia
+func thumbnailContentType(img models.ProductImage) string {
+	if img.ContentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// imageBlobKey es la clave del archivo original o de una miniatura en el almacén
+func imageBlobKey(img models.ProductImage, size string) string {
+	ext := imageExtensions[img.ContentType]
+	if size != "original" {
+		ext = imageExtensions[thumbnailContentType(img)]
+	}
+	return fmt.Sprintf("products/%d/%d/%s%s", img.ProductID, img.ID, size, ext)
+}
+
+// imageSizes son los nombres de todos los archivos de una imagen
+func imageSizes() []string {
+	sizes := []string{"original"}
+	for _, t := range thumbnailSizes {
+		sizes = append(sizes, t.Name)
+	}
+	return sizes
+}
+
+func imageURLs(img models.ProductImage) map[string]string {
+	urls := make(map[string]string)
+	for _, size := range imageSizes() {
+		urls[size] = fmt.Sprintf("/api/products/%d/images/%d/%s", img.ProductID, img.ID, size)
+	}
+	return urls
+}
+
+// --- Miniaturas ---
+
+// renderThumbnails genera las miniaturas de src codificadas en contentType
+func renderThumbnails(ctx context.Context, src image.Image, contentType string) (map[string][]byte, error) {
+	_, span := startSpan(ctx, "images.thumbnails", "image.content_type", contentType, "image.width", src.Bounds().Dx(), "image.height", src.Bounds().Dy())
+	defer span.end()
+	bounds := src.Bounds()
+	current := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(current, current.Bounds(), src, bounds.Min, draw.Src)
+
+	thumbs := make(map[string][]byte)
+	for _, size := range thumbnailSizes {
+		current = scaleDown(current, size.MaxSide)
+		var buf bytes.Buffer
+		var err error
+		if contentType == "image/jpeg" {
+			err = jpeg.Encode(&buf, current, &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(&buf, current)
+		}
+		if err != nil {
+			return nil, err
+		}
+		thumbs[size.Name] = buf.Bytes()
+	}
+	return thumbs, nil
+}
+
+// scaleDown reduce la imagen promediando el área que cubre cada píxel de destino
+// (filtro de caja) para que su lado mayor no supere maxSide. Nunca la amplía.
+func scaleDown(src *image.RGBA, maxSide int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	if sw <= maxSide && sh <= maxSide {
+		return src
+	}
+	dw, dh := maxSide, maxSide
+	if sw >= sh {
+		dh = max(1, sh*maxSide/sw)
+	} else {
+		dw = max(1, sw*maxSide/sh)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			d := dst.Pix[y*dst.Stride+x*4:]
+			for c := 0; c < 4; c++ {
+				d[c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// --- Galería ---
+
+// productGallery devuelve las imágenes del producto ordenadas por posición
+func productGallery(productID int) []models.ProductImage {
+	gallery := make([]models.ProductImage, 0)
+	for _, img := range productImages {
+		if img.ProductID == productID {
+			gallery = append(gallery, img)
+		}
+	}
+	sort.Slice(gallery, func(i, j int) bool { return gallery[i].Position < gallery[j].Position })
+	return gallery
+}
+
+func productImageIndex(id int) int {
+	for i, img := range productImages {
+		if img.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// arrangeGallery numera de nuevo las posiciones en el orden dado y marca como
+// principal la imagen primaryID (o la primera si no hay ninguna principal)
+func arrangeGallery(order []models.ProductImage, primaryID int) {
+	if primaryID == 0 && len(order) > 0 {
+		primaryID = order[0].ID
+		for _, img := range order {
+			if img.Primary {
+				primaryID = img.ID
+			}
+		}
+	}
+	for position, img := range order {
+		i := productImageIndex(img.ID)
+		productImages[i].Position = position + 1
+		productImages[i].Primary = img.ID == primaryID
+	}
+}
+
+// syncProductImage actualiza Product.ImageURL con la miniatura de la imagen principal.
+// Como cambia la representación del producto, también cambia su versión (y su ETag)
+// y se guarda una revisión.
+func syncProductImage(r *http.Request, productIndex int) {
+	url := ""
+	for _, img := range productGallery(products[productIndex].ID) {
+		if img.Primary {
+			url = img.URLs[productThumbnailSize]
+		}
+	}
+	if products[productIndex].ImageURL != url {
+		products[productIndex].ImageURL = url
+		products[productIndex].UpdatedAt = time.Now()
+		products[productIndex].Version++
+		recordRevision(r, products[productIndex], revisionImage)
+	}
+}
+
+// deleteImageBlobs borra del almacén el original y las miniaturas de una imagen
+func deleteImageBlobs(ctx context.Context, img models.ProductImage) {
+	for _, size := range imageSizes() {
+		if err := imageStore.Delete(ctx, imageBlobKey(img, size)); err != nil {
+			slog.ErrorContext(ctx, "Error borrando la imagen", "key", imageBlobKey(img, size), "error", err)
+		}
+	}
+}
+
+// deleteProductImages borra todas las imágenes de un producto que se elimina
+func deleteProductImages(ctx context.Context, productID int) {
+	kept := productImages[:0]
+	for _, img := range productImages {
+		if img.ProductID == productID {
+			deleteImageBlobs(ctx, img)
+			continue
+		}
+		kept = append(kept, img)
+	}
+	productImages = kept
+}
+
+// imageFromPath localiza el producto {id} y su imagen {imageId}; si no existen
+// responde 404 y devuelve -1
+func imageFromPath(w http.ResponseWriter, r *http.Request) (productIndex, imageIndex int) {
+	productIndex = productIndexFromPath(w, r)
+	if productIndex == -1 {
+		return -1, -1
+	}
+	imageIndex = productImageIndex(pathInt(r, "imageId"))
+	if imageIndex == -1 || productImages[imageIndex].ProductID != products[productIndex].ID {
+		writeProblem(w, r, http.StatusNotFound, "image_not_found")
+		return -1, -1
+	}
+	return productIndex, imageIndex
+}
+
+// sanitizeFilename conserva solo el nombre base del archivo, sin caracteres de control
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	if runes := []rune(name); len(runes) > 200 {
+		name = string(runes[:200])
+	}
+	if name == "" || name == "." || name == "/" {
+		return "imagen"
+	}
+	return name
+}
+
+// --- Handlers ---
+
+// Handler que lista la galería de un producto
+func listProductImagesHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsRead); !ok {
+		return
+	}
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	productIndex := productIndexFromPath(w, r)
+	if productIndex == -1 {
+		return
+	}
+	json.NewEncoder(w).Encode(productGallery(products[productIndex].ID))
+}
+
+// Handler que sube una imagen (multipart/form-data, campo "image"). El tipo se
+// detecta a partir del contenido; la cabecera del archivo no se tiene en cuenta.
+func uploadProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requirePermission(w, r, permProductsWrite)
+	if !ok {
+		return
+	}
+	// Comprobar el producto antes de leer el archivo, sin bloquear el catálogo mientras
+	// se recibe y se escala; se vuelve a buscar antes de guardar
+	catalogMu.RLock()
+	found := productIndexFromPath(w, r) != -1
+	catalogMu.RUnlock()
+	if !found {
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		writeProblemDetail(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type", "Se esperaba multipart/form-data con el archivo en el campo image")
+		return
+	}
+
+	// Holgura sobre el tamaño de la imagen para las cabeceras y los demás campos
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageBytes+maxJSONBodyBytes)
+	tooLarge := func() {
+		writeProblemDetail(w, r, http.StatusRequestEntityTooLarge, "image_too_large",
+			"Máximo "+strconv.FormatInt(maxImageBytes, 10)+" bytes")
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "multipart_invalid")
+		return
+	}
+
+	var data []byte
+	filename := ""
+	primary := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				tooLarge()
+			} else {
+				writeProblem(w, r, http.StatusBadRequest, "multipart_invalid")
+			}
+			return
+		}
+
+		switch part.FormName() {
+		case "image":
+			if data != nil {
+				writeValidationProblem(w, r, fieldError("image", "image_single"))
+				return
+			}
+			data, err = io.ReadAll(io.LimitReader(part, maxImageBytes+1))
+			var maxErr *http.MaxBytesError
+			if int64(len(data)) > maxImageBytes || errors.As(err, &maxErr) {
+				tooLarge()
+				return
+			}
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, "multipart_invalid")
+				return
+			}
+			filename = sanitizeFilename(part.FileName())
+		case "primary":
+			value, _ := io.ReadAll(io.LimitReader(part, 16))
+			if primary, err = strconv.ParseBool(strings.TrimSpace(string(value))); err != nil {
+				writeValidationProblem(w, r, fieldError("primary", "field_invalid_type", "boolean"))
+				return
+			}
+		}
+		part.Close()
+	}
+	if len(data) == 0 {
+		writeValidationProblem(w, r, fieldError("image", "field_required"))
+		return
+	}
+
+	contentType := http.DetectContentType(data)
+	if _, ok := imageExtensions[contentType]; !ok {
+		writeProblemDetail(w, r, http.StatusUnsupportedMediaType, "image_type_unsupported", "Tipo detectado: "+contentType)
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "image_invalid")
+		return
+	}
+	if config.Width*config.Height > maxImagePixels {
+		writeProblemDetail(w, r, http.StatusBadRequest, "image_dimensions_too_large",
+			fmt.Sprintf("%dx%d píxeles; máximo %d", config.Width, config.Height, maxImagePixels))
+		return
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "image_invalid")
+		return
+	}
+	thumbs, err := renderThumbnails(r.Context(), src, contentType)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error generando miniaturas", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	productIndex := productIndexFromPath(w, r)
+	if productIndex == -1 {
+		return
+	}
+	productID := products[productIndex].ID
+	img := models.ProductImage{
+		ID:          productImageIDSeq,
+		ProductID:   productID,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Width:       config.Width,
+		Height:      config.Height,
+		CreatedAt:   time.Now(),
+	}
+	img.URLs = imageURLs(img)
+
+	thumbs["original"] = data
+	for _, size := range imageSizes() {
+		if err := imageStore.Put(r.Context(), imageBlobKey(img, size), thumbs[size]); err != nil {
+			slog.ErrorContext(r.Context(), "Error guardando la imagen", "key", imageBlobKey(img, size), "error", err)
+			deleteImageBlobs(r.Context(), img)
+			writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+			return
+		}
+	}
+	productImageIDSeq++
+
+	productImages = append(productImages, img)
+	primaryID := 0
+	if primary {
+		primaryID = img.ID
+	}
+	gallery := productGallery(productID)
+	arrangeGallery(append(gallery[1:], gallery[0]), primaryID) // la nueva (aún en posición 0) va al final
+	syncProductImage(r, productIndex)
+	img = productImages[productImageIndex(img.ID)]
+	recordAudit(r, user, auditEvent{Action: "product_image.create", TargetType: auditTargetImage, TargetID: strconv.Itoa(img.ID), After: img})
+	slog.InfoContext(r.Context(), "Imagen subida", "image_id", img.ID, "product_id", productID, "content_type", contentType, "width", img.Width, "height", img.Height, "user_id", user.ID)
+
+	w.Header().Set("Location", r.URL.Path+"/"+strconv.Itoa(img.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(img)
+}
+
+// Handler que devuelve los metadatos de una imagen
+func getProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsRead); !ok {
+		return
+	}
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	_, imageIndex := imageFromPath(w, r)
+	if imageIndex == -1 {
+		return
+	}
+	json.NewEncoder(w).Encode(productImages[imageIndex])
+}
+
+// Handler que cambia la posición de una imagen en la galería o la marca como principal
+func updateProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsWrite); !ok {
+		return
+	}
+	var req imageUpdateRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	productIndex, imageIndex := imageFromPath(w, r)
+	if imageIndex == -1 {
+		return
+	}
+	img := productImages[imageIndex]
+	if req.Primary != nil && !*req.Primary && img.Primary {
+		writeValidationProblem(w, r, fieldError("primary", "image_primary_required"))
+		return
+	}
+
+	gallery := productGallery(img.ProductID)
+	primaryID := 0
+	if req.Primary != nil && *req.Primary {
+		primaryID = img.ID
+	}
+	if req.Position != nil {
+		position := min(*req.Position, len(gallery))
+		others := make([]models.ProductImage, 0, len(gallery))
+		for _, g := range gallery {
+			if g.ID != img.ID {
+				others = append(others, g)
+			}
+		}
+		gallery = append(others[:position-1], append([]models.ProductImage{img}, others[position-1:]...)...)
+	}
+	arrangeGallery(gallery, primaryID)
+	syncProductImage(r, productIndex)
+	updated := productImages[productImageIndex(img.ID)]
+	recordAudit(r, nil, auditEvent{Action: "product_image.update", TargetType: auditTargetImage, TargetID: strconv.Itoa(img.ID), Before: img, After: updated})
+	json.NewEncoder(w).Encode(updated)
+}
+
+// Handler que elimina una imagen y sus miniaturas
+func deleteProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requirePermission(w, r, permProductsWrite)
+	if !ok {
+		return
+	}
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	productIndex, imageIndex := imageFromPath(w, r)
+	if imageIndex == -1 {
+		return
+	}
+
+	img := productImages[imageIndex]
+	deleteImageBlobs(r.Context(), img)
+	productImages = append(productImages[:imageIndex], productImages[imageIndex+1:]...)
+	arrangeGallery(productGallery(img.ProductID), 0)
+	syncProductImage(r, productIndex)
+	recordAudit(r, user, auditEvent{Action: "product_image.delete", TargetType: auditTargetImage, TargetID: strconv.Itoa(img.ID), Before: img})
+	slog.InfoContext(r.Context(), "Imagen eliminada", "image_id", img.ID, "product_id", img.ProductID, "user_id", user.ID)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Imagen eliminada exitosamente"})
+}
+
+// Handler que sirve el archivo original o una miniatura. El contenido de una imagen
+// no cambia nunca (se sube otra), así que puede cachearse indefinidamente.
+func productImageContentHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsRead); !ok {
+		return
+	}
+	catalogMu.RLock()
+	_, imageIndex := imageFromPath(w, r)
+	if imageIndex == -1 {
+		catalogMu.RUnlock()
+		return
+	}
+	img := productImages[imageIndex]
+	catalogMu.RUnlock()
+
+	size := pathParam(r, "size")
+	valid := false
+	for _, s := range imageSizes() {
+		valid = valid || s == size
+	}
+	if !valid {
+		writeProblemDetail(w, r, http.StatusNotFound, "image_not_found", "Tamaños disponibles: "+strings.Join(imageSizes(), ", "))
+		return
+	}
+
+	data, err := imageStore.Get(r.Context(), imageBlobKey(img, size))
+	if errors.Is(err, errBlobNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "image_not_found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error leyendo la imagen", "key", imageBlobKey(img, size), "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+
+	contentType := thumbnailContentType(img)
+	if size == "original" {
+		contentType = img.ContentType
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": img.Filename}))
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("ETag", fmt.Sprintf(`"img-%d-%s"`, img.ID, size))
+	http.ServeContent(w, r, "", img.CreatedAt, bytes.NewReader(data))
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// Importación masiva de productos (POST /products/import) desde CSV o JSON Lines.
+// Cada fila crea un producto o, si trae el sku de uno existente, actualiza los campos
+// presentes en la fila. Opciones de la consulta:
+//
+//	mapping=name:Nombre,price:PVP  columna (CSV) o clave (JSON Lines) de origen de cada campo
+//	mode=atomic|best-effort        atomic (por defecto): si una fila falla no se aplica ninguna
+//	dryRun=true                    valida y cuenta altas y actualizaciones sin aplicar nada
+//	async=true                     responde 202 y procesa en segundo plano
+//
+// Los archivos de más de TIENDA_IMPORT_ASYNC_ROWS filas se procesan siempre en segundo
+// plano; el progreso se consulta en GET /products/import/{jobId}.
+
+// Tipos de contenido aceptados
+const (
+	mediaTypeCSV    = "text/csv"
+	mediaTypeNDJSON = "application/x-ndjson"
+	mediaTypeJSONL  = "application/jsonl"
+)
+
+// Modos de importación
+const (
+	importModeAtomic     = "atomic"
+	importModeBestEffort = "best-effort"
+)
+
+// Estados de un trabajo de importación
+const (
+	importPending   = "pending"
+	importRunning   = "running"
+	importCompleted = "completed"
+	importFailed    = "failed" // modo atomic con errores: no se aplicó nada
+)
+
+var (
+	importMaxBytes  = int64(envInt("TIENDA_IMPORT_MAX_BYTES", 10<<20))
+	importMaxRows   = envInt("TIENDA_IMPORT_MAX_ROWS", 10000)
+	importAsyncRows = envInt("TIENDA_IMPORT_ASYNC_ROWS", 500)
+)
+
+// importChunkSize es el número de filas que se aplican con cada toma de catalogMu en
+// modo best-effort, para no bloquear el catálogo durante toda la importación
+const importChunkSize = 100
+
+// importJobTTL es cuánto se conserva un trabajo terminado para poder consultarlo
+const importJobTTL = 24 * time.Hour
+
+var (
+	importMu       sync.Mutex
+	importJobs     = make([]*importJob, 0)
+	importJobIDSeq = 1
+)
+
+// importRowError son los errores de una fila; Row es su línea en el archivo
+type importRowError struct {
+	Row    int          `json:"row"`
+	SKU    string       `json:"sku,omitempty"`
+	Errors []FieldError `json:"errors"`
+}
+
+// importReport es el estado de un trabajo: la respuesta de la importación y de su consulta
+type importReport struct {
+	ID             int              `json:"id"`
+	Status         string           `json:"status"`
+	Format         string           `json:"format"` // csv o jsonl
+	Mode           string           `json:"mode"`
+	DryRun         bool             `json:"dryRun"`
+	Total          int              `json:"total"`
+	Processed      int              `json:"processed"`
+	Created        int              `json:"created"`
+	Updated        int              `json:"updated"`
+	Unchanged      int              `json:"unchanged"` // sku existente sin cambios en la fila
+	Failed         int              `json:"failed"`
+	Errors         []importRowError `json:"errors"`
+	IgnoredColumns []string         `json:"ignoredColumns,omitempty"` // columnas CSV que no corresponden a ningún campo
+	CreatedAt      time.Time        `json:"createdAt"`
+	FinishedAt     *time.Time       `json:"finishedAt,omitempty"`
+}
+
+// importJob es un trabajo de importación; report se protege con importMu
+type importJob struct {
+	report importReport
+	userID int
+	rows   []importRow
+}
+
+// importRow es una fila del archivo ya traducida a miembros JSON del producto
+type importRow struct {
+	line    int
+	members map[string]json.RawMessage
+	errs    []FieldError // errores de lectura de la fila (p. ej. JSON inválido)
+}
+
+// importFields son los campos que puede traer una fila: los que no son de solo lectura
+func importFields() []string {
+	t := reflect.TypeOf(models.Product{})
+	fields := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name := jsonFieldName(t.Field(i)); name != "" && !hasRule(t.Field(i), "readonly") {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// parseImportMapping interpreta "campo:origen" separados por comas
+func parseImportMapping(spec string) (map[string]string, []FieldError) {
+	mapping := make(map[string]string)
+	if spec == "" {
+		return mapping, nil
+	}
+	fields := importFields()
+	for _, item := range strings.Split(spec, ",") {
+		field, source, ok := strings.Cut(item, ":")
+		field, source = strings.TrimSpace(field), strings.TrimSpace(source)
+		if !ok || source == "" || !slices.Contains(fields, field) {
+			return nil, []FieldError{fieldError("mapping", "field_invalid_choice", strings.Join(fields, ", "))}
+		}
+		mapping[field] = source
+	}
+	return mapping, nil
+}
+
+// errImportFile es un error de formato de todo el archivo (400 import_invalid)
+type errImportFile struct{ detail string }
+
+func (e *errImportFile) Error() string { return e.detail }
+
+// parseCSVImport lee un CSV con cabecera. El separador es la coma o, si la cabecera
+// solo contiene punto y coma, el punto y coma (lo habitual en hojas de cálculo en
+// español); en ese caso también se aceptan la coma decimal y el punto de miles en los
+// números ("1.234,56"). Un número con un único punto y sin coma ("1.234") es ambiguo y
+// se lee con el punto como decimal.
+func parseCSVImport(body []byte, mapping map[string]string) ([]importRow, []string, error) {
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")) // BOM de Excel
+	firstLine, _, _ := bytes.Cut(body, []byte("\n"))
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	semicolon := bytes.Contains(firstLine, []byte(";")) && !bytes.Contains(firstLine, []byte(","))
+	if semicolon {
+		reader.Comma = ';'
+	}
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, &errImportFile{err.Error()}
+	}
+
+	// Columna de origen de cada campo
+	columns := make(map[string]int)
+	used := make(map[int]bool)
+	for _, field := range importFields() {
+		source, mapped := mapping[field]
+		if !mapped {
+			source = field
+		}
+		col := -1
+		for i, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), source) {
+				col = i
+				break
+			}
+		}
+		if col == -1 {
+			if mapped {
+				return nil, nil, &errImportFile{fmt.Sprintf("La columna %q del mapping no está en la cabecera", source)}
+			}
+			continue
+		}
+		columns[field], used[col] = col, true
+	}
+	var ignored []string
+	for i, name := range header {
+		if !used[i] {
+			ignored = append(ignored, name)
+		}
+	}
+
+	productType := reflect.TypeOf(models.Product{})
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, &errImportFile{err.Error()}
+		}
+		line, _ := reader.FieldPos(0)
+		row := importRow{line: line, members: make(map[string]json.RawMessage)}
+		for field, col := range columns {
+			if col >= len(record) || strings.TrimSpace(record[col]) == "" {
+				continue // celda vacía: en una actualización se conserva el valor actual
+			}
+			row.members[field] = csvValueJSON(productType, field, strings.TrimSpace(record[col]), semicolon)
+		}
+		if len(row.members) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	return rows, ignored, nil
+}
+
+// csvGroupedNumber es un número con punto de miles y coma decimal, p. ej. "1.234,56"
+var csvGroupedNumber = regexp.MustCompile(`^[+-]?[0-9]{1,3}(\.[0-9]{3})+,[0-9]+$`)
+
+// csvValueJSON convierte una celda al JSON del tipo del campo. Si un campo numérico no
+// trae un número se envía como texto para que la validación informe del tipo esperado.
+func csvValueJSON(t reflect.Type, field, value string, decimalComma bool) json.RawMessage {
+	for i := 0; i < t.NumField(); i++ {
+		if jsonFieldName(t.Field(i)) != field || t.Field(i).Type.Kind() == reflect.String {
+			continue
+		}
+		if decimalComma && csvGroupedNumber.MatchString(value) {
+			value = strings.ReplaceAll(value, ".", "")
+		}
+		if decimalComma && !strings.Contains(value, ".") {
+			value = strings.Replace(value, ",", ".", 1)
+		}
+		if _, err := strconv.ParseFloat(value, 64); err == nil && json.Valid([]byte(value)) {
+			return json.RawMessage(value)
+		}
+	}
+	data, _ := json.Marshal(value)
+	return data
+}
+
+// parseJSONLinesImport lee un objeto JSON por línea; las líneas en blanco se ignoran.
+// Las claves del mapping se renombran al campo; las demás se validan tal cual.
+func parseJSONLinesImport(body []byte, mapping map[string]string) []importRow {
+	var rows []importRow
+	for i, text := range bytes.Split(body, []byte("\n")) {
+		text = bytes.TrimSpace(text)
+		if len(text) == 0 {
+			continue
+		}
+		row := importRow{line: i + 1}
+		dec := json.NewDecoder(bytes.NewReader(text))
+		if err := dec.Decode(&row.members); err != nil || row.members == nil || dec.More() {
+			row.errs = []FieldError{fieldError("row", "import_row_invalid_json")}
+			rows = append(rows, row)
+			continue
+		}
+		for field, source := range mapping {
+			if value, ok := row.members[source]; ok {
+				delete(row.members, source)
+				row.members[field] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Handler de POST /products/import (Admin o Editor)
+func importProductsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requirePermission(w, r, permProductsWrite)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	var errs []FieldError
+	mode := query.Get("mode")
+	switch mode {
+	case "":
+		mode = importModeAtomic
+	case importModeAtomic, importModeBestEffort:
+	default:
+		errs = append(errs, fieldError("mode", "field_invalid_choice", importModeAtomic+", "+importModeBestEffort))
+	}
+	dryRun, async := false, false
+	for _, p := range []struct {
+		name string
+		dst  *bool
+	}{{"dryRun", &dryRun}, {"async", &async}} {
+		if value := query.Get(p.name); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fieldError(p.name, "field_invalid_type", "boolean"))
+			}
+			*p.dst = b
+		}
+	}
+	mapping, mappingErrs := parseImportMapping(query.Get("mapping"))
+	if errs = append(errs, mappingErrs...); len(errs) > 0 {
+		writeValidationProblem(w, r, errs...)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	format := ""
+	switch mediaType {
+	case mediaTypeCSV:
+		format = "csv"
+	case mediaTypeNDJSON, mediaTypeJSONL:
+		format = "jsonl"
+	default:
+		writeProblemDetail(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type", "Usa "+mediaTypeCSV+" o "+mediaTypeNDJSON)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, importMaxBytes))
+	r.Body.Close()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeProblemDetail(w, r, http.StatusRequestEntityTooLarge, "payload_too_large", "Máximo "+strconv.FormatInt(importMaxBytes, 10)+" bytes")
+		return
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "Error leyendo el archivo de importación", "error", err)
+		writeProblem(w, r, http.StatusBadRequest, "import_invalid")
+		return
+	}
+
+	var rows []importRow
+	var ignored []string
+	if format == "csv" {
+		rows, ignored, err = parseCSVImport(body, mapping)
+	} else {
+		rows = parseJSONLinesImport(body, mapping)
+	}
+	var fileErr *errImportFile
+	switch {
+	case errors.As(err, &fileErr):
+		writeProblemDetail(w, r, http.StatusBadRequest, "import_invalid", fileErr.detail)
+		return
+	case len(rows) == 0:
+		writeProblem(w, r, http.StatusBadRequest, "import_empty")
+		return
+	case len(rows) > importMaxRows:
+		writeProblemDetail(w, r, http.StatusRequestEntityTooLarge, "import_too_many_rows", "Máximo "+strconv.Itoa(importMaxRows)+" filas")
+		return
+	}
+
+	job := newImportJob(user, format, mode, dryRun, rows, ignored)
+	location := strings.TrimSuffix(r.URL.Path, "/") + "/" + strconv.Itoa(job.report.ID)
+	w.Header().Set("Location", location)
+
+	if async || len(rows) > importAsyncRows {
+		// La petición termina antes que el trabajo: se conservan sus valores (usuario,
+		// ID de petición) para la auditoría, sin su cancelación
+		detached := r.Clone(context.WithoutCancel(r.Context()))
+		go runImport(detached, job)
+		writeImportReport(w, r, http.StatusAccepted, job)
+		return
+	}
+
+	runImport(r, job)
+	if report := job.snapshot(); report.Status == importFailed {
+		// Los errores de cada fila se aplanan como "rows[línea].campo"; el informe
+		// completo sigue disponible en Location
+		var errs []FieldError
+		for _, rowErr := range report.Errors {
+			for _, e := range rowErr.Errors {
+				e.Field = fmt.Sprintf("rows[%d].%s", rowErr.Row, e.Field)
+				errs = append(errs, e)
+			}
+		}
+		writeProblemResponse(w, r, Problem{Status: http.StatusUnprocessableEntity, Code: "import_failed", Errors: errs})
+		return
+	}
+	writeImportReport(w, r, http.StatusOK, job)
+}
+
+// Handler de GET /products/import/{jobId}: estado y progreso de un trabajo. Cada
+// usuario ve los suyos; el Admin, todos.
+func getImportJobHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requirePermission(w, r, permProductsWrite)
+	if !ok {
+		return
+	}
+	id := pathInt(r, "jobId")
+	importMu.Lock()
+	var job *importJob
+	for _, j := range importJobs {
+		if j.report.ID == id && (j.userID == user.ID || can(r, user, permAdmin)) {
+			job = j
+		}
+	}
+	importMu.Unlock()
+	if job == nil {
+		writeProblem(w, r, http.StatusNotFound, "import_job_not_found")
+		return
+	}
+	writeImportReport(w, r, http.StatusOK, job)
+}
+
+// newImportJob registra un trabajo pendiente y descarta los terminados hace más de importJobTTL
+func newImportJob(user *models.User, format, mode string, dryRun bool, rows []importRow, ignored []string) *importJob {
+	importMu.Lock()
+	defer importMu.Unlock()
+	now := time.Now()
+	kept := importJobs[:0]
+	for _, j := range importJobs {
+		if j.report.FinishedAt == nil || now.Sub(*j.report.FinishedAt) < importJobTTL {
+			kept = append(kept, j)
+		}
+	}
+	importJobs = kept
+
+	job := &importJob{
+		userID: user.ID,
+		rows:   rows,
+		report: importReport{
+			ID:             importJobIDSeq,
+			Status:         importPending,
+			Format:         format,
+			Mode:           mode,
+			DryRun:         dryRun,
+			Total:          len(rows),
+			Errors:         make([]importRowError, 0),
+			IgnoredColumns: ignored,
+			CreatedAt:      now,
+		},
+	}
+	importJobIDSeq++
+	importJobs = append(importJobs, job)
+	return job
+}
+
+// snapshot copia el estado del trabajo para leerlo sin importMu
+func (j *importJob) snapshot() importReport {
+	importMu.Lock()
+	defer importMu.Unlock()
+	report := j.report
+	report.Errors = append(make([]importRowError, 0, len(j.report.Errors)), j.report.Errors...)
+	return report
+}
+
+// update modifica el estado del trabajo con importMu tomado
+func (j *importJob) update(fn func(*importReport)) {
+	importMu.Lock()
+	defer importMu.Unlock()
+	fn(&j.report)
+}
+
+// writeImportReport responde el estado del trabajo con los mensajes de error localizados
+func writeImportReport(w http.ResponseWriter, r *http.Request, status int, job *importJob) {
+	report := job.snapshot()
+	for i, rowErr := range report.Errors {
+		localized := make([]FieldError, len(rowErr.Errors))
+		for k, e := range rowErr.Errors {
+			e.Message = localize(r, e.Code, e.Args...)
+			localized[k] = e
+		}
+		report.Errors[i].Errors = localized
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// importPlan es el resultado de validar una fila: el producto resultante y, si
+// actualiza uno existente, su posición en products
+type importPlan struct {
+	row     importRow
+	product models.Product
+	index   int // -1: alta
+	errs    []FieldError
+}
+
+// planImportRow valida una fila contra el catálogo. seen guarda la línea de cada sku
+// ya visto en el archivo: repetirlo sería ambiguo. Debe llamarse con catalogMu tomado.
+func planImportRow(row importRow, seen map[string]int) importPlan {
+	plan := importPlan{row: row, index: -1, errs: row.errs}
+	if len(plan.errs) > 0 {
+		return plan
+	}
+
+	var sku string
+	if raw, ok := row.members["sku"]; ok && json.Unmarshal(raw, &sku) == nil && sku != "" {
+		key := strings.ToLower(sku)
+		if line, dup := seen[key]; dup {
+			plan.errs = []FieldError{fieldError("sku", "import_sku_repeated", line)}
+			return plan
+		}
+		seen[key] = row.line
+		if plan.index = findProductBySKU(sku); plan.index != -1 {
+			if products[plan.index].DeletedAt != nil {
+				plan.errs = []FieldError{fieldError("sku", "import_sku_in_trash")}
+				return plan
+			}
+			plan.product = products[plan.index]
+		}
+	}
+	plan.errs = assignMembers(row.members, &plan.product)
+	return plan
+}
+
+// applyImportPlan crea o actualiza el producto de una fila válida y devuelve si hubo
+// cambios. Debe llamarse con catalogMu tomado.
+func applyImportPlan(r *http.Request, plan importPlan) bool {
+	now := time.Now()
+	p := plan.product
+	if plan.index == -1 {
+		p.ID = productIDSeq
+		productIDSeq++
+		p.CreatedAt, p.UpdatedAt, p.Version = now, now, 1
+		products = append(products, p)
+		recordRevision(r, p, revisionCreate)
+		recordAudit(r, nil, auditEvent{Action: "product.create", TargetType: auditTargetProduct, TargetID: strconv.Itoa(p.ID), After: p})
+		return true
+	}
+
+	before := products[plan.index]
+	if reflect.DeepEqual(before, p) {
+		return false
+	}
+	p.UpdatedAt = now
+	p.Version++
+	products[plan.index] = p
+	recordRevision(r, p, revisionUpdate)
+	recordAudit(r, nil, auditEvent{Action: "product.update", TargetType: auditTargetProduct, TargetID: strconv.Itoa(p.ID), Before: before, After: p})
+	return true
+}
+
+// runImport valida y aplica las filas del trabajo. En modo atomic todo se hace con
+// catalogMu tomado, de modo que o se aplican todas las filas o ninguna; en best-effort
+// se aplica por bloques y las filas inválidas se omiten.
+func runImport(r *http.Request, job *importJob) {
+	ctx, sp := startSpan(r.Context(), "products.import", "import.id", job.report.ID, "import.rows", len(job.rows))
+	defer sp.end()
+	r = r.WithContext(ctx)
+	job.update(func(rep *importReport) { rep.Status = importRunning })
+
+	seen := make(map[string]int)
+	record := func(plan importPlan, changed bool) {
+		job.update(func(rep *importReport) {
+			rep.Processed++
+			switch {
+			case len(plan.errs) > 0:
+				rep.Failed++
+				sku, _ := jsonString(plan.row.members["sku"])
+				rep.Errors = append(rep.Errors, importRowError{Row: plan.row.line, SKU: sku, Errors: plan.errs})
+			case plan.index == -1:
+				rep.Created++
+			case changed:
+				rep.Updated++
+			default:
+				rep.Unchanged++
+			}
+		})
+	}
+
+	if job.report.Mode == importModeAtomic {
+		catalogMu.Lock()
+		plans := make([]importPlan, len(job.rows))
+		failed := false
+		for i, row := range job.rows {
+			plans[i] = planImportRow(row, seen)
+			failed = failed || len(plans[i].errs) > 0
+		}
+		for _, plan := range plans {
+			changed := plan.index == -1 || !reflect.DeepEqual(products[plan.index], plan.product)
+			if !failed && !job.report.DryRun {
+				changed = applyImportPlan(r, plan)
+			}
+			record(plan, changed)
+		}
+		catalogMu.Unlock()
+		if failed {
+			job.update(func(rep *importReport) { rep.Created, rep.Updated, rep.Unchanged = 0, 0, 0 })
+		}
+	} else {
+		for start := 0; start < len(job.rows); start += importChunkSize {
+			catalogMu.Lock()
+			for _, row := range job.rows[start:min(start+importChunkSize, len(job.rows))] {
+				plan := planImportRow(row, seen)
+				changed := plan.index == -1 || !reflect.DeepEqual(products[plan.index], plan.product)
+				if len(plan.errs) == 0 && !job.report.DryRun {
+					changed = applyImportPlan(r, plan)
+				}
+				record(plan, changed)
+			}
+			catalogMu.Unlock()
+		}
+	}
+
+	job.update(func(rep *importReport) {
+		now := time.Now()
+		rep.FinishedAt = &now
+		rep.Status = importCompleted
+		if rep.Mode == importModeAtomic && rep.Failed > 0 {
+			rep.Status = importFailed
+		}
+	})
+	job.rows = nil
+	report := job.snapshot()
+	sp.setAttributes("import.created", report.Created, "import.updated", report.Updated, "import.failed", report.Failed)
+	slog.InfoContext(ctx, "Importación de productos terminada", "import_id", report.ID, "status", report.Status, "dry_run", report.DryRun,
+		"rows", report.Total, "created", report.Created, "updated", report.Updated, "failed", report.Failed)
+}
+
+// jsonString decodifica un miembro JSON de texto; falso si no lo es
+func jsonString(raw json.RawMessage) (string, bool) {
+	var s string
+	if raw == nil || json.Unmarshal(raw, &s) != nil {
+		return "", false
+	}
+	return s, true
+}
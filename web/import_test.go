@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// useCatalog deja products y su historial como estaban al terminar la prueba
+func useCatalog(t *testing.T) {
+	t.Helper()
+	catalogMu.Lock()
+	saved, seq, revisions := append([]models.Product(nil), products...), productIDSeq, productRevisions
+	catalogMu.Unlock()
+	t.Cleanup(func() {
+		catalogMu.Lock()
+		products, productIDSeq, productRevisions = saved, seq, revisions
+		catalogMu.Unlock()
+	})
+}
+
+// importer envía archivos de importación con la sesión de un Admin
+type importer struct {
+	t      *testing.T
+	url    string
+	cookie *http.Cookie
+}
+
+func newImporter(t *testing.T) importer {
+	t.Helper()
+	srv := newTestServer(t)
+	useCatalog(t)
+	return importer{t: t, url: srv.URL, cookie: testSessionCookie(t, "Admin")}
+}
+
+func (im importer) post(query, contentType, body string) testResponse {
+	im.t.Helper()
+	req, err := http.NewRequest(http.MethodPost, im.url+"/api/v2/products/import?"+query, strings.NewReader(body))
+	if err != nil {
+		im.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(csrfHeader, csrfTokenFor(im.cookie.Value))
+	req.AddCookie(im.cookie)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		im.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	res := testResponse{status: resp.StatusCode, header: resp.Header}
+	json.NewDecoder(resp.Body).Decode(&res.body)
+	return res
+}
+
+// productsWithSKU devuelve los productos cuyo sku empieza por prefix, indexados por sku
+func productsWithSKU(prefix string) map[string]models.Product {
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	found := make(map[string]models.Product)
+	for _, p := range products {
+		if strings.HasPrefix(p.SKU, prefix) {
+			found[p.SKU] = p
+		}
+	}
+	return found
+}
+
+// expectCounts compara los contadores de un informe de importación
+func expectCounts(t *testing.T, res testResponse, created, updated, failed int) {
+	t.Helper()
+	got := []interface{}{res.body["created"], res.body["updated"], res.body["failed"]}
+	if want := []interface{}{float64(created), float64(updated), float64(failed)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("created/updated/failed = %v, se esperaba %v (%v)", got, want, res.body)
+	}
+}
+
+func TestCSVValueJSON(t *testing.T) {
+	product := reflect.TypeOf(models.Product{})
+	for _, tc := range []struct {
+		field, value string
+		decimalComma bool
+		want         string
+	}{
+		{"price", "12.5", false, `12.5`},
+		{"price", "12,5", false, `"12,5"`},
+		{"price", "12,5", true, `12.5`},
+		{"price", "1.234,56", true, `1234.56`},
+		{"price", "-12.345.678,9", true, `-12345678.9`},
+		{"price", "1.234", true, `1.234`}, // ambiguo: punto decimal
+		{"price", "1.23,4", true, `"1.23,4"`},
+		{"price", "1.234,56", false, `"1.234,56"`},
+		{"stock", "abc", true, `"abc"`},
+		{"name", "1,5", true, `"1,5"`},
+	} {
+		if got := string(csvValueJSON(product, tc.field, tc.value, tc.decimalComma)); got != tc.want {
+			t.Errorf("csvValueJSON(%s, %q, %v) = %s, se esperaba %s", tc.field, tc.value, tc.decimalComma, got, tc.want)
+		}
+	}
+}
+
+func TestImportModes(t *testing.T) {
+	im := newImporter(t)
+	const file = "sku,name,price,stock\nT-IMP-1,Mesa,10,1\nT-IMP-2,Silla,-1,2\nT-IMP-3,Lámpara,5,3\n"
+
+	// atomic: una fila inválida impide aplicar las demás
+	res := im.post("", mediaTypeCSV, file)
+	if res.status != http.StatusUnprocessableEntity || res.code() != "import_failed" {
+		t.Fatalf("atomic con errores: %d %s", res.status, res.code())
+	}
+	if errs, _ := res.body["errors"].([]interface{}); len(errs) != 1 || errs[0].(map[string]interface{})["field"] != "rows[3].price" {
+		t.Errorf("errores = %v, se esperaba rows[3].price", res.body["errors"])
+	}
+	if found := productsWithSKU("T-IMP-"); len(found) != 0 {
+		t.Fatalf("atomic con errores no debería aplicar filas: %v", found)
+	}
+
+	// dryRun: cuenta sin aplicar
+	res = im.post("mode=best-effort&dryRun=true", mediaTypeCSV, file)
+	if res.status != http.StatusOK {
+		t.Fatalf("dryRun: %d %s", res.status, res.code())
+	}
+	expectCounts(t, res, 2, 0, 1)
+	if found := productsWithSKU("T-IMP-"); len(found) != 0 {
+		t.Fatalf("dryRun no debería modificar el catálogo: %v", found)
+	}
+
+	// best-effort: se aplican las filas válidas
+	res = im.post("mode=best-effort", mediaTypeCSV, file)
+	if res.status != http.StatusOK || res.body["status"] != importCompleted {
+		t.Fatalf("best-effort: %d %v", res.status, res.body)
+	}
+	expectCounts(t, res, 2, 0, 1)
+	if found := productsWithSKU("T-IMP-"); len(found) != 2 || found["T-IMP-1"].Name != "Mesa" {
+		t.Fatalf("productos tras best-effort: %v", found)
+	}
+
+	// El mismo sku actualiza solo los campos presentes en la fila
+	res = im.post("", mediaTypeNDJSON, `{"sku":"T-IMP-1","price":12}`+"\n"+`{"sku":"T-IMP-3","stock":3}`)
+	expectCounts(t, res, 0, 1, 0)
+	if res.body["unchanged"] != float64(1) {
+		t.Errorf("unchanged = %v, se esperaba 1", res.body["unchanged"])
+	}
+	if p := productsWithSKU("T-IMP-")["T-IMP-1"]; p.Price != 12 || p.Name != "Mesa" || p.Version != 2 {
+		t.Errorf("producto actualizado: %+v", p)
+	}
+}
+
+func TestImportDuplicateSKU(t *testing.T) {
+	im := newImporter(t)
+	res := im.post("", mediaTypeCSV, "sku,name\nT-DUP,Uno\nt-dup,Dos\n")
+	if res.status != http.StatusUnprocessableEntity {
+		t.Fatalf("sku repetido: %d %s", res.status, res.code())
+	}
+	errs, _ := res.body["errors"].([]interface{})
+	if len(errs) != 1 || errs[0].(map[string]interface{})["code"] != "import_sku_repeated" || errs[0].(map[string]interface{})["field"] != "rows[3].sku" {
+		t.Errorf("errores = %v, se esperaba import_sku_repeated en rows[3].sku", errs)
+	}
+	if found := productsWithSKU("T-DUP"); len(found) != 0 {
+		t.Errorf("no debería haberse aplicado ninguna fila: %v", found)
+	}
+}
+
+func TestImportSemicolonCSV(t *testing.T) {
+	im := newImporter(t)
+	// Formato de una hoja de cálculo en español: BOM, punto y coma, coma decimal y punto de miles
+	res := im.post("mapping=name:Nombre,price:PVP", mediaTypeCSV+"; charset=utf-8",
+		"\xef\xbb\xbfsku;Nombre;PVP;stock;Notas\nT-ES-1;Escritorio;1.234,56;2;x\nT-ES-2;Silla;49,9;;\n")
+	if res.status != http.StatusOK {
+		t.Fatalf("CSV con punto y coma: %d %v", res.status, res.body)
+	}
+	expectCounts(t, res, 2, 0, 0)
+	if ignored, _ := res.body["ignoredColumns"].([]interface{}); len(ignored) != 1 || ignored[0] != "Notas" {
+		t.Errorf("ignoredColumns = %v, se esperaba [Notas]", res.body["ignoredColumns"])
+	}
+	found := productsWithSKU("T-ES-")
+	if found["T-ES-1"].Price != 1234.56 || found["T-ES-2"].Price != 49.9 || found["T-ES-1"].Name != "Escritorio" {
+		t.Errorf("productos importados: %+v", found)
+	}
+}
+
+func TestImportAsyncJob(t *testing.T) {
+	im := newImporter(t)
+	res := im.post("async=true&mode=best-effort", mediaTypeCSV, "sku,name,price\nT-ASYNC-1,Uno,1\nT-ASYNC-2,,2\n")
+	location := res.header.Get("Location")
+	if res.status != http.StatusAccepted || location == "" {
+		t.Fatalf("async: %d, Location %q", res.status, location)
+	}
+
+	// Consultar el trabajo hasta que termine
+	deadline := time.Now().Add(5 * time.Second)
+	var report testResponse
+	for {
+		report = sendJSON(t, http.MethodGet, im.url+location, nil, im.cookie, nil)
+		if report.status != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", location, report.status, report.code())
+		}
+		if report.body["status"] == importCompleted || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if report.body["status"] != importCompleted || report.body["processed"] != float64(2) || report.body["total"] != float64(2) {
+		t.Fatalf("informe del trabajo: %v", report.body)
+	}
+	expectCounts(t, report, 1, 0, 1)
+	errs, _ := report.body["errors"].([]interface{})
+	if len(errs) != 1 || errs[0].(map[string]interface{})["sku"] != "T-ASYNC-2" {
+		t.Errorf("errores = %v, se esperaba la fila de T-ASYNC-2", errs)
+	}
+
+	// Otro usuario sin permisos de Admin no ve el trabajo
+	other := testSessionCookie(t, "Editor")
+	if res := sendJSON(t, http.MethodGet, im.url+location, nil, other, nil); res.status != http.StatusNotFound {
+		t.Errorf("trabajo de otro usuario: %d %s", res.status, res.code())
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	models "TiendaSupported/modules"
+
+	"github.com/google/uuid"
+)
+
+// Modos de sesión disponibles
+const (
+	sessionModeOpaque = "opaque" // UUID opaco guardado en el slice sessions (por defecto)
+	sessionModeJWT    = "jwt"    // access token JWT firmado + refresh token rotativo
+)
+
+const (
+	jwtIssuer          = "TiendaSupported"
+	refreshTokenPrefix = "tsr_"
+	refreshCookieName  = "refresh_token"
+	refreshCookiePath  = "/api/auth"
+	jwtAlgHS256        = "HS256"
+	jwtAlgEdDSA        = "EdDSA"
+	jwtHS256SecretSize = 32
+)
+
+var (
+	sessionMode     = getEnv("TIENDA_SESSION_MODE", sessionModeOpaque)
+	jwtAccessTTL    = envDuration("TIENDA_JWT_ACCESS_TTL", 15*time.Minute)
+	jwtRefreshTTL   = envDuration("TIENDA_JWT_REFRESH_TTL", 30*24*time.Hour)
+	jwtKeys         *jwtKeyring
+	refreshTokens   = make([]models.RefreshToken, 0)
+	refreshTokenSeq = 1
+	// refreshTokensMu protege refreshTokens y refreshTokenSeq. La rotación lo mantiene
+	// desde que busca el token hasta que guarda el siguiente, de modo que dos usos
+	// simultáneos del mismo token no pueden rotarlo ambos.
+	refreshTokensMu sync.Mutex
+
+	errInvalidJWT = errors.New("token JWT inválido")
+)
+
+// jwtKey es una clave de firma identificada por su kid
+type jwtKey struct {
+	Kid       string
+	Alg       string
+	Secret    []byte             // HS256
+	Private   ed25519.PrivateKey // EdDSA
+	Public    ed25519.PublicKey  // EdDSA
+	CreatedAt time.Time
+	RetiredAt *time.Time // nil mientras es la clave activa
+}
+
+// jwtKeyring guarda la clave activa y las retiradas que aún pueden verificar tokens vigentes
+type jwtKeyring struct {
+	mu     sync.RWMutex
+	alg    string
+	active string
+	keys   map[string]*jwtKey
+}
+
+// accessClaims son los claims del access token
+type accessClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"` // ID del usuario
+	Role      string `json:"role"`
+	SessionID string `json:"sid"` // familia de refresh tokens a la que pertenece
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+// newJWTKeyring crea el llavero con una primera clave del algoritmo indicado.
+// Si se proporciona un secreto HS256 (base64), se usa como clave inicial.
+func newJWTKeyring(alg, hs256Secret string) (*jwtKeyring, error) {
+	if alg != jwtAlgHS256 && alg != jwtAlgEdDSA {
+		return nil, fmt.Errorf("algoritmo JWT no soportado: %s", alg)
+	}
+	k := &jwtKeyring{alg: alg, keys: make(map[string]*jwtKey)}
+
+	if hs256Secret != "" {
+		if alg != jwtAlgHS256 {
+			return nil, errors.New("TIENDA_JWT_HS256_SECRET solo se admite con el algoritmo HS256")
+		}
+		secret, err := base64.StdEncoding.DecodeString(hs256Secret)
+		if err != nil || len(secret) < jwtHS256SecretSize {
+			return nil, fmt.Errorf("TIENDA_JWT_HS256_SECRET debe ser base64 de al menos %d bytes", jwtHS256SecretSize)
+		}
+		sum := sha256.Sum256(secret)
+		key := &jwtKey{Kid: base64.RawURLEncoding.EncodeToString(sum[:8]), Alg: alg, Secret: secret, CreatedAt: time.Now()}
+		k.keys[key.Kid] = key
+		k.active = key.Kid
+		return k, nil
+	}
+
+	if _, err := k.rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// rotate genera una nueva clave activa. La anterior queda retirada pero sigue
+// verificando tokens hasta que caduque el último access token firmado con ella.
+func (k *jwtKeyring) rotate() (*jwtKey, error) {
+	key := &jwtKey{Kid: uuid.New().String(), Alg: k.alg, CreatedAt: time.Now()}
+	switch k.alg {
+	case jwtAlgHS256:
+		key.Secret = make([]byte, jwtHS256SecretSize)
+		if _, err := rand.Read(key.Secret); err != nil {
+			return nil, err
+		}
+	case jwtAlgEdDSA:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key.Public, key.Private = pub, priv
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	for kid, old := range k.keys {
+		if old.RetiredAt == nil {
+			old.RetiredAt = &now
+		} else if now.Sub(*old.RetiredAt) > jwtAccessTTL {
+			delete(k.keys, kid) // ya no puede quedar ningún token vigente firmado con ella
+		}
+	}
+	k.keys[key.Kid] = key
+	k.active = key.Kid
+	return key, nil
+}
+
+// sign firma los claims con la clave activa
+func (k *jwtKeyring) sign(claims accessClaims) (string, error) {
+	k.mu.RLock()
+	key := k.keys[k.active]
+	k.mu.RUnlock()
+
+	header, err := json.Marshal(map[string]string{"alg": key.Alg, "typ": "JWT", "kid": key.Kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch key.Alg {
+	case jwtAlgHS256:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write([]byte(signingInput))
+		sig = mac.Sum(nil)
+	case jwtAlgEdDSA:
+		sig = ed25519.Sign(key.Private, []byte(signingInput))
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verify comprueba firma, algoritmo, emisor y caducidad, y devuelve los claims
+func (k *jwtKeyring) verify(token string, now time.Time) (*accessClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidJWT
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errInvalidJWT
+	}
+
+	k.mu.RLock()
+	key, ok := k.keys[header.Kid]
+	k.mu.RUnlock()
+	// El algoritmo lo impone la clave, nunca la cabecera (evita ataques de confusión de algoritmo)
+	if !ok || header.Alg != key.Alg {
+		return nil, errInvalidJWT
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	signingInput := parts[0] + "." + parts[1]
+	switch key.Alg {
+	case jwtAlgHS256:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write([]byte(signingInput))
+		if subtle.ConstantTimeCompare(mac.Sum(nil), sig) != 1 {
+			return nil, errInvalidJWT
+		}
+	case jwtAlgEdDSA:
+		if !ed25519.Verify(key.Public, []byte(signingInput), sig) {
+			return nil, errInvalidJWT
+		}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	var claims accessClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidJWT
+	}
+	if claims.Issuer != jwtIssuer || now.Unix() >= claims.ExpiresAt {
+		return nil, errInvalidJWT
+	}
+	return &claims, nil
+}
+
+// publicJWKS devuelve las claves públicas EdDSA en formato JWKS (vacío con HS256)
+func (k *jwtKeyring) publicJWKS() map[string]interface{} {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make([]map[string]string, 0)
+	for _, key := range k.keys {
+		if key.Alg != jwtAlgEdDSA {
+			continue
+		}
+		keys = append(keys, map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"alg": jwtAlgEdDSA,
+			"use": "sig",
+			"kid": key.Kid,
+			"x":   base64.RawURLEncoding.EncodeToString(key.Public),
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i]["kid"] < keys[j]["kid"] })
+	return map[string]interface{}{"keys": keys}
+}
+
+// looksLikeJWT distingue un JWT (tres segmentos) de un UUID de sesión o un token de API
+func looksLikeJWT(value string) bool {
+	return strings.Count(value, ".") == 2
+}
+
+// userFromJWT valida un access token y devuelve su usuario
+func userFromJWT(token string) (*models.User, *accessClaims) {
+	if jwtKeys == nil {
+		return nil, nil
+	}
+	claims, err := jwtKeys.verify(token, time.Now())
+	if err != nil {
+		return nil, nil
+	}
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, nil
+	}
+	for i := range users {
+		if users[i].ID == id {
+			return &users[i], claims
+		}
+	}
+	return nil, nil
+}
+
+// establishSession abre una sesión completa según el modo configurado. En modo JWT
+// devuelve los campos de token que se añaden a la respuesta de login.
+func establishSession(w http.ResponseWriter, user *models.User) (map[string]interface{}, error) {
+	if sessionMode != sessionModeJWT {
+		startSession(w, user.ID, false)
+		return nil, nil
+	}
+	return issueTokenPair(w, user, uuid.New().String())
+}
+
+// issueTokenPair emite un access token y un refresh token de la familia indicada
+func issueTokenPair(w http.ResponseWriter, user *models.User, familyID string) (map[string]interface{}, error) {
+	refreshTokensMu.Lock()
+	defer refreshTokensMu.Unlock()
+	return writeTokenPair(w, user, familyID)
+}
+
+// writeTokenPair emite el par de tokens, guarda el refresh token y establece las
+// cookies. Debe llamarse con refreshTokensMu tomado.
+func writeTokenPair(w http.ResponseWriter, user *models.User, familyID string) (map[string]interface{}, error) {
+	now := time.Now()
+	access, err := jwtKeys.sign(accessClaims{
+		Issuer:    jwtIssuer,
+		Subject:   strconv.Itoa(user.ID),
+		Role:      user.Role,
+		SessionID: familyID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(jwtAccessTTL).Unix(),
+		ID:        uuid.New().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := newPrefixedToken(refreshTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+	refreshTokens = append(refreshTokens, models.RefreshToken{
+		ID:        refreshTokenSeq,
+		FamilyID:  familyID,
+		UserID:    user.ID,
+		TokenHash: hashToken(refresh),
+		CreatedAt: now,
+		ExpiresAt: now.Add(jwtRefreshTTL),
+	})
+	refreshTokenSeq++
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    access,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // Cambiar a 'true' en producción con HTTPS
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(jwtAccessTTL / time.Second),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    refresh,
+		Path:     refreshCookiePath,
+		HttpOnly: true,
+		Secure:   false, // Cambiar a 'true' en producción con HTTPS
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(jwtRefreshTTL / time.Second),
+	})
+
+	return map[string]interface{}{
+		"token":        access,
+		"tokenType":    "Bearer",
+		"expiresIn":    int(jwtAccessTTL / time.Second),
+		"refreshToken": refresh,
+	}, nil
+}
+
+// revokeRefreshFamily revoca todos los refresh tokens de una familia
+func revokeRefreshFamily(familyID string) {
+	refreshTokensMu.Lock()
+	defer refreshTokensMu.Unlock()
+	markRefreshFamilyRevoked(familyID)
+}
+
+// markRefreshFamilyRevoked revoca la familia. Debe llamarse con refreshTokensMu tomado.
+func markRefreshFamilyRevoked(familyID string) {
+	now := time.Now()
+	for i := range refreshTokens {
+		if refreshTokens[i].FamilyID == familyID && refreshTokens[i].RevokedAt == nil {
+			refreshTokens[i].RevokedAt = &now
+		}
+	}
+}
+
+// revokeUserRefreshTokens revoca los refresh tokens de un usuario salvo los de la familia indicada
+func revokeUserRefreshTokens(userID int, exceptFamily string) int {
+	refreshTokensMu.Lock()
+	defer refreshTokensMu.Unlock()
+	now := time.Now()
+	families := make(map[string]bool)
+	for i := range refreshTokens {
+		t := &refreshTokens[i]
+		if t.UserID == userID && t.FamilyID != exceptFamily && t.RevokedAt == nil {
+			t.RevokedAt = &now
+			families[t.FamilyID] = true
+		}
+	}
+	return len(families)
+}
+
+// Cuerpo opcional de /api/auth/refresh para clientes sin cookies
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Handler para rotar el refresh token y obtener un nuevo access token
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	// Configurar CORS
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if sessionMode != sessionModeJWT {
+		writeProblem(w, r, http.StatusNotFound, "jwt_mode_disabled")
+		return
+	}
+
+	// El refresh token llega en la cookie (navegador) o en el cuerpo (clientes de API)
+	var value string
+	if cookie, err := r.Cookie(refreshCookieName); err == nil {
+		value = cookie.Value
+	} else {
+		var req refreshRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes)).Decode(&req); err != nil {
+			writeProblem(w, r, http.StatusUnauthorized, "refresh_token_missing")
+			return
+		}
+		defer r.Body.Close()
+		value = req.RefreshToken
+	}
+
+	// La búsqueda, la comprobación de reutilización, la marca de usado y el nuevo token
+	// se hacen sin soltar el mutex; current apunta al slice solo mientras se tiene
+	refreshTokensMu.Lock()
+	defer refreshTokensMu.Unlock()
+	hash := hashToken(value)
+	var current *models.RefreshToken
+	for i := range refreshTokens {
+		if subtle.ConstantTimeCompare([]byte(refreshTokens[i].TokenHash), []byte(hash)) == 1 {
+			current = &refreshTokens[i]
+			break
+		}
+	}
+	if current == nil {
+		writeProblem(w, r, http.StatusUnauthorized, "refresh_token_invalid")
+		return
+	}
+
+	// Reutilizar un refresh token ya rotado indica que fue robado: se revoca toda la familia
+	if current.UsedAt != nil {
+		slog.WarnContext(r.Context(), "Reutilización de refresh token; se revoca la familia", "user_id", current.UserID, "family_id", current.FamilyID)
+		markRefreshFamilyRevoked(current.FamilyID)
+		writeProblem(w, r, http.StatusUnauthorized, "refresh_token_reused")
+		return
+	}
+	if current.RevokedAt != nil || !current.ExpiresAt.After(time.Now()) {
+		writeProblem(w, r, http.StatusUnauthorized, "refresh_token_expired")
+		return
+	}
+
+	var user *models.User
+	for i := range users {
+		if users[i].ID == current.UserID {
+			u := users[i]
+			user = &u
+			break
+		}
+	}
+	if user == nil {
+		writeProblem(w, r, http.StatusUnauthorized, "refresh_token_invalid")
+		return
+	}
+
+	now := time.Now()
+	current.UsedAt = &now
+	tokens, err := writeTokenPair(w, user, current.FamilyID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error emitiendo tokens JWT", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// Handler que publica las claves públicas (solo con EdDSA) para verificar access tokens
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if jwtKeys == nil {
+		writeProblem(w, r, http.StatusNotFound, "jwt_mode_disabled")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jwtKeys.publicJWKS())
+}
+
+// Handler de administración para rotar la clave de firma JWT
+func adminJWTRotateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	if !ok || user == nil {
+		slog.ErrorContext(r.Context(), "Usuario no encontrado en el contexto")
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	if !can(r, user, permAdmin) {
+		writeForbidden(w, r, permAdmin)
+		return
+	}
+
+	if jwtKeys == nil {
+		writeProblem(w, r, http.StatusNotFound, "jwt_mode_disabled")
+		return
+	}
+
+	key, err := jwtKeys.rotate()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error rotando la clave JWT", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	recordAudit(r, user, auditEvent{Action: "config.jwt_rotate", TargetType: auditTargetConfig, TargetID: "jwt-key", After: map[string]string{"kid": key.Kid, "alg": key.Alg}})
+	slog.InfoContext(r.Context(), "Clave JWT rotada", "kid", key.Kid, "user_id", user.ID)
+	json.NewEncoder(w).Encode(map[string]interface{}{"kid": key.Kid, "alg": key.Alg, "createdAt": key.CreatedAt})
+}
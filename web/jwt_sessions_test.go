@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	models "TiendaSupported/modules"
+
+	"github.com/google/uuid"
+)
+
+// useJWTSessions activa el modo JWT con una clave HS256 nueva durante la prueba
+func useJWTSessions(t *testing.T) {
+	t.Helper()
+	keys, err := newJWTKeyring(jwtAlgHS256, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedMode, savedKeys := sessionMode, jwtKeys
+	refreshTokensMu.Lock()
+	savedTokens := refreshTokens
+	refreshTokens = append([]models.RefreshToken(nil), refreshTokens...)
+	refreshTokensMu.Unlock()
+	sessionMode, jwtKeys = sessionModeJWT, keys
+	t.Cleanup(func() {
+		sessionMode, jwtKeys = savedMode, savedKeys
+		refreshTokensMu.Lock()
+		refreshTokens = savedTokens
+		refreshTokensMu.Unlock()
+	})
+}
+
+// newRefreshFamily emite el primer par de tokens de una familia y devuelve el refresh token
+func newRefreshFamily(t *testing.T, role string) string {
+	t.Helper()
+	user := addTestUser(t, role)
+	tokens, err := issueTokenPair(httptest.NewRecorder(), &user, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens["refreshToken"].(string)
+}
+
+func refreshWith(t *testing.T, baseURL, token string) testResponse {
+	t.Helper()
+	return sendJSON(t, http.MethodPost, baseURL+"/api/auth/refresh", refreshRequest{RefreshToken: token}, nil, nil)
+}
+
+func TestRefreshRotation(t *testing.T) {
+	srv := newTestServer(t)
+	useJWTSessions(t)
+	first := newRefreshFamily(t, "User")
+
+	rotated := refreshWith(t, srv.URL, first)
+	if rotated.status != http.StatusOK {
+		t.Fatalf("primera rotación: %d %s", rotated.status, rotated.code())
+	}
+	second, _ := rotated.body["refreshToken"].(string)
+	if second == "" || second == first {
+		t.Fatalf("la rotación debería devolver un refresh token nuevo: %q", second)
+	}
+
+	// Volver a presentar el token ya rotado revoca la familia entera, incluido el nuevo
+	if res := refreshWith(t, srv.URL, first); res.status != http.StatusUnauthorized || res.code() != "refresh_token_reused" {
+		t.Fatalf("reutilizar el token rotado: %d %s, se esperaba 401 refresh_token_reused", res.status, res.code())
+	}
+	if res := refreshWith(t, srv.URL, second); res.status != http.StatusUnauthorized || res.code() != "refresh_token_expired" {
+		t.Errorf("el token sucesor tras la reutilización: %d %s, se esperaba 401 refresh_token_expired", res.status, res.code())
+	}
+	if res := refreshWith(t, srv.URL, "tsr_desconocido"); res.code() != "refresh_token_invalid" {
+		t.Errorf("token desconocido: %d %s", res.status, res.code())
+	}
+}
+
+// TestRefreshConcurrentReuse presenta el mismo refresh token a la vez desde varios
+// clientes: solo uno puede rotarlo y los demás se tratan como reutilización. Llama al
+// handler directamente, sin el limitador de peticiones, cuyo mutex ordenaría las
+// peticiones y ocultaría la carrera a go test -race.
+func TestRefreshConcurrentReuse(t *testing.T) {
+	srv := newTestServer(t)
+	useJWTSessions(t)
+	token := newRefreshFamily(t, "User")
+
+	const clients = 16
+	results := make([]*httptest.ResponseRecorder, clients)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range results {
+		results[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/api/auth/refresh", strings.NewReader(`{"refreshToken":"`+token+`"}`))
+			<-start
+			refreshHandler(rec, req)
+		}(results[i])
+	}
+	close(start)
+	wg.Wait()
+
+	rotated := 0
+	for _, rec := range results {
+		switch code := problemCode(t, rec); {
+		case rec.Code == http.StatusOK:
+			rotated++
+		case code != "refresh_token_reused":
+			t.Errorf("respuesta inesperada: %d %s", rec.Code, code)
+		}
+	}
+	if rotated != 1 {
+		t.Fatalf("el mismo refresh token se rotó %d veces, se esperaba 1", rotated)
+	}
+
+	// Tras detectar la reutilización, el token emitido en la rotación también está revocado
+	refreshTokensMu.Lock()
+	last := refreshTokens[len(refreshTokens)-1]
+	refreshTokensMu.Unlock()
+	if last.RevokedAt == nil {
+		t.Errorf("el token sucesor debería estar revocado")
+	}
+	if res := refreshWith(t, srv.URL, token); res.status != http.StatusUnauthorized {
+		t.Errorf("tras detectar la reutilización, el token rotado debería estar revocado: %d", res.status)
+	}
+}
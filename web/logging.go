@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Los logs son JSON (log/slog) con un registro por línea. Los mensajes de los
+// handlers se emiten con slog.InfoContext(r.Context(), ...) para que lleven el ID de
+// la petición; además cada petición deja una línea de acceso al terminar.
+//
+//	TIENDA_LOG_LEVEL   debug | info (por defecto) | warn | error
+//	TIENDA_LOG_FORMAT  json (por defecto) | text
+
+// Clave de contexto para los datos de la petición que completan el log de acceso
+const logInfoContextKey contextKey = "logInfo"
+
+// redactedValue sustituye el valor de los atributos sensibles
+const redactedValue = "[REDACTED]"
+
+// sensitiveLogKeys son atributos cuyo valor nunca se escribe en los logs. Además se
+// ocultan todos los que contienen "password" o "secret".
+var sensitiveLogKeys = map[string]bool{
+	"token":         true,
+	"session_token": true,
+	"refresh_token": true,
+	"access_token":  true,
+	"id_token":      true,
+	"csrf_token":    true,
+	"cookie":        true,
+	"set-cookie":    true,
+	"authorization": true,
+	"code":          true, // códigos TOTP, de recuperación y de autorización OIDC
+}
+
+// setupLogging configura el logger por defecto. También redirige el paquete log
+// (y con él los errores internos de net/http) al mismo destino.
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("TIENDA_LOG_LEVEL", "info"))); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+
+	var handler slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if getEnv("TIENDA_LOG_FORMAT", "json") == "text" {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// redactAttr oculta el valor de los atributos sensibles, también dentro de grupos
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if isSensitiveLogKey(a.Key) {
+		return slog.String(a.Key, redactedValue)
+	}
+	return a
+}
+
+func isSensitiveLogKey(key string) bool {
+	key = strings.ToLower(key)
+	return sensitiveLogKeys[key] || strings.Contains(key, "password") || strings.Contains(key, "secret")
+}
+
+// contextHandler añade a cada registro el ID de la petición y el span en curso
+// guardados en el contexto
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIDContextKey).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if s := spanFromContext(ctx); s != nil {
+		record.AddAttrs(slog.String("trace_id", s.data.TraceID), slog.String("span_id", s.data.SpanID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal registra el error y termina el proceso
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// --- Log de acceso ---
+
+// requestLogInfo lo rellenan el router (ruta) y authMiddleware (usuario) para que el
+// log de acceso, que envuelve a ambos, pueda incluirlos
+type requestLogInfo struct {
+	route  string
+	userID int
+}
+
+// logInfo devuelve los datos de log de la petición (nil fuera de accessLogMiddleware)
+func logInfo(r *http.Request) *requestLogInfo {
+	info, _ := r.Context().Value(logInfoContextKey).(*requestLogInfo)
+	return info
+}
+
+// statusRecorder guarda el estado y el tamaño de la respuesta
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap permite a http.ResponseController llegar al ResponseWriter original
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// accessLogMiddleware escribe una línea por petición con el método, la ruta (el
+// patrón del router, sin parámetros), el estado, la duración y el usuario. La ruta
+// real se registra sin la query string, que puede llevar tokens o códigos.
+// Debe envolver a requestIDMiddleware para registrar también los pánicos (500).
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestLogInfo{}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), logInfoContextKey, info)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("ip", clientIP(r)),
+			slog.String("request_id", w.Header().Get("X-Request-ID")),
+		}
+		if info.route != "" {
+			attrs = append(attrs, slog.String("route", info.route))
+		}
+		if info.userID != 0 {
+			attrs = append(attrs, slog.Int("user_id", info.userID))
+		}
+		level := slog.LevelInfo
+		switch {
+		case probePaths[r.URL.Path]:
+			level = slog.LevelDebug // las sondas llegan cada pocos segundos; un 503 de /readyz es normal al parar
+		case rec.status >= 500:
+			level = slog.LevelError
+		}
+		slog.LogAttrs(r.Context(), level, "Petición atendida", attrs...)
+	})
+}
+
+// setLogUser anota el usuario autenticado para el log de acceso
+func setLogUser(r *http.Request, userID int) {
+	if info := logInfo(r); info != nil {
+		info.userID = userID
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// loginThrottleConfig agrupa los parámetros de protección contra fuerza bruta
+type loginThrottleConfig struct {
+	MaxAccountFailures int           // fallos por cuenta antes del bloqueo temporal
+	MaxIPFailures      int           // fallos por IP antes del bloqueo temporal
+	LockoutDuration    time.Duration // duración del bloqueo (y ventana tras la que se olvidan los fallos)
+	BackoffBase        time.Duration // espera tras el primer fallo; se duplica con cada fallo
+	BackoffMax         time.Duration // espera máxima entre intentos antes del bloqueo
+}
+
+// failureRecord registra los intentos fallidos de una cuenta o de una IP
+type failureRecord struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// loginThrottle lleva la cuenta de fallos por cuenta y por IP
+type loginThrottle struct {
+	mu        sync.Mutex
+	cfg       loginThrottleConfig
+	byAccount map[string]*failureRecord
+	byIP      map[string]*failureRecord
+	lastSweep time.Time
+}
+
+// loginThrottleSweepInterval es cada cuánto se recorren los registros para descartar
+// los caducados: las claves son nombres de usuario arbitrarios e IPs, y un registro
+// solo se olvida al consultarlo de nuevo
+const loginThrottleSweepInterval = time.Minute
+
+// LockoutInfo describe una cuenta bloqueada para el endpoint de administración
+type LockoutInfo struct {
+	Username    string    `json:"username"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+var (
+	loginGuard = newLoginThrottle(loginThrottleConfig{
+		MaxAccountFailures: envInt("TIENDA_LOGIN_MAX_FAILURES", 5),
+		MaxIPFailures:      envInt("TIENDA_LOGIN_MAX_IP_FAILURES", 20),
+		LockoutDuration:    envDuration("TIENDA_LOGIN_LOCKOUT", 15*time.Minute),
+		BackoffBase:        envDuration("TIENDA_LOGIN_BACKOFF_BASE", 1*time.Second),
+		BackoffMax:         envDuration("TIENDA_LOGIN_BACKOFF_MAX", 30*time.Second),
+	})
+
+	// dummyPasswordHash se compara cuando el usuario no existe, para que la
+	// respuesta tarde lo mismo que con un usuario real y no permita enumerar cuentas
+	dummyPasswordHash []byte
+)
+
+func newLoginThrottle(cfg loginThrottleConfig) *loginThrottle {
+	return &loginThrottle{
+		cfg:       cfg,
+		byAccount: make(map[string]*failureRecord),
+		byIP:      make(map[string]*failureRecord),
+	}
+}
+
+// initDummyPasswordHash genera el hash señuelo con el mismo coste que los hashes reales
+func initDummyPasswordHash() error {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	hash, err := hashPassword(context.Background(), buf)
+	if err != nil {
+		return err
+	}
+	dummyPasswordHash = hash
+	return nil
+}
+
+func accountKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// retryAfter calcula cuánto debe esperar el cliente antes de volver a intentarlo.
+// Devuelve cero si el intento está permitido; locked indica un bloqueo completo.
+func (t *loginThrottle) retryAfter(username, ip string, now time.Time) (wait time.Duration, locked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, rec := range []*failureRecord{t.record(t.byAccount, accountKey(username), now), t.record(t.byIP, ip, now)} {
+		if rec == nil {
+			continue
+		}
+		if rec.LockedUntil.After(now) {
+			if d := rec.LockedUntil.Sub(now); d > wait || !locked {
+				wait, locked = d, true
+			}
+			continue
+		}
+		if locked {
+			continue
+		}
+		if d := rec.LastFailure.Add(t.backoff(rec.Failures)).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, locked
+}
+
+// record devuelve el registro vigente para la clave, olvidando los fallos antiguos
+func (t *loginThrottle) record(m map[string]*failureRecord, key string, now time.Time) *failureRecord {
+	rec, ok := m[key]
+	if !ok {
+		return nil
+	}
+	if rec.LockedUntil.Before(now) && now.Sub(rec.LastFailure) > t.cfg.LockoutDuration {
+		delete(m, key)
+		return nil
+	}
+	return rec
+}
+
+// backoff devuelve la espera exponencial tras n fallos consecutivos
+func (t *loginThrottle) backoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	d := time.Duration(float64(t.cfg.BackoffBase) * math.Pow(2, float64(failures-1)))
+	if d > t.cfg.BackoffMax || d <= 0 {
+		d = t.cfg.BackoffMax
+	}
+	return d
+}
+
+// recordFailure anota un intento fallido y bloquea la cuenta o la IP si superan el umbral
+func (t *loginThrottle) recordFailure(username, ip string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bump := func(m map[string]*failureRecord, key string, max int) {
+		rec := t.record(m, key, now)
+		if rec == nil {
+			rec = &failureRecord{}
+			m[key] = rec
+		}
+		rec.Failures++
+		rec.LastFailure = now
+		if rec.Failures >= max {
+			rec.LockedUntil = now.Add(t.cfg.LockoutDuration)
+		}
+	}
+	t.sweep(now)
+	bump(t.byAccount, accountKey(username), t.cfg.MaxAccountFailures)
+	bump(t.byIP, ip, t.cfg.MaxIPFailures)
+}
+
+// sweep descarta los registros caducados de ambos mapas. Debe llamarse con mu tomado.
+func (t *loginThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < loginThrottleSweepInterval {
+		return
+	}
+	t.lastSweep = now
+	for _, m := range []map[string]*failureRecord{t.byAccount, t.byIP} {
+		for key := range m {
+			t.record(m, key, now)
+		}
+	}
+}
+
+// recordSuccess olvida los fallos de la cuenta tras un login correcto.
+// Los fallos de la IP se mantienen para que una cuenta válida no sirva para reiniciarlos.
+func (t *loginThrottle) recordSuccess(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.byAccount, accountKey(username))
+}
+
+// unlock elimina el bloqueo de una cuenta; devuelve false si no estaba registrada
+func (t *loginThrottle) unlock(username string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := accountKey(username)
+	if _, ok := t.byAccount[key]; !ok {
+		return false
+	}
+	delete(t.byAccount, key)
+	return true
+}
+
+// lockedAccounts lista las cuentas bloqueadas en este momento
+func (t *loginThrottle) lockedAccounts(now time.Time) []LockoutInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]LockoutInfo, 0)
+	for key, rec := range t.byAccount {
+		if rec.LockedUntil.After(now) {
+			list = append(list, LockoutInfo{Username: key, Failures: rec.Failures, LastFailure: rec.LastFailure, LockedUntil: rec.LockedUntil})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+// writeTooManyAttempts responde 429 con la cabecera Retry-After en segundos
+func writeTooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration, locked bool) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	if locked {
+		writeProblem(w, r, http.StatusTooManyRequests, "account_locked")
+		return
+	}
+	writeProblem(w, r, http.StatusTooManyRequests, "too_many_attempts")
+}
+
+// Handler de administración para listar las cuentas bloqueadas
+func adminLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	if !ok || user == nil {
+		slog.ErrorContext(r.Context(), "Usuario no encontrado en el contexto")
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	if !can(r, user, permAdmin) {
+		writeForbidden(w, r, permAdmin)
+		return
+	}
+
+	json.NewEncoder(w).Encode(loginGuard.lockedAccounts(time.Now()))
+}
+
+// Cuerpo del desbloqueo de una cuenta
+type unlockRequest struct {
+	Username string `json:"username" validate:"required"`
+}
+
+// Handler de administración para desbloquear una cuenta
+func adminUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	if !ok || user == nil {
+		slog.ErrorContext(r.Context(), "Usuario no encontrado en el contexto")
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	if !can(r, user, permAdmin) {
+		writeForbidden(w, r, permAdmin)
+		return
+	}
+
+	var req unlockRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if !loginGuard.unlock(req.Username) {
+		writeProblem(w, r, http.StatusNotFound, "lockout_not_found")
+		return
+	}
+
+	target := auditEvent{Action: "user.unlock", TargetType: auditTargetUser, After: map[string]string{"username": accountKey(req.Username)}}
+	if u := findUserByName(req.Username); u != nil {
+		target.TargetID = strconv.Itoa(u.ID)
+	}
+	recordAudit(r, user, target)
+	slog.InfoContext(r.Context(), "Cuenta desbloqueada", "username", accountKey(req.Username), "user_id", user.ID)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Cuenta desbloqueada exitosamente"})
+}
+
+// envDuration lee una variable de entorno de duración (p. ej. "15m"), usando el valor por defecto si no es válida
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnv(key, fallback.String()))
+	if err != nil {
+		slog.Warn("Valor de configuración inválido; se usa el predeterminado", "key", key, "fallback", fallback.String(), "error", err)
+		return fallback
+	}
+	return value
+}
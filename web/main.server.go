@@ -3,16 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
 	"strings" // Importar para strings.TrimSpace
+	"sync"
 	"time"
 
 	models "TiendaSupported/modules" // ¡IMPORTACIÓN CORREGIDA para el nuevo nombre del módulo!
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Definir un tipo de clave de contexto personalizado para evitar colisiones
@@ -28,15 +30,103 @@ var (
 	sessions     = make([]models.Session, 0)
 	productIDSeq = 1
 	userIDSeq    = 1
+
+	// catalogMu protege products, productImages y productRevisions: además de los handlers, el purgado
+	// de la papelera (trash.go) los modifica en segundo plano
+	catalogMu sync.RWMutex
+
+	// usersMu serializa las altas, que pueden mover el slice users, con las escrituras
+	// en un usuario que se hacen después de una operación lenta (el hash de una
+	// contraseña restablecida), para que ninguna se pierda en una copia antigua
+	usersMu sync.Mutex
 )
 
 func main() {
-	mux := http.NewServeMux()
-
+	setupLogging()
+	if err := setupTracing(); err != nil {
+		fatal("Error configurando las trazas", "error", err)
+	}
 	// Inicializar datos de prueba al inicio del servidor
 	initializeData()
 
-	// --- Manejo de Archivos Estáticos y Rutas de la API ---
+	// Hash señuelo para que el login de usuarios inexistentes tarde lo mismo que el de usuarios reales
+	if err := initDummyPasswordHash(); err != nil {
+		fatal("No se pudo generar el hash señuelo de login", "error", err)
+	}
+
+	// Modo de sesión: UUID opaco (por defecto) o JWT firmado con refresh tokens rotativos
+	switch sessionMode {
+	case sessionModeOpaque:
+	case sessionModeJWT:
+		keyring, err := newJWTKeyring(getEnv("TIENDA_JWT_ALG", jwtAlgHS256), getEnv("TIENDA_JWT_HS256_SECRET", ""))
+		if err != nil {
+			fatal("No se pudo inicializar el llavero JWT", "error", err)
+		}
+		jwtKeys = keyring
+		slog.Info("Sesiones en modo JWT", "alg", keyring.alg)
+	default:
+		fatal("TIENDA_SESSION_MODE desconocido", "mode", sessionMode)
+	}
+
+	// Cargar la lista de contraseñas comunes/filtradas para la política de contraseñas. Si
+	// no puede leerse no se arranca: la comprobación se omitiría sin que nadie lo notara.
+	// "none" la desactiva de forma explícita.
+	breachedPath := getEnv("TIENDA_BREACHED_PASSWORDS_FILE", "web/data/common-passwords.txt")
+	if breachedPath == "none" {
+		slog.Warn("Comprobación de contraseñas filtradas desactivada (TIENDA_BREACHED_PASSWORDS_FILE=none)")
+	} else if err := loadBreachedPasswords(breachedPath); err != nil {
+		fatal("No se pudo cargar la lista de contraseñas filtradas", "path", breachedPath, "error", err)
+	} else {
+		slog.Info("Contraseñas filtradas cargadas", "count", len(breachedPasswords), "path", breachedPath)
+	}
+
+	// Límites de peticiones por IP y por usuario
+	if err := setupRateLimiting(); err != nil {
+		fatal("Error configurando los límites de peticiones", "error", err)
+	}
+
+	// Almacén de las imágenes de productos
+	if err := setupBlobStore(); err != nil {
+		fatal("Error configurando el almacén de imágenes", "error", err)
+	}
+
+	// Fechas de obsolescencia y retirada de las versiones de la API
+	if err := setupAPIVersions(); err != nil {
+		fatal("Error configurando las versiones de la API", "error", err)
+	}
+
+	// La tabla de rutas (routes.go) alimenta el mux y la especificación OpenAPI
+	routes := apiRouteTable()
+	if err := setupOpenAPI(routes); err != nil {
+		fatal("No se pudo generar la especificación OpenAPI", "error", err)
+	}
+	mux := newServeMux(routes)
+
+	// Login corporativo OIDC (opcional)
+	if err := setupOIDC(mux); err != nil {
+		fatal("Error configurando OIDC", "error", err)
+	}
+
+	// Purgado periódico de la papelera de productos
+	startTrashPurger()
+
+	srv := &http.Server{
+		Addr:    ":8080",
+		Handler: accessLogMiddleware(metricsMiddleware(tracingMiddleware(requestIDMiddleware(mux)))),
+	}
+	serverReady.Store(true)
+	slog.Info("Servidor iniciado", "addr", "http://localhost:8080", "products", len(products), "users", len(users))
+	if err := runServer(srv); err != nil {
+		fatal("El servidor se detuvo", "error", err)
+	}
+	slog.Info("Servidor detenido")
+}
+
+// newServeMux monta en un mux los archivos estáticos, la SPA y las rutas de la tabla
+// (la API bajo /api/ y, en la raíz, las sondas y las métricas)
+func newServeMux(routes []apiRoute) *serveMux {
+	mux := &serveMux{ServeMux: http.NewServeMux()}
+
 	// ¡CORRECCIÓN CLAVE! Servir archivos estáticos bajo un prefijo /static/
 	// y manejar la ruta raíz explícitamente para index.html.
 	// Esto evita que el FileServer capture las rutas de la API.
@@ -47,32 +137,27 @@ func main() {
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// Asegurarse de que solo se sirva index.html para la raíz y no para otras rutas no API
 		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
-			http.NotFound(w, r)
+			writeProblem(w, r, http.StatusNotFound, "not_found")
 			return
 		}
 		http.ServeFile(w, r, "web/public/index.html")
 	})
 
-	// API endpoints
-	// Orden de las rutas: Las rutas exactas primero, luego las rutas con parámetros.
-	// Esto ayuda a evitar que "/api/v1/products/{id}" capture "/api/v1/products"
-	mux.HandleFunc("/api/v1/products", authMiddleware(productsHandler))
-	// Nota: El patrón "/api/v1/products/" con la barra final es para capturar paths como "/api/v1/products/123"
-	mux.HandleFunc("/api/v1/products/", authMiddleware(productHandler))
-
-	mux.HandleFunc("/api/auth/register", registerHandler)
-	mux.HandleFunc("/api/auth/login", loginHandler)
-	mux.HandleFunc("/api/auth/logout", logoutHandler)
-	mux.HandleFunc("/api/auth/check-session", checkSessionHandler) // Nueva ruta para verificar sesión
-
-	log.Println("Servidor iniciado en http://localhost:8080")
-	log.Printf("Iniciando servidor con %d productos y %d usuarios", len(products), len(users))
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	registerRoutes(mux, routes)
+	return mux
+}
+
+// getEnv devuelve el valor de una variable de entorno o un valor por defecto
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
 }
 
 // initializeData crea algunos productos y usuarios de prueba
 func initializeData() {
-	log.Println("⏳ Inicializando datos de ejemplo...")
+	slog.Debug("Inicializando datos de ejemplo")
 
 	// Crear productos de ejemplo
 	products = append(products, models.Product{
@@ -83,6 +168,7 @@ func initializeData() {
 		Stock:       8,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
+		Version:     1,
 	})
 	productIDSeq++
 	products = append(products, models.Product{
@@ -93,6 +179,7 @@ func initializeData() {
 		Stock:       45,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
+		Version:     1,
 	})
 	productIDSeq++
 	products = append(products, models.Product{
@@ -103,22 +190,26 @@ func initializeData() {
 		Stock:       12,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
+		Version:     1,
 	})
 	productIDSeq++
-	log.Printf("✅ Inicializados %d productos de ejemplo.", len(products))
+	for _, p := range products {
+		appendRevision(p, nil, revisionCreate, 0)
+	}
+	slog.Info("Productos de ejemplo inicializados", "count", len(products))
 
 	// Crear usuarios de prueba
 	registerTestUser := func(username, password, role string) {
 		for _, u := range users {
 			if u.Username == username {
-				log.Printf("ℹ️ Usuario de prueba '%s' (Rol: %s) ya existe.", username, role)
+				slog.Debug("El usuario de prueba ya existe", "username", username, "role", role)
 				return
 			}
 		}
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		hashedPassword, err := hashPassword(context.Background(), []byte(password))
 		if err != nil {
-			log.Fatalf("❌ Fatal: No se pudo hashear contraseña para %s: %v", username, err)
+			fatal("No se pudo hashear la contraseña del usuario de prueba", "username", username, "error", err)
 		}
 		newUser := models.User{
 			ID:           userIDSeq,
@@ -129,13 +220,12 @@ func initializeData() {
 		}
 		userIDSeq++
 		users = append(users, newUser)
-		log.Printf("✅ Usuario de prueba '%s' (Rol: %s) registrado.", username, role)
+		slog.Info("Usuario de prueba registrado", "username", username, "role", role)
 	}
 
 	registerTestUser("admin", "admin123", "Admin")    // Rol Admin
 	registerTestUser("editor", "editor123", "Editor") // Rol Editor
 	registerTestUser("user", "user123", "User")       // Rol Usuario normal
-	log.Printf("✅ Inicialización de usuarios de prueba completada.")
 }
 
 // Middleware de autenticación
@@ -144,48 +234,103 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// Configurar CORS
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization") // Añadir Authorization si se usa
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token, If-Match, If-None-Match") // Añadir Authorization si se usa
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Request-ID, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy")
+
+		// Clientes automatizados: token de API en la cabecera Authorization
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			value, found := strings.CutPrefix(auth, "Bearer ")
+			if !found {
+				writeProblem(w, r, http.StatusUnauthorized, "auth_scheme_unsupported")
+				return
+			}
+			value = strings.TrimSpace(value)
+
+			// Access token JWT enviado como Bearer: equivale a una sesión del usuario
+			if looksLikeJWT(value) {
+				jwtUser, _ := userFromJWT(value)
+				if jwtUser == nil {
+					writeProblem(w, r, http.StatusUnauthorized, "token_invalid")
+					return
+				}
+				serveAuthenticated(w, r, next, jwtUser)
+				return
+			}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
+			apiToken, tokenUser := authenticateAPIToken(value)
+			if apiToken == nil {
+				slog.DebugContext(r.Context(), "Token de API inválido o expirado")
+				writeProblem(w, r, http.StatusUnauthorized, "token_invalid")
+				return
+			}
+			if requiresTwoFactor(tokenUser) && !tokenUser.TOTPEnabled {
+				writeProblem(w, r, http.StatusForbidden, "mfa_enrollment_required")
+				return
+			}
+			now := time.Now()
+			apiToken.LastUsedAt = &now
+			slog.DebugContext(r.Context(), "Autenticado con token de API", "token_id", apiToken.ID, "user_id", tokenUser.ID)
+			setLogUser(r, tokenUser.ID)
+
+			ctx := context.WithValue(r.Context(), userContextKey, tokenUser)
+			ctx = context.WithValue(ctx, authMethodContextKey, authMethodToken)
+			ctx = context.WithValue(ctx, scopesContextKey, apiToken.Scopes)
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
-		log.Printf("Verificando autenticación para: %s %s", r.Method, r.URL.Path)
-
 		// Verificar cookie de sesión
 		cookie, err := r.Cookie("session_token")
 		if err != nil {
-			log.Printf("Cookie 'session_token' no encontrada: %v", err)
-			http.Error(w, "No autorizado: Cookie de sesión no encontrada", http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, "session_missing")
 			return
 		}
 
-		log.Printf("Cookie encontrada: %s", cookie.Value)
+		// Modo JWT: el access token viaja en la misma cookie y se valida sin consultar el servidor
+		if looksLikeJWT(cookie.Value) {
+			jwtUser, _ := userFromJWT(cookie.Value)
+			if jwtUser == nil {
+				writeProblem(w, r, http.StatusUnauthorized, "session_invalid")
+				return
+			}
+			// La cookie viaja sola en peticiones de otros sitios: exigir el token CSRF
+			if !checkCSRF(w, r) {
+				return
+			}
+			serveAuthenticated(w, r, next, jwtUser)
+			return
+		}
 
 		// Buscar sesión válida
+		_, lookup := startSpan(r.Context(), "sessions.lookup", "sessions.count", len(sessions))
 		var validSession *models.Session
 		for i := range sessions { // Usar range con índice para obtener referencia modificable si fuera necesario
 			session := &sessions[i] // Obtener la dirección de la sesión
 			if session.ID == models.SessionID(cookie.Value) {
 				if session.ExpiresAt.After(time.Now()) {
 					validSession = session
-					log.Printf("Sesión válida encontrada para usuario ID: %d", session.UserID)
 					break
 				} else {
-					log.Printf("Sesión expirada para usuario ID: %d. Eliminando sesión.", session.UserID)
+					slog.DebugContext(r.Context(), "Sesión expirada; se elimina", "user_id", session.UserID)
 					// Eliminar sesión expirada del slice
 					sessions = append(sessions[:i], sessions[i+1:]...)
-					http.Error(w, "Sesión expirada", http.StatusUnauthorized)
+					lookup.end()
+					writeProblem(w, r, http.StatusUnauthorized, "session_invalid")
 					return
 				}
 			}
 		}
 
+		lookup.end()
 		if validSession == nil {
-			log.Printf("No se encontró sesión válida para el token: %s", cookie.Value)
-			http.Error(w, "Sesión inválida", http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, "session_invalid")
+			return
+		}
+
+		// Las sesiones parciales no dan acceso a la API hasta completar el segundo factor
+		if validSession.MFAPending {
+			writeProblem(w, r, http.StatusUnauthorized, "mfa_pending")
 			return
 		}
 
@@ -199,16 +344,34 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		if authenticatedUser == nil {
-			log.Printf("Error interno: Usuario ID %d no encontrado para sesión válida.", validSession.UserID)
-			http.Error(w, "Error interno de autenticación: Usuario no encontrado", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Usuario de una sesión válida no encontrado", "user_id", validSession.UserID)
+			writeProblem(w, r, http.StatusInternalServerError, "internal_error")
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), userContextKey, authenticatedUser) // USANDO LA CLAVE PERSONALIZADA
-		next.ServeHTTP(w, r.WithContext(ctx))
+		// La cookie viaja sola en peticiones de otros sitios: exigir el token CSRF
+		if !checkCSRF(w, r) {
+			return
+		}
+
+		serveAuthenticated(w, r, next, authenticatedUser)
 	}
 }
 
+// serveAuthenticated pasa la petición al handler con el usuario de la sesión en el contexto
+func serveAuthenticated(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, authenticatedUser *models.User) {
+	// Si la política exige 2FA para su rol, el usuario debe activarla antes de usar la API
+	if requiresTwoFactor(authenticatedUser) && !authenticatedUser.TOTPEnabled {
+		writeProblem(w, r, http.StatusForbidden, "mfa_enrollment_required")
+		return
+	}
+
+	setLogUser(r, authenticatedUser.ID)
+	ctx := context.WithValue(r.Context(), userContextKey, authenticatedUser) // USANDO LA CLAVE PERSONALIZADA
+	ctx = context.WithValue(ctx, authMethodContextKey, authMethodSession)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
 // Handler de registro
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	// Configurar CORS para este handler específico (o usar un wrapper global)
@@ -217,50 +380,35 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	if r.Method != http.MethodPost {
-		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var credentials struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
-		log.Printf("Error decodificando registro: %v", err)
-		http.Error(w, "JSON inválido", http.StatusBadRequest)
+	var credentials models.Credentials
+	if !decodeJSON(w, r, &credentials) {
 		return
 	}
-	defer r.Body.Close()
 
-	if strings.TrimSpace(credentials.Username) == "" || strings.TrimSpace(credentials.Password) == "" {
-		http.Error(w, "Nombre de usuario y contraseña no pueden estar vacíos", http.StatusBadRequest)
+	// Aplicar la política de contraseñas
+	if violations := passwordPolicy.Validate(credentials.Username, credentials.Password); len(violations) > 0 {
+		writeValidationProblem(w, r, violations...)
 		return
 	}
 
 	// Verificar si el usuario ya existe
 	for _, u := range users {
 		if u.Username == credentials.Username {
-			http.Error(w, "Usuario ya existe", http.StatusConflict) // 409 Conflict
+			writeProblem(w, r, http.StatusConflict, "username_taken") // 409 Conflict
 			return
 		}
 	}
 
 	// Hashear contraseña
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(r.Context(), []byte(credentials.Password))
 	if err != nil {
-		log.Printf("Error hasheando contraseña: %v", err)
-		http.Error(w, "Error al procesar la contraseña", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error hasheando la contraseña", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
 		return
 	}
 
 	// Crear nuevo usuario
+	usersMu.Lock()
 	newUser := models.User{
 		ID:           userIDSeq,
 		Username:     credentials.Username,
@@ -270,8 +418,10 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	userIDSeq++
 	users = append(users, newUser)
+	usersMu.Unlock()
+	recordAudit(r, &newUser, auditEvent{Action: "user.register", TargetType: auditTargetUser, TargetID: strconv.Itoa(newUser.ID), After: newUser})
 
-	log.Printf("Usuario registrado exitosamente: %s (ID: %d)", newUser.Username, newUser.ID)
+	slog.InfoContext(r.Context(), "Usuario registrado", "username", newUser.Username, "user_id", newUser.ID)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -286,29 +436,21 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	if r.Method != http.MethodPost {
-		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	var credentials models.Credentials
+	if !decodeJSON(w, r, &credentials) {
 		return
 	}
 
-	var credentials struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-	}
+	slog.DebugContext(r.Context(), "Intento de login", "username", credentials.Username)
 
-	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
-		log.Printf("Error decodificando credenciales: %v", err)
-		http.Error(w, "JSON inválido", http.StatusBadRequest)
+	// Protección contra fuerza bruta: espera exponencial y bloqueo por cuenta e IP
+	ip := clientIP(r)
+	if wait, locked := loginGuard.retryAfter(credentials.Username, ip, time.Now()); wait > 0 {
+		slog.WarnContext(r.Context(), "Login rechazado por exceso de intentos", "username", credentials.Username, "ip", ip, "locked", locked)
+		recordLogin("password", loginResultThrottled)
+		writeTooManyAttempts(w, r, wait, locked)
 		return
 	}
-	defer r.Body.Close()
-
-	log.Printf("Intento de login para usuario: %s", credentials.Username)
 
 	// Buscar usuario
 	var user *models.User
@@ -320,24 +462,85 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if user == nil {
-		log.Printf("Usuario no encontrado: %s", credentials.Username)
-		http.Error(w, "Credenciales inválidas", http.StatusUnauthorized)
+		// Comparar contra un hash señuelo para que el tiempo de respuesta no revele si la cuenta existe
+		checkPassword(r.Context(), dummyPasswordHash, []byte(credentials.Password))
+		loginGuard.recordFailure(credentials.Username, ip, time.Now())
+		slog.InfoContext(r.Context(), "Login fallido: usuario inexistente", "username", credentials.Username, "ip", ip)
+		recordLogin("password", loginResultFailure)
+		writeProblem(w, r, http.StatusUnauthorized, "invalid_credentials")
 		return
 	}
 
 	// Verificar contraseña
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(credentials.Password)); err != nil {
-		log.Printf("Contraseña incorrecta para usuario: %s", credentials.Username)
-		http.Error(w, "Credenciales inválidas", http.StatusUnauthorized)
+	if err := checkPassword(r.Context(), []byte(user.PasswordHash), []byte(credentials.Password)); err != nil {
+		loginGuard.recordFailure(credentials.Username, ip, time.Now())
+		slog.InfoContext(r.Context(), "Login fallido: contraseña incorrecta", "username", credentials.Username, "ip", ip)
+		recordLogin("password", loginResultFailure)
+		writeProblem(w, r, http.StatusUnauthorized, "invalid_credentials")
+		return
+	}
+
+	// Segundo factor: si el usuario tiene TOTP activo, o la política lo exige para su rol,
+	// se emite una sesión parcial que solo permite completar la verificación o el alta de 2FA.
+	// Los fallos de la cuenta no se olvidan hasta superar el segundo factor: si no, cada
+	// login con la contraseña correcta reiniciaría el contador de códigos incorrectos.
+	if user.TOTPEnabled || requiresTwoFactor(user) {
+		startSession(w, user.ID, true)
+		recordLogin("password", loginResultMFARequired)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":               "Se requiere verificación en dos pasos",
+			"mfaRequired":           user.TOTPEnabled,
+			"mfaEnrollmentRequired": !user.TOTPEnabled,
+		})
+		slog.InfoContext(r.Context(), "Contraseña correcta; pendiente de segundo factor", "user_id", user.ID)
+		return
+	}
+
+	loginGuard.recordSuccess(credentials.Username)
+
+	tokens, err := establishSession(w, user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creando la sesión", "user_id", user.ID, "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
 		return
 	}
 
+	// Responder con JSON incluyendo información del usuario (y los tokens en modo JWT)
+	response := map[string]interface{}{
+		"message":  "Login exitoso",
+		"id":       user.ID,
+		"username": user.Username,
+		"role":     user.Role,
+	}
+	for k, v := range tokens {
+		response[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+	setLogUser(r, user.ID)
+	recordLogin("password", loginResultSuccess)
+	recordAudit(r, user, auditEvent{Action: "session.login", TargetType: auditTargetSession, TargetID: strconv.Itoa(user.ID), After: map[string]string{"method": "password"}})
+	slog.InfoContext(r.Context(), "Login exitoso", "user_id", user.ID)
+}
+
+// startSession crea una sesión para el usuario y establece la cookie session_token.
+// Las sesiones parciales (mfaPending) duran solo lo necesario para introducir el código.
+func startSession(w http.ResponseWriter, userID int, mfaPending bool) models.Session {
+	ttl := 24 * time.Hour
+	if mfaPending {
+		ttl = mfaPendingSessionTTL
+	}
+
 	// Crear nueva sesión
 	session := models.Session{
-		ID:        models.SessionID(uuid.New().String()),
-		UserID:    user.ID,
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(24 * time.Hour),
+		ID:         models.SessionID(uuid.New().String()),
+		UserID:     userID,
+		CreatedAt:  time.Now(),
+		ExpiresAt:  time.Now().Add(ttl),
+		MFAPending: mfaPending,
 	}
 	sessions = append(sessions, session)
 
@@ -349,170 +552,255 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		HttpOnly: true,
 		Secure:   false, // Cambiar a 'true' en producción con HTTPS
 		SameSite: http.SameSiteLaxMode,
-		MaxAge:   int(24 * time.Hour / time.Second), // 24 horas en segundos
+		MaxAge:   int(ttl / time.Second),
 	})
+	return session
+}
 
-	// Responder con JSON incluyendo información del usuario
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":  "Login exitoso",
-		"id":       user.ID,
-		"username": user.Username,
-		"role":     user.Role,
-	})
-	log.Printf("Login exitoso para usuario: %s", user.Username)
+// Handler que lista los productos (v1: array completo; v2 pagina con listProductsPageHandler)
+func listProductsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsRead); !ok {
+		return
+	}
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	json.NewEncoder(w).Encode(activeProducts())
 }
 
-// Handler para la colección de productos
-func productsHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	log.Printf("Método %s en /api/v1/products", r.Method)
+// Handler que crea un producto (Admin o Editor)
+func createProductHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsWrite); !ok {
+		return
+	}
 
-	// Recuperar el usuario del contexto
-	user, ok := r.Context().Value(userContextKey).(*models.User) // USANDO LA CLAVE PERSONALIZADA
-	if !ok || user == nil {
-		log.Printf("Error: Usuario no encontrado en el contexto para productsHandler.")
-		http.Error(w, "Error interno de autenticación", http.StatusInternalServerError)
+	// El cuerpo no puede traer id, fechas ni versión: los asigna el servidor
+	var product models.Product
+	if !decodeJSON(w, r, &product) {
 		return
 	}
-	log.Printf("productsHandler accedido por usuario: %s (Rol: %s)", user.Username, user.Role)
 
-	switch r.Method {
-	case http.MethodGet:
-		// Asegurarse de que el slice de productos no sea nil si está vacío
-		if products == nil {
-			products = []models.Product{}
-		}
-		log.Printf("Productos actuales: %v", products)
-		json.NewEncoder(w).Encode(products)
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	if skuTaken(product) {
+		writeProblem(w, r, http.StatusConflict, "sku_taken")
+		return
+	}
+	product.ID = productIDSeq
+	productIDSeq++
+	product.CreatedAt = time.Now()
+	product.UpdatedAt = time.Now()
+	product.Version = 1
+
+	products = append(products, product)
+	recordRevision(r, product, revisionCreate)
+	recordAudit(r, nil, auditEvent{Action: "product.create", TargetType: auditTargetProduct, TargetID: strconv.Itoa(product.ID), After: product})
+	slog.InfoContext(r.Context(), "Producto creado", "product_id", product.ID)
+	w.Header().Set("ETag", productETag(product))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(product)
+}
 
-	case http.MethodPost:
-		// Solo permitir POST si el usuario es Admin o Editor
-		if user.Role != "Admin" && user.Role != "Editor" {
-			http.Error(w, "Acceso denegado: No tienes permisos para agregar productos.", http.StatusForbidden)
-			return
-		}
+// productIndexFromPath busca el producto del parámetro {id}; si no existe o está en
+// la papelera responde 404 y devuelve -1. Debe llamarse con catalogMu tomado.
+func productIndexFromPath(w http.ResponseWriter, r *http.Request) int {
+	i := findProductIndex(pathInt(r, "id"))
+	if i == -1 || products[i].DeletedAt != nil {
+		writeProblem(w, r, http.StatusNotFound, "product_not_found")
+		return -1
+	}
+	return i
+}
 
-		var product models.Product
-		if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
-			log.Printf("Error decodificando producto: %v", err)
-			http.Error(w, "JSON inválido", http.StatusBadRequest)
-			return
+// findProductIndex devuelve la posición del producto en el slice (también si está en
+// la papelera), o -1
+func findProductIndex(id int) int {
+	for i, p := range products {
+		if p.ID == id {
+			return i
 		}
-		defer r.Body.Close()
+	}
+	return -1
+}
 
-		if strings.TrimSpace(product.Name) == "" {
-			http.Error(w, "El nombre del producto no puede estar vacío", http.StatusBadRequest)
-			return
-		}
-		if product.Price < 0 {
-			http.Error(w, "El precio del producto no puede ser negativo", http.StatusBadRequest)
-			return
+// findProductBySKU devuelve la posición del producto con ese SKU (también si está en
+// la papelera), o -1. Los SKU no distinguen mayúsculas de minúsculas.
+func findProductBySKU(sku string) int {
+	for i, p := range products {
+		if p.SKU != "" && strings.EqualFold(p.SKU, sku) {
+			return i
 		}
+	}
+	return -1
+}
 
-		log.Printf("Nuevo producto recibido: %v", product)
-		product.ID = productIDSeq
-		productIDSeq++
-		product.CreatedAt = time.Now()
-		product.UpdatedAt = time.Now()
-
-		products = append(products, product)
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(product)
-
-	default:
-		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+// skuTaken indica si el SKU del producto ya lo usa otro producto
+func skuTaken(p models.Product) bool {
+	if p.SKU == "" {
+		return false
 	}
+	i := findProductBySKU(p.SKU)
+	return i != -1 && products[i].ID != p.ID
 }
 
-// Handler para producto individual
-func productHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// activeProducts devuelve los productos que no están en la papelera
+func activeProducts() []models.Product {
+	active := make([]models.Product, 0, len(products))
+	for _, p := range products {
+		if p.DeletedAt == nil {
+			active = append(active, p)
+		}
+	}
+	return active
+}
 
-	// Recuperar el usuario del contexto
-	user, ok := r.Context().Value(userContextKey).(*models.User) // USANDO LA CLAVE PERSONALIZADA
-	if !ok || user == nil {
-		log.Printf("Error: Usuario no encontrado en el contexto para productHandler.")
-		http.Error(w, "Error interno de autenticación", http.StatusInternalServerError)
+// Handler que devuelve un producto con su ETag
+func getProductHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsRead); !ok {
+		return
+	}
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	productIndex := productIndexFromPath(w, r)
+	if productIndex == -1 {
 		return
 	}
-	log.Printf("productHandler accedido por usuario: %s (Rol: %s)", user.Username, user.Role)
 
-	// Extraer ID del path (ej: /api/v1/products/123 -> "123")
-	// Usar strings.TrimPrefix para manejar el caso de la ruta base "/api/v1/products/"
-	idStr := strings.TrimPrefix(r.URL.Path, "/api/v1/products/")
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		log.Printf("ID inválido en la ruta: %s, error: %v", idStr, err)
-		http.Error(w, "ID inválido", http.StatusBadRequest)
+	etag := productETag(products[productIndex])
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Accept-Patch", mediaTypeMergePatch+", "+mediaTypeJSONPatch)
+	if etagMatches(r.Header.Get("If-None-Match"), etag, true) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
+	json.NewEncoder(w).Encode(products[productIndex])
+}
 
-	// Buscar producto
-	var productIndex = -1
-	for i, p := range products {
-		if p.ID == id {
-			productIndex = i
-			break
-		}
+// Handler que reemplaza un producto (Admin o Editor)
+func replaceProductHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsWrite); !ok {
+		return
+	}
+	// El cuerpo se lee antes de bloquear el catálogo, para que un envío lento no
+	// detenga al resto de lectores y escritores
+	var updatedProduct models.Product
+	if !decodeJSON(w, r, &updatedProduct) {
+		return
 	}
 
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	productIndex := productIndexFromPath(w, r)
 	if productIndex == -1 {
-		http.Error(w, "Producto no encontrado", http.StatusNotFound)
+		return
+	}
+	if !checkIfMatch(w, r, products[productIndex]) {
 		return
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		json.NewEncoder(w).Encode(products[productIndex])
+	updatedProduct.ID = products[productIndex].ID
+	updatedProduct.CreatedAt = products[productIndex].CreatedAt // Mantener la fecha de creación original
+	updatedProduct.UpdatedAt = time.Now()
+	updatedProduct.Version = products[productIndex].Version + 1
+	updatedProduct.ImageURL = products[productIndex].ImageURL // la gestiona la galería de imágenes
+	if skuTaken(updatedProduct) {
+		writeProblem(w, r, http.StatusConflict, "sku_taken")
+		return
+	}
 
-	case http.MethodPut:
-		// Solo permitir PUT si el usuario es Admin o Editor
-		if user.Role != "Admin" && user.Role != "Editor" {
-			http.Error(w, "Acceso denegado: No tienes permisos para editar productos.", http.StatusForbidden)
-			return
-		}
+	recordAudit(r, nil, auditEvent{Action: "product.update", TargetType: auditTargetProduct, TargetID: strconv.Itoa(updatedProduct.ID), Before: products[productIndex], After: updatedProduct})
+	products[productIndex] = updatedProduct
+	recordRevision(r, updatedProduct, revisionUpdate)
+	w.Header().Set("ETag", productETag(updatedProduct))
+	json.NewEncoder(w).Encode(updatedProduct)
+}
 
-		var updatedProduct models.Product
-		if err := json.NewDecoder(r.Body).Decode(&updatedProduct); err != nil {
-			log.Printf("Error decodificando producto para actualizar: %v", err)
-			http.Error(w, "JSON inválido", http.StatusBadRequest)
-			return
-		}
-		defer r.Body.Close()
+// Handler de actualización parcial: mismos permisos que PUT
+func patchProductHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsWrite); !ok {
+		return
+	}
+	// Como en PUT, el cuerpo se lee sin el catálogo bloqueado
+	body, err := readBody(w, r)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
 
-		if strings.TrimSpace(updatedProduct.Name) == "" {
-			http.Error(w, "El nombre del producto no puede estar vacío", http.StatusBadRequest)
-			return
-		}
-		if updatedProduct.Price < 0 {
-			http.Error(w, "El precio del producto no puede ser negativo", http.StatusBadRequest)
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	productIndex := productIndexFromPath(w, r)
+	if productIndex == -1 {
+		return
+	}
+	if !checkIfMatch(w, r, products[productIndex]) {
+		return
+	}
+
+	patchedProduct, err := patchProduct(products[productIndex], r.Header.Get("Content-Type"), body)
+	if err != nil {
+		var pe *patchError
+		if errors.As(err, &pe) {
+			if pe.status == http.StatusUnsupportedMediaType {
+				w.Header().Set("Accept-Patch", mediaTypeMergePatch+", "+mediaTypeJSONPatch)
+			}
+			if len(pe.fields) > 0 {
+				writeValidationProblem(w, r, pe.fields...)
+				return
+			}
+			writeProblemDetail(w, r, pe.status, pe.code, pe.message)
 			return
 		}
+		slog.ErrorContext(r.Context(), "Error aplicando el parche", "product_id", products[productIndex].ID, "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
 
-		updatedProduct.ID = id
-		updatedProduct.CreatedAt = products[productIndex].CreatedAt // Mantener la fecha de creación original
-		updatedProduct.UpdatedAt = time.Now()
-
-		products[productIndex] = updatedProduct
-		json.NewEncoder(w).Encode(updatedProduct)
+	// La validación se aplica al documento resultante, igual que en PUT
+	if errs := validateStruct(&patchedProduct); len(errs) > 0 {
+		writeValidationProblem(w, r, errs...)
+		return
+	}
 
-	case http.MethodDelete:
-		// Solo permitir DELETE si el usuario es Admin
-		if user.Role != "Admin" {
-			http.Error(w, "Acceso denegado: No tienes permisos para eliminar productos.", http.StatusForbidden)
-			return
-		}
+	if skuTaken(patchedProduct) {
+		writeProblem(w, r, http.StatusConflict, "sku_taken")
+		return
+	}
+	patchedProduct.UpdatedAt = time.Now()
+	patchedProduct.Version++
 
-		// Eliminar el producto del slice
-		products = append(products[:productIndex], products[productIndex+1:]...)
-		w.WriteHeader(http.StatusOK) // 200 OK para éxito de eliminación
-		json.NewEncoder(w).Encode(map[string]string{"message": "Producto eliminado exitosamente"})
+	recordAudit(r, nil, auditEvent{Action: "product.update", TargetType: auditTargetProduct, TargetID: strconv.Itoa(patchedProduct.ID), Before: products[productIndex], After: patchedProduct})
+	products[productIndex] = patchedProduct
+	recordRevision(r, patchedProduct, revisionUpdate)
+	w.Header().Set("ETag", productETag(patchedProduct))
+	json.NewEncoder(w).Encode(patchedProduct)
+}
 
-	default:
-		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+// Handler que envía un producto a la papelera (solo Admin). Deja de aparecer en los
+// listados y devuelve 404, pero conserva sus imágenes hasta que se purga (trash.go).
+func deleteProductHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsDelete); !ok {
+		return
+	}
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	productIndex := productIndexFromPath(w, r)
+	if productIndex == -1 {
+		return
+	}
+	if !checkIfMatch(w, r, products[productIndex]) {
+		return
 	}
+
+	before := products[productIndex]
+	now := time.Now()
+	products[productIndex].DeletedAt = &now
+	products[productIndex].UpdatedAt = now
+	products[productIndex].Version++
+	recordRevision(r, products[productIndex], revisionDelete)
+	recordAudit(r, nil, auditEvent{Action: "product.delete", TargetType: auditTargetProduct, TargetID: strconv.Itoa(before.ID), Before: before, After: products[productIndex]})
+	slog.InfoContext(r.Context(), "Producto enviado a la papelera", "product_id", before.ID)
+	w.WriteHeader(http.StatusOK) // 200 OK para éxito de eliminación
+	json.NewEncoder(w).Encode(map[string]string{"message": "Producto enviado a la papelera"})
 }
 
 // Handler de logout
@@ -521,16 +809,26 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-CSRF-Token")
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
+	// Con una sesión válida, solo se cierra si la petición trae su token CSRF
+	session, user := sessionFromCookie(r)
+	if session != nil && !checkCSRF(w, r) {
 		return
 	}
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
-		return
+	// Cerrar la sesión en el servidor: sesión opaca o familia de refresh tokens (modo JWT)
+	if cookie, err := r.Cookie("session_token"); err == nil {
+		if looksLikeJWT(cookie.Value) {
+			if _, claims := userFromJWT(cookie.Value); claims != nil {
+				revokeRefreshFamily(claims.SessionID)
+			}
+		} else {
+			deleteSession(models.SessionID(cookie.Value))
+		}
+	}
+	if session != nil && !session.MFAPending {
+		recordAudit(r, user, auditEvent{Action: "session.logout", TargetType: auditTargetSession, TargetID: strconv.Itoa(user.ID)})
 	}
 
 	// Invalidar la cookie de sesión
@@ -543,10 +841,18 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 		Expires:  time.Now().Add(-1 * time.Hour), // Expira la cookie inmediatamente
 		SameSite: http.SameSiteLaxMode,
 	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookieName,
+		Value:    "",
+		Path:     refreshCookiePath,
+		HttpOnly: true,
+		Secure:   false, // Cambiar a 'true' en producción con HTTPS
+		Expires:  time.Now().Add(-1 * time.Hour),
+		SameSite: http.SameSiteStrictMode,
+	})
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Logout exitoso"})
-	log.Println("Sesión cerrada exitosamente.")
 }
 
 // Handler para verificar sesión
@@ -557,38 +863,29 @@ func checkSessionHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	log.Printf("Verificando sesión en /api/auth/check-session")
-
-	if r.Method != http.MethodGet {
-		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
-		return
-	}
-
 	cookie, err := r.Cookie("session_token")
 	if err != nil {
-		log.Printf("Error al obtener cookie en check-session: %v", err)
-		http.Error(w, "No autenticado: Cookie de sesión no encontrada", http.StatusUnauthorized)
+		writeProblem(w, r, http.StatusUnauthorized, "session_missing")
 		return
 	}
 
-	// Buscar sesión válida
+	// Buscar sesión válida (opaca o access token JWT)
 	var validSession *models.Session
+	if looksLikeJWT(cookie.Value) {
+		if jwtUser, claims := userFromJWT(cookie.Value); jwtUser != nil {
+			validSession = &models.Session{ID: models.SessionID(claims.SessionID), UserID: jwtUser.ID, ExpiresAt: time.Unix(claims.ExpiresAt, 0)}
+		}
+	}
 	for i := range sessions {
 		session := &sessions[i]
-		if session.ID == models.SessionID(cookie.Value) && session.ExpiresAt.After(time.Now()) {
+		if session.ID == models.SessionID(cookie.Value) && session.ExpiresAt.After(time.Now()) && !session.MFAPending {
 			validSession = session
 			break
 		}
 	}
 
 	if validSession == nil {
-		log.Printf("Sesión no válida o expirada en check-session para token: %s", cookie.Value)
-		http.Error(w, "Sesión inválida o expirada", http.StatusUnauthorized)
+		writeProblem(w, r, http.StatusUnauthorized, "session_invalid")
 		return
 	}
 
@@ -602,12 +899,12 @@ func checkSessionHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if user == nil {
-		log.Printf("Error interno: Usuario ID %d no encontrado para sesión válida.", validSession.UserID)
-		http.Error(w, "Error interno: Usuario no encontrado", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Usuario de una sesión válida no encontrado", "user_id", validSession.UserID)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
 		return
 	}
 
-	log.Printf("Sesión válida encontrada para usuario: %s (ID: %d, Rol: %s)", user.Username, user.ID, user.Role)
+	setLogUser(r, user.ID)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -617,3 +914,70 @@ func checkSessionHandler(w http.ResponseWriter, r *http.Request) {
 		"role":     user.Role,
 	})
 }
+
+// Cuerpo del cambio de contraseña
+type changePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" validate:"required,maxbytes=72"`
+	NewPassword     string `json:"newPassword" validate:"required"`
+}
+
+// Handler para cambiar la contraseña del usuario autenticado
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	if !ok || user == nil {
+		slog.ErrorContext(r.Context(), "Usuario no encontrado en el contexto")
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	if authMethod(r) != authMethodSession {
+		writeProblem(w, r, http.StatusForbidden, "session_auth_required")
+		return
+	}
+
+	var req changePasswordRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if user.ExternalSubject != "" {
+		writeProblem(w, r, http.StatusBadRequest, "external_account")
+		return
+	}
+
+	if err := checkPassword(r.Context(), []byte(user.PasswordHash), []byte(req.CurrentPassword)); err != nil {
+		slog.InfoContext(r.Context(), "Cambio de contraseña rechazado: contraseña actual incorrecta", "user_id", user.ID)
+		writeProblem(w, r, http.StatusUnauthorized, "current_password_wrong")
+		return
+	}
+
+	if violations := passwordPolicy.Validate(user.Username, req.NewPassword); len(violations) > 0 {
+		writeValidationProblem(w, r, violations...)
+		return
+	}
+
+	hashedPassword, err := hashPassword(r.Context(), []byte(req.NewPassword))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error hasheando la contraseña", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	user.PasswordHash = string(hashedPassword)
+
+	// Mantener la sesión actual y cerrar las demás
+	var current models.SessionID
+	if cookie, err := r.Cookie("session_token"); err == nil {
+		current = models.SessionID(cookie.Value)
+		if looksLikeJWT(cookie.Value) {
+			if _, claims := userFromJWT(cookie.Value); claims != nil {
+				current = models.SessionID(claims.SessionID) // familia de refresh tokens de esta sesión
+			}
+		}
+	}
+	closed := deleteUserSessions(user.ID, current)
+	recordAudit(r, user, auditEvent{Action: "user.password_change", TargetType: auditTargetUser, TargetID: strconv.Itoa(user.ID)})
+	slog.InfoContext(r.Context(), "Contraseña cambiada", "user_id", user.ID, "sessions_closed", closed)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Contraseña actualizada exitosamente"})
+}
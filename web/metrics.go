@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Métricas en el formato de texto de Prometheus (versión 0.0.4), sin dependencias
+// externas. GET /metrics las expone; si TIENDA_METRICS_TOKEN está definido, exige
+// Authorization: Bearer <token>.
+
+// Buckets por defecto de los clientes de Prometheus, en segundos
+var httpDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// bcrypt con coste 10 tarda decenas de milisegundos
+var bcryptDurationBuckets = []float64{.01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// routeOther agrupa las peticiones que no pasan por el router de la API (SPA,
+// estáticos, /metrics, 404), para que la ruta real no dispare la cardinalidad
+const routeOther = "other"
+
+// methodOther agrupa los métodos fuera de metricMethods: el método lo elige el cliente
+// y, usado tal cual como etiqueta, cada texto distinto crearía una serie nueva
+const methodOther = "OTHER"
+
+var metricMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+	http.MethodConnect: true, http.MethodTrace: true,
+}
+
+// methodLabel es la etiqueta method de una petición
+func methodLabel(method string) string {
+	if metricMethods[method] {
+		return method
+	}
+	return methodOther
+}
+
+var (
+	processStartTime = time.Now()
+	metricsToken     = getEnv("TIENDA_METRICS_TOKEN", "")
+
+	httpRequestsTotal = newCounterVec("tienda_http_requests_total",
+		"Peticiones HTTP atendidas.", "method", "route", "status")
+	httpRequestDuration = newHistogramVec("tienda_http_request_duration_seconds",
+		"Duración de las peticiones HTTP en segundos.", httpDurationBuckets, "method", "route", "status")
+	httpRequestsInFlight atomic.Int64
+
+	loginAttemptsTotal = newCounterVec("tienda_login_attempts_total",
+		"Intentos de login por método (password, totp, oidc) y resultado.", "method", "result")
+	rateLimitedTotal = newCounterVec("tienda_rate_limited_total",
+		"Peticiones rechazadas por límite de peticiones, por política.", "policy")
+	bcryptDuration = newHistogramVec("tienda_bcrypt_duration_seconds",
+		"Duración de las operaciones bcrypt en segundos.", bcryptDurationBuckets, "operation")
+)
+
+// Resultados de tienda_login_attempts_total
+const (
+	loginResultSuccess     = "success"
+	loginResultFailure     = "failure"
+	loginResultThrottled   = "throttled"    // rechazado por loginGuard antes de comprobar nada
+	loginResultMFARequired = "mfa_required" // contraseña correcta; falta el segundo factor
+)
+
+// recordLogin cuenta un intento de login
+func recordLogin(method, result string) {
+	loginAttemptsTotal.inc(method, result)
+}
+
+// metricsMiddleware cuenta y mide cada petición. Debe ir dentro de accessLogMiddleware,
+// que crea el requestLogInfo donde el router deja la ruta.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpRequestsInFlight.Add(1)
+		defer httpRequestsInFlight.Add(-1)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := routeOther
+		if info := logInfo(r); info != nil && info.route != "" {
+			route = info.route
+		}
+		method, status := methodLabel(r.Method), strconv.Itoa(rec.status)
+		httpRequestsTotal.inc(method, route, status)
+		httpRequestDuration.observe(time.Since(start).Seconds(), method, route, status)
+	})
+}
+
+// Handler de GET /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) {
+		return
+	}
+	if metricsToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			writeProblem(w, r, http.StatusUnauthorized, "token_invalid")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	writeMetrics(w)
+}
+
+// writeMetrics escribe todas las métricas de la aplicación y del runtime de Go
+func writeMetrics(w io.Writer) {
+	httpRequestsTotal.write(w)
+	httpRequestDuration.write(w)
+	writeGauge(w, "tienda_http_requests_in_flight", "Peticiones HTTP en curso.", float64(httpRequestsInFlight.Load()))
+	loginAttemptsTotal.write(w)
+	rateLimitedTotal.write(w)
+	bcryptDuration.write(w)
+
+	writeGauge(w, "tienda_sessions_active", "Sesiones de login activas (no caducadas ni revocadas).", float64(activeSessionCount(time.Now())))
+	catalogMu.RLock()
+	active := len(activeProducts())
+	trashed := len(products) - active
+	catalogMu.RUnlock()
+	writeGauge(w, "tienda_products", "Productos en el catálogo.", float64(active))
+	writeGauge(w, "tienda_products_trashed", "Productos en la papelera, pendientes de purgar.", float64(trashed))
+	writeGauge(w, "tienda_users", "Usuarios registrados.", float64(len(users)))
+
+	writeRuntimeMetrics(w)
+}
+
+// activeSessionCount cuenta las sesiones completas vigentes: las opacas y, en modo JWT,
+// las familias de refresh tokens que aún pueden renovarse
+func activeSessionCount(now time.Time) int {
+	count := 0
+	for _, s := range sessions {
+		if !s.MFAPending && now.Before(s.ExpiresAt) {
+			count++
+		}
+	}
+	families := make(map[string]bool)
+	refreshTokensMu.Lock()
+	defer refreshTokensMu.Unlock()
+	for _, t := range refreshTokens {
+		if t.RevokedAt == nil && t.UsedAt == nil && now.Before(t.ExpiresAt) {
+			families[t.FamilyID] = true
+		}
+	}
+	return count + len(families)
+}
+
+func writeRuntimeMetrics(w io.Writer) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	fmt.Fprintf(w, "# HELP go_info Versión de Go del binario.\n# TYPE go_info gauge\ngo_info{version=%q} 1\n", runtime.Version())
+	writeGauge(w, "go_goroutines", "Goroutines existentes.", float64(runtime.NumGoroutine()))
+	writeGauge(w, "go_memstats_alloc_bytes", "Bytes del heap asignados y en uso.", float64(mem.HeapAlloc))
+	writeGauge(w, "go_memstats_heap_inuse_bytes", "Bytes en spans del heap en uso.", float64(mem.HeapInuse))
+	writeGauge(w, "go_memstats_heap_objects", "Objetos asignados en el heap.", float64(mem.HeapObjects))
+	writeGauge(w, "go_memstats_sys_bytes", "Bytes obtenidos del sistema operativo.", float64(mem.Sys))
+	writeCounter(w, "go_memstats_mallocs_total", "Asignaciones de memoria realizadas.", float64(mem.Mallocs))
+	writeCounter(w, "go_gc_cycles_total", "Ciclos de recolección de basura completados.", float64(mem.NumGC))
+	writeCounter(w, "go_gc_pause_seconds_total", "Tiempo total de pausa del recolector en segundos.", float64(mem.PauseTotalNs)/1e9)
+	writeGauge(w, "process_start_time_seconds", "Hora de arranque del proceso en segundos desde la época Unix.", float64(processStartTime.UnixNano())/1e9)
+}
+
+// --- Tipos de métrica ---
+
+// labelKey identifica una serie por los valores de sus etiquetas
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels devuelve {a="x",b="y"} escapando los valores; extra se añade al final (le del histograma)
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	pairs := append(append([]string(nil), interleave(names, values)...), extra...)
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func interleave(names, values []string) []string {
+	pairs := make([]string, 0, 2*len(names))
+	for i, name := range names {
+		pairs = append(pairs, name, values[i])
+	}
+	return pairs
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func writeCounter(w io.Writer, name, help string, value float64) {
+	writeHeader(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+// sortedKeys devuelve las claves ordenadas para que la salida sea estable
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// counterVec es un contador con etiquetas
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	count  float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: make(map[string]*counterSeries)}
+}
+
+func (c *counterVec) inc(values ...string) {
+	key := labelKey(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{values: values}
+		c.series[key] = s
+	}
+	s.count++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.values), formatFloat(s.count))
+	}
+}
+
+// histogramVec es un histograma con etiquetas y buckets fijos
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64 // por bucket, sin acumular
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.values), s.count)
+	}
+}
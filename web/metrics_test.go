@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics pide /metrics y devuelve el valor de cada serie, indexado por el nombre
+// con sus etiquetas tal como aparece en la exposición
+func scrapeMetrics(t *testing.T, baseURL string) map[string]float64 {
+	t.Helper()
+	resp, err := http.Get(baseURL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /metrics = %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	series := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, raw, found := strings.Cut(line, "} ")
+		if found {
+			name += "}"
+		} else {
+			name, raw, found = strings.Cut(line, " ")
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if !found || err != nil {
+			t.Fatalf("línea de métrica no válida: %q", line)
+		}
+		series[name] = value
+	}
+	return series
+}
+
+func doRequest(t *testing.T, method, url string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func TestMetricsHTTPRequests(t *testing.T) {
+	srv := newTestServer(t)
+	const openapi = `route="/api/openapi.json",status="200"`
+	const brewed = `route="/api/openapi.json",status="405"`
+	before := scrapeMetrics(t, srv.URL)
+
+	for i := 0; i < 3; i++ {
+		doRequest(t, http.MethodGet, srv.URL+"/api/openapi.json")
+	}
+	doRequest(t, "BREW", srv.URL+"/api/openapi.json")
+	doRequest(t, "BREW-42", srv.URL+"/api/openapi.json")
+
+	after := scrapeMetrics(t, srv.URL)
+	delta := func(series string) float64 { return after[series] - before[series] }
+
+	if got := delta(`tienda_http_requests_total{method="GET",` + openapi + `}`); got != 3 {
+		t.Errorf("peticiones GET contadas = %v, se esperaban 3", got)
+	}
+	if got := delta(`tienda_http_requests_total{method="OTHER",` + brewed + `}`); got != 2 {
+		t.Errorf("peticiones con método desconocido contadas como OTHER = %v, se esperaban 2", got)
+	}
+	for series := range after {
+		if strings.Contains(series, `method="BREW`) {
+			t.Errorf("el método del cliente no debería usarse como etiqueta: %s", series)
+		}
+	}
+
+	// Histograma: cubetas acumulativas, +Inf igual a _count y _count igual al contador
+	prefix := `tienda_http_request_duration_seconds`
+	labels := `method="GET",` + openapi
+	previous := 0.0
+	for _, le := range httpDurationBuckets {
+		bucket, ok := after[prefix+`_bucket{`+labels+`,le="`+formatFloat(le)+`"}`]
+		if !ok {
+			t.Fatalf("falta la cubeta le=%v", le)
+		}
+		if bucket < previous {
+			t.Errorf("la cubeta le=%v (%v) es menor que la anterior (%v)", le, bucket, previous)
+		}
+		previous = bucket
+	}
+	inf := after[prefix+`_bucket{`+labels+`,le="+Inf"}`]
+	count := after[prefix+`_count{`+labels+`}`]
+	total := after[`tienda_http_requests_total{`+labels+`}`]
+	if inf != count || count != total || inf < previous {
+		t.Errorf("+Inf = %v, _count = %v, contador = %v; deberían coincidir", inf, count, total)
+	}
+	if _, ok := after[prefix+`_sum{`+labels+`}`]; !ok {
+		t.Errorf("falta %s_sum", prefix)
+	}
+}
+
+func TestMetricsGauges(t *testing.T) {
+	srv := newTestServer(t)
+	series := scrapeMetrics(t, srv.URL)
+
+	// La propia petición a /metrics está en curso mientras se escribe
+	if got := series["tienda_http_requests_in_flight"]; got != 1 {
+		t.Errorf("tienda_http_requests_in_flight = %v, se esperaba 1", got)
+	}
+	catalogMu.RLock()
+	active := len(activeProducts())
+	trashed := len(products) - active
+	catalogMu.RUnlock()
+	want := map[string]float64{
+		"tienda_products":         float64(active),
+		"tienda_products_trashed": float64(trashed),
+		"tienda_users":            float64(len(users)),
+	}
+	for name, value := range want {
+		if got, ok := series[name]; !ok || got != value {
+			t.Errorf("%s = %v (presente: %v), se esperaba %v", name, got, ok, value)
+		}
+	}
+	if series["go_goroutines"] < 1 || series["process_start_time_seconds"] <= 0 {
+		t.Errorf("faltan las métricas del runtime: go_goroutines=%v process_start_time_seconds=%v",
+			series["go_goroutines"], series["process_start_time_seconds"])
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	srv := newTestServer(t)
+	metricsToken = "secreto-de-prueba"
+	t.Cleanup(func() { metricsToken = "" })
+
+	for _, tc := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer otro", http.StatusUnauthorized},
+		{"Bearer secreto-de-prueba", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/metrics", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("Authorization %q: estado %d, se esperaba %d", tc.auth, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestMethodLabel(t *testing.T) {
+	for method, want := range map[string]string{
+		http.MethodGet: "GET", http.MethodDelete: "DELETE", http.MethodOptions: "OPTIONS",
+		"get": methodOther, "BREW": methodOther, "": methodOther,
+	} {
+		if got := methodLabel(method); got != want {
+			t.Errorf("methodLabel(%q) = %q, se esperaba %q", method, got, want)
+		}
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+const (
+	oidcStateCookie    = "oidc_state"
+	oidcCookiePath     = "/api/auth/oidc"
+	oidcPendingTTL     = 10 * time.Minute
+	oidcDiscoveryTTL   = 1 * time.Hour
+	oidcJWKSMinRefetch = 1 * time.Minute
+	oidcClockSkew      = 1 * time.Minute
+)
+
+// oidcConfig es la configuración del relying party
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       string
+	RoleClaim    string            // claim con los grupos/roles externos (p. ej. "groups")
+	RoleMap      map[string]string // valor externo -> rol local
+	DefaultRole  string
+}
+
+// oidcDiscovery es el subconjunto del documento de discovery que se usa
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcPendingLogin guarda los valores de un login en curso, indexados por state
+type oidcPendingLogin struct {
+	Nonce        string
+	CodeVerifier string
+	CreatedAt    time.Time
+}
+
+// oidcClient es el relying party: cachea discovery y JWKS y guarda los logins en curso
+type oidcClient struct {
+	cfg  oidcConfig
+	http *http.Client
+
+	mu           sync.Mutex
+	discovery    *oidcDiscovery
+	discoveredAt time.Time
+	keys         map[string]*rsa.PublicKey
+	keysFetched  time.Time
+	pending      map[string]oidcPendingLogin
+}
+
+// oidc es nil cuando el login corporativo no está configurado
+var oidc *oidcClient
+
+// mountFakeOIDC monta el proveedor de pruebas y ajusta la configuración para usarlo;
+// devuelve el cliente HTTP que habla con él en memoria. Solo se define al compilar
+// con -tags oidcfake (oidc_fake.go), de modo que el binario normal no lo incluye.
+var mountFakeOIDC func(mux *serveMux, cfg *oidcConfig) (*http.Client, error)
+
+// rolePriority ordena los roles locales para quedarse con el de más privilegios
+var rolePriority = map[string]int{"User": 1, "Editor": 2, "Admin": 3}
+
+func newOIDCClient(cfg oidcConfig, httpClient *http.Client) *oidcClient {
+	return &oidcClient{
+		cfg:     cfg,
+		http:    httpClient,
+		keys:    make(map[string]*rsa.PublicKey),
+		pending: make(map[string]oidcPendingLogin),
+	}
+}
+
+// setupOIDC configura el login corporativo a partir de TIENDA_OIDC_*. Con
+// TIENDA_OIDC_FAKE=true, en un binario compilado con -tags oidcfake, usa el proveedor
+// de pruebas de oidc_fake.go, que funciona sin red.
+func setupOIDC(mux *serveMux) error {
+	cfg := oidcConfig{
+		Issuer:       getEnv("TIENDA_OIDC_ISSUER", ""),
+		ClientID:     getEnv("TIENDA_OIDC_CLIENT_ID", ""),
+		ClientSecret: getEnv("TIENDA_OIDC_CLIENT_SECRET", ""),
+		RedirectURL:  getEnv("TIENDA_OIDC_REDIRECT_URL", strings.TrimRight(publicBaseURL, "/")+"/api/auth/oidc/callback"),
+		Scopes:       getEnv("TIENDA_OIDC_SCOPES", "openid profile email groups"),
+		RoleClaim:    getEnv("TIENDA_OIDC_ROLE_CLAIM", "groups"),
+		RoleMap:      parseRoleMap(getEnv("TIENDA_OIDC_ROLE_MAP", "")),
+		DefaultRole:  getEnv("TIENDA_OIDC_DEFAULT_ROLE", "User"),
+	}
+	httpClient := &http.Client{Timeout: 10 * time.Second, Transport: tracingTransport{http.DefaultTransport}}
+
+	if envBool("TIENDA_OIDC_FAKE", false) {
+		if mountFakeOIDC == nil {
+			return errors.New("TIENDA_OIDC_FAKE requiere un binario compilado con -tags oidcfake")
+		}
+		client, err := mountFakeOIDC(mux, &cfg)
+		if err != nil {
+			return err
+		}
+		httpClient = client
+	}
+
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		slog.Info("Login OIDC desactivado (TIENDA_OIDC_ISSUER/TIENDA_OIDC_CLIENT_ID sin configurar)")
+		return nil
+	}
+	oidc = newOIDCClient(cfg, httpClient)
+	slog.Info("Login OIDC configurado", "issuer", cfg.Issuer)
+	return nil
+}
+
+// parseRoleMap interpreta "grupo=Rol,otro=Rol"
+func parseRoleMap(value string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		external, local, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && external != "" && local != "" {
+			m[strings.TrimSpace(external)] = strings.TrimSpace(local)
+		}
+	}
+	return m
+}
+
+// getDiscovery obtiene (y cachea) el documento de discovery del emisor
+func (c *oidcClient) getDiscovery() (*oidcDiscovery, error) {
+	c.mu.Lock()
+	if c.discovery != nil && time.Since(c.discoveredAt) < oidcDiscoveryTTL {
+		d := c.discovery
+		c.mu.Unlock()
+		return d, nil
+	}
+	c.mu.Unlock()
+
+	var d oidcDiscovery
+	if err := c.getJSON(strings.TrimRight(c.cfg.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if d.Issuer != c.cfg.Issuer {
+		return nil, fmt.Errorf("discovery: el emisor %q no coincide con el configurado %q", d.Issuer, c.cfg.Issuer)
+	}
+
+	c.mu.Lock()
+	c.discovery, c.discoveredAt = &d, time.Now()
+	c.mu.Unlock()
+	return &d, nil
+}
+
+// publicKey devuelve la clave del kid, refrescando el JWKS si es desconocida
+// (como mucho una vez por minuto, para no amplificar tokens con kid inventados)
+func (c *oidcClient) publicKey(kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	stale := time.Since(c.keysFetched) > oidcJWKSMinRefetch
+	c.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("clave %q desconocida", kid)
+	}
+
+	d, err := c.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := c.getJSON(d.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	c.mu.Lock()
+	c.keys, c.keysFetched = keys, time.Now()
+	c.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("clave %q desconocida", kid)
+}
+
+func (c *oidcClient) getJSON(u string, v interface{}) error {
+	resp, err := c.http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: estado %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// oidcIDClaims son los claims del id_token que se validan y mapean
+type oidcIDClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"` // string o lista
+	AuthorizedParty   string          `json:"azp"`
+	ExpiresAt         int64           `json:"exp"`
+	IssuedAt          int64           `json:"iat"`
+	Nonce             string          `json:"nonce"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+	raw               map[string]interface{}
+}
+
+// verifyIDToken valida firma RS256, emisor, audiencia, caducidad y nonce
+func (c *oidcClient) verifyIDToken(token, nonce string, now time.Time) (*oidcIDClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id_token mal formado")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("id_token mal formado")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("id_token mal formado")
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("algoritmo de id_token no admitido: %s", header.Alg)
+	}
+	key, err := c.publicKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("firma de id_token mal formada")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("firma de id_token inválida")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("id_token mal formado")
+	}
+	var claims oidcIDClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("id_token mal formado")
+	}
+	if err := json.Unmarshal(payload, &claims.raw); err != nil {
+		return nil, errors.New("id_token mal formado")
+	}
+
+	if claims.Issuer != c.cfg.Issuer {
+		return nil, fmt.Errorf("emisor inesperado: %s", claims.Issuer)
+	}
+	var audiences []string
+	if err := json.Unmarshal(claims.Audience, &audiences); err != nil {
+		var single string
+		if err := json.Unmarshal(claims.Audience, &single); err != nil {
+			return nil, errors.New("audiencia mal formada")
+		}
+		audiences = []string{single}
+	}
+	found := false
+	for _, aud := range audiences {
+		if aud == c.cfg.ClientID {
+			found = true
+		}
+	}
+	if !found || (len(audiences) > 1 && claims.AuthorizedParty != c.cfg.ClientID) {
+		return nil, errors.New("el id_token no está dirigido a este cliente")
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(oidcClockSkew)) {
+		return nil, errors.New("id_token expirado")
+	}
+	if time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("id_token emitido en el futuro")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id_token sin sub")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("nonce inválido")
+	}
+	return &claims, nil
+}
+
+// mapRole traduce el claim de grupos/roles externo al rol local de más privilegios
+func (c *oidcClient) mapRole(claims *oidcIDClaims) string {
+	var values []string
+	switch v := claims.raw[c.cfg.RoleClaim].(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	role := c.cfg.DefaultRole
+	for _, value := range values {
+		if mapped, ok := c.cfg.RoleMap[value]; ok && rolePriority[mapped] > rolePriority[role] {
+			role = mapped
+		}
+	}
+	return role
+}
+
+// upsertOIDCUser busca el usuario vinculado a la identidad externa o lo crea.
+// Nunca se vincula por nombre a una cuenta local existente, para evitar tomas de cuenta.
+func (c *oidcClient) upsertOIDCUser(r *http.Request, claims *oidcIDClaims) *models.User {
+	role := c.mapRole(claims)
+	for i := range users {
+		if users[i].ExternalIssuer == claims.Issuer && users[i].ExternalSubject == claims.Subject {
+			if users[i].Role != role {
+				slog.InfoContext(r.Context(), "Rol de usuario OIDC actualizado", "user_id", users[i].ID, "old_role", users[i].Role, "role", role)
+				before := users[i]
+				users[i].Role = role // el proveedor es la fuente de verdad de los roles
+				recordAudit(r, nil, auditEvent{Action: "user.role_change", TargetType: auditTargetUser, TargetID: strconv.Itoa(users[i].ID), Before: before, After: users[i]})
+			}
+			return &users[i]
+		}
+	}
+
+	base := claims.PreferredUsername
+	if base == "" && claims.Email != "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	if base == "" {
+		base = "oidc-" + claims.Subject
+	}
+	username := base
+	for n := 2; usernameTaken(username); n++ {
+		username = base + "-" + strconv.Itoa(n)
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	newUser := models.User{
+		ID:              userIDSeq,
+		Username:        username,
+		Role:            role,
+		CreatedAt:       time.Now(),
+		ExternalIssuer:  claims.Issuer,
+		ExternalSubject: claims.Subject,
+	}
+	userIDSeq++
+	users = append(users, newUser)
+	recordAudit(r, nil, auditEvent{Action: "user.create", TargetType: auditTargetUser, TargetID: strconv.Itoa(newUser.ID), After: newUser})
+	slog.InfoContext(r.Context(), "Usuario OIDC creado", "user_id", newUser.ID, "username", newUser.Username, "role", newUser.Role, "subject", claims.Subject)
+	return &users[len(users)-1]
+}
+
+func usernameTaken(username string) bool {
+	for _, u := range users {
+		if u.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcRandom genera un valor aleatorio de 32 bytes para state, nonce o code_verifier
+func oidcRandom() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Handler que indica a la SPA si el login corporativo está disponible
+func oidcConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":  oidc != nil,
+		"loginUrl": "/api/auth/oidc/login",
+	})
+}
+
+// Handler que inicia el flujo authorization code con PKCE redirigiendo al proveedor
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		writeProblem(w, r, http.StatusNotFound, "oidc_disabled")
+		return
+	}
+
+	d, err := oidc.getDiscovery()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error obteniendo el discovery OIDC", "error", err)
+		writeProblem(w, r, http.StatusBadGateway, "oidc_provider_unavailable")
+		return
+	}
+
+	var values [3]string // state, nonce y code_verifier
+	for i := range values {
+		if values[i], err = oidcRandom(); err != nil {
+			slog.ErrorContext(r.Context(), "Error generando los parámetros del login OIDC", "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+			return
+		}
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+	challenge := sha256.Sum256([]byte(verifier))
+
+	oidc.mu.Lock()
+	for s, p := range oidc.pending {
+		if time.Since(p.CreatedAt) > oidcPendingTTL {
+			delete(oidc.pending, s)
+		}
+	}
+	oidc.pending[state] = oidcPendingLogin{Nonce: nonce, CodeVerifier: verifier, CreatedAt: time.Now()}
+	oidc.mu.Unlock()
+
+	// El state también se guarda en una cookie para ligar el callback a este navegador
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     oidcCookiePath,
+		HttpOnly: true,
+		Secure:   false, // Cambiar a 'true' en producción con HTTPS
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(oidcPendingTTL / time.Second),
+	})
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", oidc.cfg.ClientID)
+	params.Set("redirect_uri", oidc.cfg.RedirectURL)
+	params.Set("scope", oidc.cfg.Scopes)
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	http.Redirect(w, r, d.AuthorizationEndpoint+"?"+params.Encode(), http.StatusFound)
+}
+
+// Handler del callback: valida state, canjea el código, verifica el id_token y abre sesión
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		writeProblem(w, r, http.StatusNotFound, "oidc_disabled")
+		return
+	}
+
+	q := r.URL.Query()
+	state := q.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		writeProblem(w, r, http.StatusBadRequest, "oidc_state_invalid")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: oidcCookiePath, MaxAge: -1})
+
+	oidc.mu.Lock()
+	pending, ok := oidc.pending[state]
+	delete(oidc.pending, state) // el state es de un solo uso
+	oidc.mu.Unlock()
+	if !ok || time.Since(pending.CreatedAt) > oidcPendingTTL {
+		writeProblem(w, r, http.StatusBadRequest, "oidc_state_invalid")
+		return
+	}
+
+	if errCode := q.Get("error"); errCode != "" {
+		slog.InfoContext(r.Context(), "El proveedor OIDC rechazó el login", "oidc_error", errCode)
+		recordLogin("oidc", loginResultFailure)
+		writeProblemDetail(w, r, http.StatusUnauthorized, "oidc_login_rejected", errCode)
+		return
+	}
+
+	d, err := oidc.getDiscovery()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error obteniendo el discovery OIDC", "error", err)
+		writeProblem(w, r, http.StatusBadGateway, "oidc_provider_unavailable")
+		return
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", q.Get("code"))
+	form.Set("redirect_uri", oidc.cfg.RedirectURL)
+	form.Set("code_verifier", pending.CodeVerifier)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(oidc.cfg.ClientID), url.QueryEscape(oidc.cfg.ClientSecret))
+
+	resp, err := oidc.http.Do(req)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error canjeando el código OIDC", "error", err)
+		writeProblem(w, r, http.StatusBadGateway, "oidc_provider_unavailable")
+		return
+	}
+	defer resp.Body.Close()
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil || resp.StatusCode != http.StatusOK || tokenResp.IDToken == "" {
+		slog.ErrorContext(r.Context(), "Respuesta de token OIDC inválida", "status", resp.StatusCode, "oidc_error", tokenResp.Error)
+		recordLogin("oidc", loginResultFailure)
+		writeProblem(w, r, http.StatusUnauthorized, "oidc_login_failed")
+		return
+	}
+
+	claims, err := oidc.verifyIDToken(tokenResp.IDToken, pending.Nonce, time.Now())
+	if err != nil {
+		slog.WarnContext(r.Context(), "id_token OIDC rechazado", "error", err)
+		recordLogin("oidc", loginResultFailure)
+		writeProblem(w, r, http.StatusUnauthorized, "oidc_identity_invalid")
+		return
+	}
+
+	user := oidc.upsertOIDCUser(r, claims)
+
+	// El segundo factor local sigue aplicándose igual que en el login con contraseña
+	if user.TOTPEnabled || requiresTwoFactor(user) {
+		startSession(w, user.ID, true)
+		recordLogin("oidc", loginResultMFARequired)
+		mode := "verify"
+		if !user.TOTPEnabled {
+			mode = "enroll"
+		}
+		http.Redirect(w, r, "/?mfa="+mode, http.StatusFound)
+		return
+	}
+
+	if _, err := establishSession(w, user); err != nil {
+		slog.ErrorContext(r.Context(), "Error creando la sesión", "user_id", user.ID, "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	setLogUser(r, user.ID)
+	recordLogin("oidc", loginResultSuccess)
+	recordAudit(r, user, auditEvent{Action: "session.login", TargetType: auditTargetSession, TargetID: strconv.Itoa(user.ID), After: map[string]string{"method": "oidc"}})
+	slog.InfoContext(r.Context(), "Login OIDC exitoso", "user_id", user.ID)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,39 @@
+//go:build oidcfake
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"TiendaSupported/modules/oidcfake"
+)
+
+// Proveedor OIDC de pruebas para desarrollo sin conexión. Solo se compila con
+// -tags oidcfake; se activa con TIENDA_OIDC_FAKE=true y se monta en /oidc-fake/.
+
+const oidcFakeMountPath = "/oidc-fake"
+
+func init() {
+	mountFakeOIDC = func(mux *serveMux, cfg *oidcConfig) (*http.Client, error) {
+		cfg.Issuer = strings.TrimRight(publicBaseURL, "/") + oidcFakeMountPath
+		cfg.ClientID = "tienda-local"
+		cfg.ClientSecret = "tienda-local-secret"
+		if len(cfg.RoleMap) == 0 {
+			cfg.RoleMap = map[string]string{"tienda-admins": "Admin", "tienda-editors": "Editor"}
+		}
+		provider, err := oidcfake.New(cfg.Issuer, cfg.ClientID, cfg.ClientSecret,
+			oidcfake.User{Subject: "fake-ana", PreferredUsername: "ana", Email: "ana@example.com", Name: "Ana Admin", Groups: []string{"tienda-admins"}},
+			oidcfake.User{Subject: "fake-beto", PreferredUsername: "beto", Email: "beto@example.com", Name: "Beto Editor", Groups: []string{"tienda-editors"}},
+			oidcfake.User{Subject: "fake-carla", PreferredUsername: "carla", Email: "carla@example.com", Name: "Carla Cliente"},
+		)
+		if err != nil {
+			return nil, err
+		}
+		mux.Handle(oidcFakeMountPath+"/", provider)
+		slog.Warn("Proveedor OIDC de pruebas activo (no usar en producción)", "issuer", cfg.Issuer)
+		// El servidor habla con el proveedor en memoria, sin pasar por la red
+		return provider.Client(), nil
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"TiendaSupported/modules/oidcfake"
+)
+
+// Pruebas del login OIDC contra el proveedor falso de modules/oidcfake, que atiende
+// en memoria: el relying party global (oidc) se configura contra él en cada prueba.
+
+const (
+	testOIDCIssuer   = "https://idp.example.com/realms/tienda"
+	testOIDCClientID = "tienda-test"
+	testOIDCSecret   = "tienda-test-secret"
+	testOIDCCallback = "http://localhost:8080/api/auth/oidc/callback"
+)
+
+var testOIDCUsers = []oidcfake.User{
+	{Subject: "sub-ana", PreferredUsername: "ana-oidc", Email: "ana@example.com", Groups: []string{"tienda-admins"}},
+	{Subject: "sub-carla", PreferredUsername: "carla-oidc", Email: "carla@example.com"},
+}
+
+// newTestOIDC crea el proveedor falso y apunta el relying party global a él
+func newTestOIDC(t *testing.T) *oidcfake.Provider {
+	t.Helper()
+	provider, err := oidcfake.New(testOIDCIssuer, testOIDCClientID, testOIDCSecret, testOIDCUsers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oidc = newOIDCClient(oidcConfig{
+		Issuer:       testOIDCIssuer,
+		ClientID:     testOIDCClientID,
+		ClientSecret: testOIDCSecret,
+		RedirectURL:  testOIDCCallback,
+		Scopes:       "openid profile email groups",
+		RoleClaim:    "groups",
+		RoleMap:      map[string]string{"tienda-admins": "Admin"},
+		DefaultRole:  "User",
+	}, provider.Client())
+	t.Cleanup(func() { oidc = nil })
+	return provider
+}
+
+// oidcTestLogin es un login en curso: la cookie de state y la URL de autorización
+type oidcTestLogin struct {
+	state     string
+	cookie    *http.Cookie
+	authorize *url.URL
+}
+
+// startOIDCLogin llama a /api/auth/oidc/login y devuelve la redirección al proveedor
+func startOIDCLogin(t *testing.T) oidcTestLogin {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	oidcLoginHandler(rec, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: estado %d, se esperaba 302", rec.Code)
+	}
+	authorize, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != authorize.Query().Get("state") {
+		t.Fatalf("login: la cookie de state no coincide con el parámetro state")
+	}
+	return oidcTestLogin{state: cookie.Value, cookie: cookie, authorize: authorize}
+}
+
+// authorizeAs aprueba el login en el proveedor como el usuario indicado y devuelve
+// la URL del callback a la que redirige
+func authorizeAs(t *testing.T, provider *oidcfake.Provider, authorize *url.URL, hint string) *url.URL {
+	t.Helper()
+	u := *authorize
+	q := u.Query()
+	q.Set("login_hint", hint)
+	u.RawQuery = q.Encode()
+
+	client := provider.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: estado %d, se esperaba 302", resp.StatusCode)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callback
+}
+
+// oidcCallback llama al callback con la cookie de state indicada (nil: sin cookie)
+func oidcCallback(callback *url.URL, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	if cookie != nil {
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	rec := httptest.NewRecorder()
+	oidcCallbackHandler(rec, req)
+	return rec
+}
+
+// problemCode devuelve el code de una respuesta problem+json
+func problemCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var p Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatalf("respuesta sin problem+json (estado %d): %s", rec.Code, rec.Body.String())
+	}
+	return p.Code
+}
+
+func expectProblem(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("estado %d, se esperaba %d: %s", rec.Code, status, rec.Body.String())
+	}
+	if got := problemCode(t, rec); got != code {
+		t.Fatalf("código %q, se esperaba %q", got, code)
+	}
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	provider := newTestOIDC(t)
+	login := startOIDCLogin(t)
+
+	q := login.authorize.Query()
+	if q.Get("client_id") != testOIDCClientID || q.Get("redirect_uri") != testOIDCCallback {
+		t.Fatalf("parámetros de autorización inesperados: %v", q)
+	}
+	if q.Get("nonce") == "" || q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("falta nonce o PKCE en la autorización: %v", q)
+	}
+
+	rec := oidcCallback(authorizeAs(t, provider, login.authorize, "sub-ana"), login.cookie)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/" {
+		t.Fatalf("callback: estado %d, Location %q: %s", rec.Code, rec.Header().Get("Location"), rec.Body.String())
+	}
+	var session *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "session_token" && c.Value != "" {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("callback: no se abrió sesión")
+	}
+
+	user := findUserByName("ana-oidc")
+	if user == nil {
+		t.Fatal("no se creó el usuario OIDC")
+	}
+	if user.ExternalIssuer != testOIDCIssuer || user.ExternalSubject != "sub-ana" || user.Role != "Admin" {
+		t.Fatalf("usuario OIDC inesperado: issuer %q, subject %q, rol %q", user.ExternalIssuer, user.ExternalSubject, user.Role)
+	}
+
+	// Un segundo login con la misma identidad reutiliza la cuenta
+	count := len(users)
+	login = startOIDCLogin(t)
+	if rec := oidcCallback(authorizeAs(t, provider, login.authorize, "sub-ana"), login.cookie); rec.Code != http.StatusFound {
+		t.Fatalf("segundo login: estado %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(users) != count {
+		t.Fatalf("el segundo login creó otra cuenta")
+	}
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	provider := newTestOIDC(t)
+
+	t.Run("sin cookie", func(t *testing.T) {
+		login := startOIDCLogin(t)
+		expectProblem(t, oidcCallback(authorizeAs(t, provider, login.authorize, "sub-carla"), nil), http.StatusBadRequest, "oidc_state_invalid")
+	})
+
+	t.Run("cookie de otro login", func(t *testing.T) {
+		login, other := startOIDCLogin(t), startOIDCLogin(t)
+		expectProblem(t, oidcCallback(authorizeAs(t, provider, login.authorize, "sub-carla"), other.cookie), http.StatusBadRequest, "oidc_state_invalid")
+	})
+
+	t.Run("state desconocido", func(t *testing.T) {
+		callback, _ := url.Parse(testOIDCCallback + "?code=x&state=inventado")
+		expectProblem(t, oidcCallback(callback, &http.Cookie{Name: oidcStateCookie, Value: "inventado"}), http.StatusBadRequest, "oidc_state_invalid")
+	})
+
+	t.Run("state reutilizado", func(t *testing.T) {
+		login := startOIDCLogin(t)
+		callback := authorizeAs(t, provider, login.authorize, "sub-carla")
+		if rec := oidcCallback(callback, login.cookie); rec.Code != http.StatusFound {
+			t.Fatalf("primer callback: estado %d: %s", rec.Code, rec.Body.String())
+		}
+		expectProblem(t, oidcCallback(callback, login.cookie), http.StatusBadRequest, "oidc_state_invalid")
+	})
+}
+
+func TestOIDCCallbackErrors(t *testing.T) {
+	provider := newTestOIDC(t)
+
+	t.Run("login rechazado por el proveedor", func(t *testing.T) {
+		login := startOIDCLogin(t)
+		callback := authorizeAs(t, provider, login.authorize, "desconocido")
+		if callback.Query().Get("error") != "access_denied" {
+			t.Fatalf("el proveedor no devolvió access_denied: %s", callback)
+		}
+		expectProblem(t, oidcCallback(callback, login.cookie), http.StatusUnauthorized, "oidc_login_rejected")
+	})
+
+	t.Run("código inválido", func(t *testing.T) {
+		login := startOIDCLogin(t)
+		callback := authorizeAs(t, provider, login.authorize, "sub-carla")
+		q := callback.Query()
+		q.Set("code", "inventado")
+		callback.RawQuery = q.Encode()
+		expectProblem(t, oidcCallback(callback, login.cookie), http.StatusUnauthorized, "oidc_login_failed")
+	})
+
+	t.Run("proveedor no disponible", func(t *testing.T) {
+		login := startOIDCLogin(t)
+		callback := authorizeAs(t, provider, login.authorize, "sub-carla")
+		oidc.discovery = nil
+		oidc.http = &http.Client{Transport: failingTransport{}}
+		expectProblem(t, oidcCallback(callback, login.cookie), http.StatusBadGateway, "oidc_provider_unavailable")
+	})
+}
+
+// failingTransport simula un proveedor inaccesible
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("conexión rechazada")
+}
+
+func TestOIDCPKCE(t *testing.T) {
+	provider := newTestOIDC(t)
+
+	t.Run("code_verifier distinto", func(t *testing.T) {
+		login := startOIDCLogin(t)
+		callback := authorizeAs(t, provider, login.authorize, "sub-carla")
+		oidc.mu.Lock()
+		pending := oidc.pending[login.state]
+		pending.CodeVerifier, _ = oidcRandom()
+		oidc.pending[login.state] = pending
+		oidc.mu.Unlock()
+		expectProblem(t, oidcCallback(callback, login.cookie), http.StatusUnauthorized, "oidc_login_failed")
+	})
+
+	t.Run("autorización sin code_challenge", func(t *testing.T) {
+		login := startOIDCLogin(t)
+		q := login.authorize.Query()
+		q.Del("code_challenge")
+		login.authorize.RawQuery = q.Encode()
+		callback := authorizeAs(t, provider, login.authorize, "sub-carla")
+		if callback.Query().Get("error") != "invalid_request" || callback.Query().Get("code") != "" {
+			t.Fatalf("el proveedor aceptó una autorización sin PKCE: %s", callback)
+		}
+	})
+}
+
+func TestOIDCIDTokenValidation(t *testing.T) {
+	cases := []struct {
+		name   string
+		claims func(map[string]interface{})
+		ok     bool
+	}{
+		{"nonce distinto", func(c map[string]interface{}) { c["nonce"] = "otro" }, false},
+		{"sin nonce", func(c map[string]interface{}) { delete(c, "nonce") }, false},
+		{"audiencia de otro cliente", func(c map[string]interface{}) { c["aud"] = "otro-cliente" }, false},
+		{"varias audiencias sin azp", func(c map[string]interface{}) { c["aud"] = []string{testOIDCClientID, "otro-cliente"} }, false},
+		{"varias audiencias con azp de otro cliente", func(c map[string]interface{}) {
+			c["aud"], c["azp"] = []string{testOIDCClientID, "otro-cliente"}, "otro-cliente"
+		}, false},
+		{"varias audiencias con azp propio", func(c map[string]interface{}) {
+			c["aud"], c["azp"] = []string{testOIDCClientID, "otro-cliente"}, testOIDCClientID
+		}, true},
+		{"emisor distinto", func(c map[string]interface{}) { c["iss"] = "https://otro.example.com" }, false},
+		{"expirado", func(c map[string]interface{}) { c["exp"] = c["iat"].(int64) - 3600 }, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := newTestOIDC(t)
+			provider.Claims = tc.claims
+			login := startOIDCLogin(t)
+			rec := oidcCallback(authorizeAs(t, provider, login.authorize, "sub-carla"), login.cookie)
+			if tc.ok {
+				if rec.Code != http.StatusFound {
+					t.Fatalf("estado %d, se esperaba 302: %s", rec.Code, rec.Body.String())
+				}
+				return
+			}
+			expectProblem(t, rec, http.StatusUnauthorized, "oidc_identity_invalid")
+		})
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiOperation documenta un método de una ruta para la especificación OpenAPI
+type apiOperation struct {
+	Method     string
+	Summary    string
+	Handler    http.HandlerFunc
+	Permission string      // permiso requerido; "" si basta con autenticarse
+	Request    interface{} // valor del tipo del cuerpo (nil si no lleva cuerpo)
+	MediaTypes []string    // tipos del cuerpo; application/json por defecto
+	Response   interface{} // valor del tipo de la respuesta de éxito (nil si no tiene cuerpo)
+	Status     int         // estado de éxito; 200 por defecto
+	Headers    []string    // cabeceras de la petición que interpreta el handler
+	Query      []string    // parámetros de consulta: "nombre" (entero >= 1), "nombre:string", "nombre:boolean" o "nombre:date-time"
+	Errors     []int       // estados de error (problem+json) además de los comunes
+	RateLimit  string      // política de rateLimitPolicies; por defecto "api" con Auth y "public" sin ella
+	// ResponseType es el tipo de la respuesta de éxito; application/json por defecto
+	ResponseType string
+}
+
+// apiRoute es una entrada de la tabla de rutas: el patrón, relativo a /api (o a
+// /api/<versión>), y el handler y la documentación de cada método que acepta
+type apiRoute struct {
+	Pattern    string // patrón del router, p. ej. /products/{id:int}
+	Version    string // versión de la API ("" en las rutas sin versión, como /api/auth)
+	Tag        string
+	Auth       bool // se registra detrás de authMiddleware
+	Root       bool // se monta tal cual en la raíz del servidor, fuera de /api y del router
+	Operations []apiOperation
+}
+
+// registerRoutes monta en el mux, bajo /api/, un router con las rutas de la tabla.
+// Cada versión es un grupo con su versionMiddleware, y las rutas con Auth un subgrupo
+// con authMiddleware. Cada ruta versionada se registra también sin versión
+// (/api/v1/products -> /api/products), con la versión elegida por la cabecera Accept.
+// Las rutas Root (sondas y métricas) se montan directamente en el mux; su handler
+// comprueba el método, por lo que tienen una sola operación.
+func registerRoutes(mux *serveMux, routes []apiRoute) {
+	rt := newRouter()
+	api := rt.group("/api")
+	groups := make(map[string]*routeGroup)
+	groupFor := func(route apiRoute) *routeGroup {
+		key := route.Version + "|" + strconv.FormatBool(route.Auth)
+		if g, ok := groups[key]; ok {
+			return g
+		}
+		g := api
+		if route.Version != "" {
+			version, _ := findAPIVersion(route.Version)
+			g = g.group("/"+route.Version, tracedMiddleware("versionMiddleware", versionMiddleware(version)))
+		}
+		if route.Auth {
+			g = g.group("", tracedMiddleware("authMiddleware", authMiddleware))
+		}
+		groups[key] = g
+		return g
+	}
+
+	negotiated := make(map[string]bool)
+	for _, route := range routes {
+		if route.Root {
+			mux.HandleFunc(route.Pattern, route.Operations[0].Handler)
+			continue
+		}
+		g := groupFor(route)
+		for _, op := range route.Operations {
+			policy := rateLimitPolicies[op.rateLimitPolicyName(route)]
+			g.handle(op.Method, route.Pattern, rateLimitMiddleware(policy)(tracedHandler(op.Handler)))
+			if route.Version != "" && !negotiated[op.Method+" "+route.Pattern] {
+				negotiated[op.Method+" "+route.Pattern] = true
+				api.handle(op.Method, route.Pattern, versionNegotiationHandler(rt))
+			}
+		}
+	}
+	mux.Handle("/api/", rt)
+}
+
+// openAPIPath es la ruta completa en la especificación, p. ej. /api/v1/products/{id}
+func (route apiRoute) openAPIPath() string {
+	if route.Root {
+		return openAPIPattern(route.Pattern)
+	}
+	if route.Version != "" {
+		return "/api/" + route.Version + openAPIPattern(route.Pattern)
+	}
+	return "/api" + openAPIPattern(route.Pattern)
+}
+
+// --- Esquemas a partir de tipos Go ---
+
+// schemaBuilder genera esquemas JSON Schema (OpenAPI 3.1) por reflexión. Los structs
+// con nombre se registran una vez en components.schemas y se referencian con $ref.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+func (b *schemaBuilder) schemaFor(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t == reflect.TypeOf([]byte(nil)) {
+		// Archivos de los formularios multipart y cuerpos binarios (importación)
+		return map[string]interface{}{"type": "string", "format": "binary"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		inner := b.schemaFor(t.Elem())
+		if typ, ok := inner["type"].(string); ok {
+			inner["type"] = []string{typ, "null"}
+			return inner
+		}
+		return map[string]interface{}{"anyOf": []interface{}{inner, map[string]interface{}{"type": "null"}}}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schemaFor(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		name := componentName(t)
+		if _, ok := b.components[name]; !ok {
+			b.components[name] = map[string]interface{}{} // marcador para tipos recursivos
+			b.components[name] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// componentName usa el nombre del tipo Go con la inicial en mayúscula
+func componentName(t reflect.Type) string {
+	name := t.Name()
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+	b.addFields(t, properties, &required)
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addFields añade las propiedades de t; los structs embebidos sin etiqueta json se
+// aplanan, igual que hace encoding/json
+func (b *schemaBuilder) addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Tag.Get("json") == "" && field.Type.Kind() == reflect.Struct {
+			b.addFields(field.Type, properties, required)
+			continue
+		}
+		name := jsonFieldName(field)
+		if name == "" {
+			continue
+		}
+		schema := b.schemaFor(field.Type)
+		if _, isRef := schema["$ref"]; !isRef {
+			applyValidateRules(schema, field)
+		}
+		properties[name] = schema
+		if hasRule(field, "required") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// applyValidateRules traduce las etiquetas `validate` (ver validateStruct) a JSON Schema
+func applyValidateRules(schema map[string]interface{}, field reflect.StructField) {
+	tag := field.Tag.Get("validate")
+	if tag == "" {
+		return
+	}
+	isString := field.Type.Kind() == reflect.String
+	for _, rule := range strings.Split(tag, ",") {
+		rule, arg, _ := strings.Cut(rule, "=")
+		n, _ := strconv.ParseFloat(arg, 64)
+		switch rule {
+		case "readonly":
+			schema["readOnly"] = true
+		case "required":
+			if isString {
+				schema["minLength"] = 1
+			}
+		case "min":
+			if isString {
+				schema["minLength"] = int(n)
+			} else {
+				schema["minimum"] = n
+			}
+		case "max":
+			if isString {
+				schema["maxLength"] = int(n)
+			} else {
+				schema["maximum"] = n
+			}
+		case "maxbytes":
+			schema["description"] = fmt.Sprintf("Máximo %s bytes", arg)
+		case "chars":
+			switch arg {
+			case "username":
+				schema["pattern"] = "^[A-Za-z0-9._-]+$"
+			case "sku":
+				schema["pattern"] = "^[A-Za-z0-9._/-]*$"
+			}
+		}
+	}
+}
+
+// --- Documento OpenAPI ---
+
+// buildOpenAPI genera el documento OpenAPI 3.1 a partir de la tabla de rutas
+func buildOpenAPI(routes []apiRoute) map[string]interface{} {
+	b := &schemaBuilder{components: make(map[string]interface{})}
+	problemSchema := b.schemaFor(reflect.TypeOf(Problem{}))
+
+	paths := make(map[string]interface{})
+	tags := make([]map[string]string, 0)
+	seenTags := make(map[string]bool)
+	for _, route := range routes {
+		if !seenTags[route.Tag] {
+			seenTags[route.Tag] = true
+			tags = append(tags, map[string]string{"name": route.Tag})
+		}
+		path := route.openAPIPath()
+		item := make(map[string]interface{})
+		for _, op := range route.Operations {
+			item[strings.ToLower(op.Method)] = buildOperation(b, route, op, path, problemSchema)
+		}
+		paths[path] = item
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "TiendaSupported API",
+			"version": "1.0.0",
+			"description": "Documento generado a partir de la tabla de rutas del servidor. Los errores usan application/problem+json (RFC 7807). " +
+				"Las rutas /api/<versión>/... también se sirven sin versión (/api/products...), eligiendo la versión con Accept: application/vnd.tienda.<versión>+json (por defecto, la más reciente).",
+		},
+		"servers": []map[string]string{{"url": publicBaseURL}},
+		"tags":    tags,
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"cookieAuth": map[string]interface{}{
+					"type": "apiKey", "in": "cookie", "name": "session_token",
+					"description": "Sesión del navegador. Las peticiones que cambian estado deben enviar X-CSRF-Token (GET /api/auth/csrf).",
+				},
+				"bearerAuth": map[string]interface{}{
+					"type": "http", "scheme": "bearer",
+					"description": "Token de API (tsp_...) o access token JWT.",
+				},
+			},
+		},
+	}
+}
+
+func buildOperation(b *schemaBuilder, route apiRoute, op apiOperation, path string, problemSchema map[string]interface{}) map[string]interface{} {
+	operation := map[string]interface{}{
+		"tags":        []string{route.Tag},
+		"summary":     op.Summary,
+		"operationId": operationID(op.Method, path),
+	}
+
+	params := make([]interface{}, 0)
+	for _, segment := range parseRoutePattern(route.Pattern) {
+		if segment.param == "" {
+			continue
+		}
+		schema := map[string]interface{}{"type": "string"}
+		if segment.kind == "int" {
+			schema = map[string]interface{}{"type": "integer"}
+		}
+		params = append(params, map[string]interface{}{"name": segment.param, "in": "path", "required": true, "schema": schema})
+	}
+	for _, q := range op.Query {
+		name, kind, _ := strings.Cut(q, ":")
+		schema := map[string]interface{}{"type": "integer", "minimum": 1}
+		switch kind {
+		case "string":
+			schema = map[string]interface{}{"type": "string"}
+		case "boolean":
+			schema = map[string]interface{}{"type": "boolean"}
+		case "date-time":
+			schema = map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		params = append(params, map[string]interface{}{"name": name, "in": "query", "schema": schema})
+	}
+	headers := op.Headers
+	if route.Auth && !isSafeMethod(op.Method) {
+		headers = append(headers, csrfHeader)
+	}
+	for _, h := range headers {
+		params = append(params, map[string]interface{}{"name": h, "in": "header", "schema": map[string]string{"type": "string"}})
+	}
+	if len(params) > 0 {
+		operation["parameters"] = params
+	}
+
+	if op.Request != nil {
+		mediaTypes := op.MediaTypes
+		if len(mediaTypes) == 0 {
+			mediaTypes = []string{"application/json"}
+		}
+		content := make(map[string]interface{})
+		for _, mt := range mediaTypes {
+			content[mt] = map[string]interface{}{"schema": b.schemaFor(reflect.TypeOf(op.Request))}
+		}
+		operation["requestBody"] = map[string]interface{}{"required": true, "content": content}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if op.Response != nil {
+		responseType := op.ResponseType
+		if responseType == "" {
+			responseType = "application/json"
+		}
+		success["content"] = map[string]interface{}{
+			responseType: map[string]interface{}{"schema": b.schemaFor(reflect.TypeOf(op.Response))},
+		}
+	}
+	responses := map[string]interface{}{strconv.Itoa(status): success}
+
+	errs := append([]int{}, op.Errors...)
+	if route.Auth {
+		operation["security"] = []map[string][]string{{"cookieAuth": {}}, {"bearerAuth": {}}}
+		errs = append(errs, http.StatusUnauthorized)
+		if op.Permission != "" || !isSafeMethod(op.Method) {
+			errs = append(errs, http.StatusForbidden)
+		}
+	}
+	if version, ok := findAPIVersion(route.Version); ok && !version.Deprecated.IsZero() {
+		operation["deprecated"] = true
+	}
+	if op.Permission != "" {
+		operation["description"] = "Requiere el permiso `" + op.Permission + "`."
+		operation["x-permission"] = op.Permission
+	}
+	if !route.Root {
+		operation["x-rate-limit"] = op.rateLimitPolicyName(route)
+		errs = append(errs, http.StatusTooManyRequests)
+	}
+	errs = append(errs, http.StatusInternalServerError)
+	for _, code := range errs {
+		if code == http.StatusNotModified {
+			responses[strconv.Itoa(code)] = map[string]interface{}{"description": http.StatusText(code)}
+			continue
+		}
+		responses[strconv.Itoa(code)] = map[string]interface{}{
+			"description": http.StatusText(code),
+			"content": map[string]interface{}{
+				"application/problem+json": map[string]interface{}{"schema": problemSchema},
+			},
+		}
+	}
+	operation["responses"] = responses
+	return operation
+}
+
+// operationID deriva un identificador estable, p. ej. "patch_api_v1_products_id"
+func operationID(method, path string) string {
+	id := strings.NewReplacer("/", "_", "{", "", "}", "", "-", "_", ".", "_").Replace(strings.Trim(path, "/"))
+	return strings.ToLower(method) + "_" + id
+}
+
+// openAPIDocument es el documento servido en /api/openapi.json (se genera al arrancar)
+var openAPIDocument []byte
+
+// Handler que publica la especificación OpenAPI de la API
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+// setupOpenAPI genera el documento publicado a partir de la tabla de rutas. Que la
+// tabla y lo que sirve el mux coincidan lo comprueba openapi_test.go.
+func setupOpenAPI(routes []apiRoute) error {
+	doc, err := json.MarshalIndent(buildOpenAPI(routes), "", "  ")
+	if err != nil {
+		return err
+	}
+	openAPIDocument = doc
+	slog.Debug("Especificación OpenAPI generada", "routes", len(routes))
+	return nil
+}
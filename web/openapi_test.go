@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// undocumentedPatterns son los patrones del mux que quedan fuera de la especificación
+// a propósito, con el motivo
+var undocumentedPatterns = map[string]string{
+	"/":           "la SPA (index.html)",
+	"/static/":    "los archivos estáticos de la SPA",
+	"/oidc-fake/": "el proveedor OIDC de pruebas, solo con -tags oidcfake",
+}
+
+// probeMethods son los métodos con los que se sondean las rutas montadas directamente
+// en el mux, que no declaran sus métodos como el router
+var probeMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// documentedOperations devuelve las operaciones de la especificación, p. ej. "GET /api/v1/products/{id}"
+func documentedOperations(t *testing.T, routes []apiRoute) map[string]bool {
+	t.Helper()
+	if err := setupOpenAPI(routes); err != nil {
+		t.Fatalf("setupOpenAPI: %v", err)
+	}
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPIDocument, &doc); err != nil {
+		t.Fatalf("el documento OpenAPI no es JSON válido: %v", err)
+	}
+	ops := make(map[string]bool)
+	for path, item := range doc.Paths {
+		for method := range item {
+			ops[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+	return ops
+}
+
+// servedOperations recorre el mux del servidor: las rutas del router montado en /api/
+// por sus métodos registrados y el resto de patrones llamando al handler con cada
+// método. Devuelve las operaciones servidas y los patrones excluidos encontrados.
+func servedOperations(t *testing.T, mux *serveMux) (map[string]bool, []string) {
+	t.Helper()
+	served := make(map[string]bool)
+	var excluded []string
+	for _, pattern := range mux.patterns {
+		if _, ok := undocumentedPatterns[pattern]; ok {
+			excluded = append(excluded, pattern)
+			continue
+		}
+		handler, _ := mux.Handler(httptest.NewRequest(http.MethodGet, pattern, nil))
+		if rt, ok := handler.(*router); ok {
+			for _, route := range rt.routes {
+				for method := range route.handlers {
+					served[method+" "+openAPIPattern(route.pattern)] = true
+				}
+			}
+			continue
+		}
+		for _, method := range probeMethods {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(method, pattern, nil))
+			if rec.Code != http.StatusMethodNotAllowed && rec.Code != http.StatusNotFound {
+				served[method+" "+pattern] = true
+			}
+		}
+	}
+	return served, excluded
+}
+
+// TestServedRoutesDocumented comprueba que lo que sirve el mux y lo que publica
+// /api/openapi.json coinciden en ambos sentidos
+func TestServedRoutesDocumented(t *testing.T) {
+	routes := apiRouteTable()
+	documented := documentedOperations(t, routes)
+	served, excluded := servedOperations(t, newServeMux(routes))
+
+	for op := range served {
+		if documented[op] {
+			continue
+		}
+		// Las rutas sin versión (/api/products) negocian la versión con Accept
+		method, path, _ := strings.Cut(op, " ")
+		if rest, ok := strings.CutPrefix(path, "/api/"); ok && hasVersionedOperation(documented, method, "/"+rest) {
+			continue
+		}
+		t.Errorf("%s se sirve pero no está en la especificación", op)
+	}
+	for op := range documented {
+		if !served[op] {
+			t.Errorf("%s está en la especificación pero no se sirve", op)
+		}
+	}
+
+	sort.Strings(excluded)
+	if want := []string{"/", "/static/"}; strings.Join(excluded, " ") != strings.Join(want, " ") {
+		t.Errorf("patrones excluidos montados = %v, se esperaba %v", excluded, want)
+	}
+}
+
+// hasVersionedOperation indica si alguna versión documenta la operación en /api/<versión><path>
+func hasVersionedOperation(documented map[string]bool, method, path string) bool {
+	for _, v := range apiVersions {
+		if documented[method+" /api/"+v.Name+path] {
+			return true
+		}
+	}
+	return false
+}
+
+// TestServedRoutesDocumentedDetectsGaps comprueba que la comparación falla si el mux
+// sirve una ruta que la tabla no documenta
+func TestServedRoutesDocumentedDetectsGaps(t *testing.T) {
+	routes := apiRouteTable()
+	documented := documentedOperations(t, routes)
+	mux := newServeMux(routes)
+	mux.HandleFunc("/debug/vars", healthzHandler)
+
+	served, _ := servedOperations(t, mux)
+	if !served["GET /debug/vars"] || documented["GET /debug/vars"] {
+		t.Fatalf("una ruta montada fuera de la tabla debería detectarse como no documentada")
+	}
+}
+
+// TestRouteTable comprueba cada entrada de la tabla: operaciones sin duplicar, con
+// resumen, handler y una política de límite conocida
+func TestRouteTable(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, route := range apiRouteTable() {
+		path := route.openAPIPath()
+		if len(route.Operations) == 0 {
+			t.Errorf("%s: ruta sin operaciones", path)
+		}
+		if route.Root && len(route.Operations) != 1 {
+			t.Errorf("%s: una ruta de la raíz se monta con un único handler", path)
+		}
+		for _, op := range route.Operations {
+			key := op.Method + " " + path
+			if seen[key] {
+				t.Errorf("%s: operación declarada dos veces", key)
+			}
+			seen[key] = true
+			if op.Summary == "" {
+				t.Errorf("%s: falta el resumen", key)
+			}
+			if op.Handler == nil {
+				t.Errorf("%s: falta el handler", key)
+			}
+			if _, ok := rateLimitPolicies[op.rateLimitPolicyName(route)]; !ok && !route.Root {
+				t.Errorf("%s: política de límite desconocida %q", key, op.RateLimit)
+			}
+		}
+	}
+}
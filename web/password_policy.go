@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptMaxPasswordBytes es el límite de bcrypt: los bytes posteriores se ignoran en silencio
+const bcryptMaxPasswordBytes = 72
+
+// hashPassword genera el hash bcrypt de una contraseña y mide cuánto tarda
+func hashPassword(ctx context.Context, password []byte) ([]byte, error) {
+	_, span := startSpan(ctx, "bcrypt.hash")
+	defer span.end()
+	start := time.Now()
+	defer func() { bcryptDuration.observe(time.Since(start).Seconds(), "hash") }()
+	return bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+}
+
+// checkPassword compara una contraseña con su hash bcrypt y mide cuánto tarda
+func checkPassword(ctx context.Context, hash, password []byte) error {
+	_, span := startSpan(ctx, "bcrypt.compare")
+	defer span.end()
+	start := time.Now()
+	defer func() { bcryptDuration.observe(time.Since(start).Seconds(), "compare") }()
+	return bcrypt.CompareHashAndPassword(hash, password)
+}
+
+// PasswordPolicy define las reglas que debe cumplir cualquier contraseña nueva
+type PasswordPolicy struct {
+	MinLength        int  // longitud mínima en caracteres
+	MaxBytes         int  // longitud máxima en bytes (nunca mayor que bcryptMaxPasswordBytes)
+	RequireLower     bool // al menos una minúscula
+	RequireUpper     bool // al menos una mayúscula
+	RequireDigit     bool // al menos un dígito
+	RequireSymbol    bool // al menos un carácter que no sea letra ni dígito
+	DisallowUsername bool // la contraseña no puede contener el nombre de usuario
+}
+
+var (
+	// passwordPolicy es la política activa, configurable mediante variables de entorno
+	passwordPolicy = loadPasswordPolicy()
+	// breachedPasswords contiene contraseñas comunes o filtradas (en minúsculas)
+	breachedPasswords = make(map[string]struct{})
+)
+
+// loadPasswordPolicy construye la política a partir de las variables TIENDA_PASSWORD_*
+func loadPasswordPolicy() PasswordPolicy {
+	policy := PasswordPolicy{
+		MinLength:        envInt("TIENDA_PASSWORD_MIN_LENGTH", 8),
+		MaxBytes:         envInt("TIENDA_PASSWORD_MAX_BYTES", bcryptMaxPasswordBytes),
+		RequireLower:     envBool("TIENDA_PASSWORD_REQUIRE_LOWER", true),
+		RequireUpper:     envBool("TIENDA_PASSWORD_REQUIRE_UPPER", true),
+		RequireDigit:     envBool("TIENDA_PASSWORD_REQUIRE_DIGIT", true),
+		RequireSymbol:    envBool("TIENDA_PASSWORD_REQUIRE_SYMBOL", false),
+		DisallowUsername: envBool("TIENDA_PASSWORD_DISALLOW_USERNAME", true),
+	}
+	if policy.MaxBytes <= 0 || policy.MaxBytes > bcryptMaxPasswordBytes {
+		policy.MaxBytes = bcryptMaxPasswordBytes
+	}
+	return policy
+}
+
+// loadBreachedPasswords carga la lista de contraseñas prohibidas desde un archivo
+func loadBreachedPasswords(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		breachedPasswords[strings.ToLower(line)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+// Validate devuelve todas las reglas que incumple la contraseña (vacío si es válida)
+func (p PasswordPolicy) Validate(username, password string) []FieldError {
+	var violations []FieldError
+	add := func(code string, args ...interface{}) {
+		violations = append(violations, fieldError("password", code, args...))
+	}
+
+	if n := len([]rune(password)); n < p.MinLength {
+		add("password_too_short", p.MinLength)
+	}
+	if len(password) > p.MaxBytes {
+		add("password_too_long", p.MaxBytes)
+	}
+
+	var hasLower, hasUpper, hasDigit, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case !unicode.IsSpace(c):
+			hasSymbol = true
+		}
+	}
+	if p.RequireLower && !hasLower {
+		add("password_missing_lowercase")
+	}
+	if p.RequireUpper && !hasUpper {
+		add("password_missing_uppercase")
+	}
+	if p.RequireDigit && !hasDigit {
+		add("password_missing_digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		add("password_missing_symbol")
+	}
+
+	if p.DisallowUsername && strings.TrimSpace(username) != "" &&
+		strings.Contains(strings.ToLower(password), strings.ToLower(strings.TrimSpace(username))) {
+		add("password_contains_username")
+	}
+
+	if _, found := breachedPasswords[strings.ToLower(password)]; found {
+		add("password_breached")
+	}
+
+	return violations
+}
+
+// envInt lee una variable de entorno entera, usando el valor por defecto si no es válida
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(getEnv(key, strconv.Itoa(fallback)))
+	if err != nil {
+		slog.Warn("Valor de configuración inválido; se usa el predeterminado", "key", key, "fallback", fallback, "error", err)
+		return fallback
+	}
+	return value
+}
+
+// envBool lee una variable de entorno booleana, usando el valor por defecto si no es válida
+func envBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(getEnv(key, strconv.FormatBool(fallback)))
+	if err != nil {
+		slog.Warn("Valor de configuración inválido; se usa el predeterminado", "key", key, "fallback", fallback, "error", err)
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// passwordResetTTL es el tiempo de vida de un token de restablecimiento
+const passwordResetTTL = 1 * time.Hour
+
+// ResetNotifier entrega al usuario el enlace para restablecer su contraseña.
+// Permite sustituir la implementación por defecto (archivos en disco) por
+// correo, SMS, etc. sin tocar los handlers.
+type ResetNotifier interface {
+	SendPasswordReset(user models.User, resetLink string, expiresAt time.Time) error
+}
+
+// outboxNotifier escribe cada enlace en un archivo dentro de un directorio
+// local. Sirve para desarrollo y entornos sin conexión.
+type outboxNotifier struct {
+	dir string
+}
+
+func (n outboxNotifier) SendPasswordReset(user models.User, resetLink string, expiresAt time.Time) error {
+	if err := os.MkdirAll(n.dir, 0o700); err != nil {
+		return fmt.Errorf("creando directorio outbox: %w", err)
+	}
+
+	name := fmt.Sprintf("%s-password-reset-%s.txt", time.Now().UTC().Format("20060102T150405.000000000"), user.Username)
+	body := fmt.Sprintf("Para: %s\nAsunto: Restablecer contraseña\n\nHola %s,\n\nUsa el siguiente enlace para elegir una nueva contraseña:\n\n%s\n\nEl enlace caduca el %s y solo puede usarse una vez.\nSi no solicitaste el cambio, ignora este mensaje.\n",
+		user.Username, user.Username, resetLink, expiresAt.Format(time.RFC1123))
+
+	return os.WriteFile(filepath.Join(n.dir, name), []byte(body), 0o600)
+}
+
+var (
+	passwordResetTokens     = make([]models.PasswordResetToken, 0)
+	passwordResetTokenIDSeq = 1
+	// passwordResetMu protege passwordResetTokens, passwordResetTokenIDSeq y
+	// resetTokenClaims
+	passwordResetMu sync.Mutex
+	// resetTokenClaims son los tokens (por ID) que una confirmación en curso ya ha
+	// reclamado: mientras se hashea la contraseña nueva, nadie más puede usarlos
+	resetTokenClaims = make(map[int]bool)
+
+	// resetNotifier es el canal usado para enviar enlaces de restablecimiento
+	resetNotifier ResetNotifier = outboxNotifier{dir: getEnv("TIENDA_OUTBOX_DIR", "outbox")}
+	// publicBaseURL se usa para construir enlaces absolutos hacia la SPA
+	publicBaseURL = getEnv("TIENDA_PUBLIC_URL", "http://localhost:8080")
+)
+
+// newResetToken genera un token aleatorio y devuelve el valor en claro y su hash
+func newResetToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+// hashToken devuelve el hash SHA-256 en hexadecimal de un token aleatorio
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Cuerpo de la solicitud de restablecimiento
+type passwordResetRequest struct {
+	Username string `json:"username" validate:"required"`
+}
+
+// Handler para solicitar el restablecimiento de contraseña
+func passwordResetRequestHandler(w http.ResponseWriter, r *http.Request) {
+	// Configurar CORS
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	var req passwordResetRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	// La respuesta es la misma exista o no el usuario, para no revelar qué cuentas existen
+	respond := func() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Si el usuario existe, se ha enviado un enlace para restablecer la contraseña"})
+	}
+
+	var user *models.User
+	for i := range users {
+		if users[i].Username == req.Username {
+			u := users[i]
+			user = &u
+			break
+		}
+	}
+	if user == nil {
+		slog.InfoContext(r.Context(), "Solicitud de restablecimiento para usuario inexistente", "username", req.Username)
+		respond()
+		return
+	}
+	// Las cuentas OIDC no tienen contraseña local: se gestionan en el proveedor
+	if user.ExternalSubject != "" {
+		slog.InfoContext(r.Context(), "Solicitud de restablecimiento ignorada para usuario OIDC", "user_id", user.ID)
+		respond()
+		return
+	}
+
+	token, tokenHash, err := newResetToken()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error generando el token de restablecimiento", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+
+	// Solo un token vigente por usuario: las solicitudes anteriores quedan invalidadas
+	now := time.Now()
+	passwordResetMu.Lock()
+	for i := range passwordResetTokens {
+		if passwordResetTokens[i].UserID == user.ID && passwordResetTokens[i].UsedAt == nil {
+			passwordResetTokens[i].UsedAt = &now
+		}
+	}
+
+	resetToken := models.PasswordResetToken{
+		ID:        passwordResetTokenIDSeq,
+		UserID:    user.ID,
+		TokenHash: tokenHash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordResetTTL),
+	}
+	passwordResetTokenIDSeq++
+	passwordResetTokens = append(passwordResetTokens, resetToken)
+	passwordResetMu.Unlock()
+
+	// Si el envío falla se registra, pero se responde igual que a un usuario inexistente:
+	// un 500 revelaría que la cuenta existe
+	resetLink := strings.TrimRight(publicBaseURL, "/") + "/?reset_token=" + url.QueryEscape(token)
+	if err := resetNotifier.SendPasswordReset(*user, resetLink, resetToken.ExpiresAt); err != nil {
+		slog.ErrorContext(r.Context(), "Error enviando el enlace de restablecimiento", "user_id", user.ID, "error", err)
+		respond()
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Enlace de restablecimiento emitido", "user_id", user.ID)
+	respond()
+}
+
+// Cuerpo de la confirmación de restablecimiento
+type passwordResetConfirm struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+// findResetToken devuelve la posición del token con ese hash, o -1. Debe llamarse con
+// passwordResetMu tomado.
+func findResetToken(tokenHash string) int {
+	for i := range passwordResetTokens {
+		if passwordResetTokens[i].TokenHash == tokenHash {
+			return i
+		}
+	}
+	return -1
+}
+
+// claimResetToken reserva un token vigente para una confirmación y devuelve una copia.
+// Mientras esté reservado ninguna otra confirmación puede usarlo; releaseResetToken lo
+// libera si la confirmación no llega a aplicarse.
+func claimResetToken(tokenHash string, now time.Time) (models.PasswordResetToken, bool) {
+	passwordResetMu.Lock()
+	defer passwordResetMu.Unlock()
+	i := findResetToken(tokenHash)
+	if i == -1 {
+		return models.PasswordResetToken{}, false
+	}
+	t := passwordResetTokens[i]
+	if t.UsedAt != nil || !t.ExpiresAt.After(now) || resetTokenClaims[t.ID] {
+		return models.PasswordResetToken{}, false
+	}
+	resetTokenClaims[t.ID] = true
+	return t, true
+}
+
+func releaseResetToken(id int) {
+	passwordResetMu.Lock()
+	defer passwordResetMu.Unlock()
+	delete(resetTokenClaims, id)
+}
+
+// Handler para confirmar el restablecimiento con el token recibido
+func passwordResetConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	// Configurar CORS
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	var req passwordResetConfirm
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	// Reservar el token antes del hash (decenas de milisegundos): dos confirmaciones
+	// simultáneas con el mismo token no pueden tener éxito ambas
+	tokenHash := hashToken(req.Token)
+	resetToken, ok := claimResetToken(tokenHash, time.Now())
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "reset_token_invalid")
+		return
+	}
+	defer releaseResetToken(resetToken.ID)
+
+	var user *models.User
+	for i := range users {
+		if users[i].ID == resetToken.UserID {
+			u := users[i]
+			user = &u
+			break
+		}
+	}
+	if user == nil {
+		slog.ErrorContext(r.Context(), "Usuario de un token de restablecimiento no encontrado", "user_id", resetToken.UserID)
+		writeProblem(w, r, http.StatusBadRequest, "reset_token_invalid")
+		return
+	}
+
+	// Aplicar la política de contraseñas; al liberar la reserva el token sigue vigente
+	// para reintentar
+	if violations := passwordPolicy.Validate(user.Username, req.Password); len(violations) > 0 {
+		writeValidationProblem(w, r, violations...)
+		return
+	}
+
+	hashedPassword, err := hashPassword(r.Context(), []byte(req.Password))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error hasheando la contraseña", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+
+	// Marcar el token como usado y aplicar el cambio. Token y usuario se vuelven a buscar
+	// bajo los mutex: los slices pueden haberse movido durante el hash. Si entretanto se
+	// pidió otro enlace, este token ya no vale.
+	passwordResetMu.Lock()
+	i := findResetToken(tokenHash)
+	if i == -1 || passwordResetTokens[i].UsedAt != nil {
+		passwordResetMu.Unlock()
+		writeProblem(w, r, http.StatusBadRequest, "reset_token_invalid")
+		return
+	}
+	now := time.Now()
+	passwordResetTokens[i].UsedAt = &now
+	usersMu.Lock()
+	for j := range users {
+		if users[j].ID == user.ID {
+			users[j].PasswordHash = string(hashedPassword)
+			break
+		}
+	}
+	usersMu.Unlock()
+	passwordResetMu.Unlock()
+
+	// Cerrar todas las sesiones abiertas con la contraseña anterior
+	closed := deleteUserSessions(user.ID, "")
+	recordAudit(r, user, auditEvent{Action: "user.password_reset", TargetType: auditTargetUser, TargetID: strconv.Itoa(user.ID)})
+	slog.InfoContext(r.Context(), "Contraseña restablecida", "user_id", user.ID, "sessions_closed", closed)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Contraseña restablecida exitosamente"})
+}
+
+// deleteUserSessions elimina las sesiones de un usuario, salvo la indicada en except,
+// y devuelve cuántas se cerraron
+func deleteUserSessions(userID int, except models.SessionID) int {
+	kept := sessions[:0]
+	closed := 0
+	for _, s := range sessions {
+		if s.UserID == userID && s.ID != except {
+			closed++
+			continue
+		}
+		kept = append(kept, s)
+	}
+	sessions = kept
+	// En modo JWT se revocan también los refresh tokens; los access tokens ya emitidos
+	// siguen siendo válidos hasta su caducidad (TIENDA_JWT_ACCESS_TTL)
+	closed += revokeUserRefreshTokens(userID, string(except))
+	return closed
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// captureNotifier guarda el último enlace enviado, o falla con err
+type captureNotifier struct {
+	link string
+	err  error
+}
+
+func (n *captureNotifier) SendPasswordReset(user models.User, resetLink string, expiresAt time.Time) error {
+	n.link = resetLink
+	return n.err
+}
+
+// useNotifier sustituye resetNotifier y los tokens de restablecimiento durante la prueba
+func useNotifier(t *testing.T, err error) *captureNotifier {
+	t.Helper()
+	notifier := &captureNotifier{err: err}
+	previous, savedTokens := resetNotifier, passwordResetTokens
+	resetNotifier = notifier
+	t.Cleanup(func() { resetNotifier, passwordResetTokens = previous, savedTokens })
+	return notifier
+}
+
+func requestReset(t *testing.T, username string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/password-reset/request", strings.NewReader(`{"username":"`+username+`"}`))
+	passwordResetRequestHandler(rec, req)
+	return rec
+}
+
+// TestPasswordResetNotifierFailure comprueba que un fallo del envío no se distingue de
+// una solicitud para un usuario inexistente
+func TestPasswordResetNotifierFailure(t *testing.T) {
+	useNotifier(t, errors.New("smtp caído"))
+	user := addTestUser(t, "User")
+
+	missing := requestReset(t, "no-existe")
+	failed := requestReset(t, user.Username)
+	if failed.Code != http.StatusAccepted || failed.Body.String() != missing.Body.String() {
+		t.Errorf("con el envío fallido: %d %s; se esperaba lo mismo que para un usuario inexistente: %d %s",
+			failed.Code, failed.Body, missing.Code, missing.Body)
+	}
+}
+
+// TestPasswordResetConcurrentConfirm confirma a la vez con el mismo token: solo una
+// confirmación puede tener éxito. Llama a los handlers directamente, sin el limitador de
+// peticiones, para que go test -race vea la carrera.
+func TestPasswordResetConcurrentConfirm(t *testing.T) {
+	notifier := useNotifier(t, nil)
+	user := addTestUser(t, "User")
+	if rec := requestReset(t, user.Username); rec.Code != http.StatusAccepted {
+		t.Fatalf("solicitud: %d", rec.Code)
+	}
+	link, err := url.Parse(notifier.link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := link.Query().Get("reset_token")
+
+	// Una contraseña que no cumple la política no consume el token
+	rec := httptest.NewRecorder()
+	passwordResetConfirmHandler(rec, httptest.NewRequest(http.MethodPost, "/api/auth/password-reset/confirm",
+		strings.NewReader(`{"token":"`+token+`","password":"x"}`)))
+	if code := problemCode(t, rec); code != "validation_failed" {
+		t.Fatalf("contraseña débil: %d %s", rec.Code, code)
+	}
+
+	const clients = 8
+	results := make([]*httptest.ResponseRecorder, clients)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range results {
+		results[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/api/auth/password-reset/confirm",
+				strings.NewReader(`{"token":"`+token+`","password":"Otra-Clave-Segura-42"}`))
+			<-start
+			passwordResetConfirmHandler(rec, req)
+		}(results[i])
+	}
+	close(start)
+	wg.Wait()
+
+	confirmed := 0
+	for _, rec := range results {
+		switch code := problemCode(t, rec); {
+		case rec.Code == http.StatusOK:
+			confirmed++
+		case code != "reset_token_invalid":
+			t.Errorf("respuesta inesperada: %d %s", rec.Code, code)
+		}
+	}
+	if confirmed != 1 {
+		t.Fatalf("el mismo token se usó %d veces, se esperaba 1", confirmed)
+	}
+	if len(resetTokenClaims) != 0 {
+		t.Errorf("quedan tokens reservados: %v", resetTokenClaims)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	models "TiendaSupported/modules"
+)
+
+const (
+	mediaTypeMergePatch = "application/merge-patch+json" // RFC 7396
+	mediaTypeJSONPatch  = "application/json-patch+json"  // RFC 6902
+)
+
+// patchError es un error al aplicar un parche, con el estado HTTP que le corresponde
+type patchError struct {
+	status  int
+	code    string // código estable del problema (ver problemMessages)
+	message string
+	fields  []FieldError // errores de campo, si el parche toca campos de solo lectura
+}
+
+func (e *patchError) Error() string { return e.message }
+
+func patchErrorf(status int, code, format string, args ...interface{}) *patchError {
+	return &patchError{status: status, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// applyMergePatch aplica un JSON Merge Patch (RFC 7396): los miembros con null se
+// eliminan, los objetos se fusionan recursivamente y cualquier otro valor reemplaza
+func applyMergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+		} else {
+			targetObj[key] = applyMergePatch(targetObj[key], value)
+		}
+	}
+	return targetObj
+}
+
+// jsonPatchOp es una operación de un documento JSON Patch (RFC 6902)
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch aplica las operaciones en orden sobre doc. Si alguna falla se
+// devuelve el error y el llamante debe descartar el resultado (el parche es atómico).
+func applyJSONPatch(doc interface{}, ops []jsonPatchOp) (interface{}, error) {
+	for i, op := range ops {
+		if op.Path == nil {
+			return nil, patchErrorf(http.StatusBadRequest, "patch_invalid", "Operación %d: falta 'path'", i)
+		}
+		path, err := parseJSONPointer(*op.Path)
+		if err != nil {
+			return nil, patchErrorf(http.StatusBadRequest, "patch_invalid", "Operación %d: %v", i, err)
+		}
+
+		var value interface{}
+		if op.Op == "add" || op.Op == "replace" || op.Op == "test" {
+			if len(op.Value) == 0 {
+				return nil, patchErrorf(http.StatusBadRequest, "patch_invalid", "Operación %d (%s): falta 'value'", i, op.Op)
+			}
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				return nil, patchErrorf(http.StatusBadRequest, "patch_invalid", "Operación %d (%s): 'value' inválido", i, op.Op)
+			}
+		}
+		var from []string
+		if op.Op == "move" || op.Op == "copy" {
+			if op.From == nil {
+				return nil, patchErrorf(http.StatusBadRequest, "patch_invalid", "Operación %d (%s): falta 'from'", i, op.Op)
+			}
+			if from, err = parseJSONPointer(*op.From); err != nil {
+				return nil, patchErrorf(http.StatusBadRequest, "patch_invalid", "Operación %d: %v", i, err)
+			}
+		}
+
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, path, value)
+		case "remove":
+			doc, err = pointerRemove(doc, path)
+		case "replace":
+			if len(path) == 0 {
+				doc = value
+			} else if doc, err = pointerRemove(doc, path); err == nil {
+				doc, err = pointerAdd(doc, path, value)
+			}
+		case "move":
+			if isProperPrefix(from, path) {
+				return nil, patchErrorf(http.StatusBadRequest, "patch_invalid", "Operación %d (move): no se puede mover un valor dentro de sí mismo", i)
+			}
+			var moved interface{}
+			if moved, err = pointerGet(doc, from); err == nil {
+				if doc, err = pointerRemove(doc, from); err == nil {
+					doc, err = pointerAdd(doc, path, moved)
+				}
+			}
+		case "copy":
+			var copied interface{}
+			if copied, err = pointerGet(doc, from); err == nil {
+				if copied, err = deepCopyJSON(copied); err == nil {
+					doc, err = pointerAdd(doc, path, copied)
+				}
+			}
+		case "test":
+			var current interface{}
+			if current, err = pointerGet(doc, path); err == nil && !reflect.DeepEqual(current, value) {
+				return nil, patchErrorf(http.StatusConflict, "patch_test_failed", "Operación %d (test): el valor de %s no coincide", i, *op.Path)
+			}
+		default:
+			return nil, patchErrorf(http.StatusBadRequest, "patch_invalid", "Operación %d: 'op' desconocida: %q", i, op.Op)
+		}
+		if err != nil {
+			return nil, patchErrorf(http.StatusUnprocessableEntity, "patch_not_applicable", "Operación %d (%s): %v", i, op.Op, err)
+		}
+	}
+	return doc, nil
+}
+
+// parseJSONPointer divide un JSON Pointer (RFC 6901) en sus tokens ya decodificados
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("ruta inválida %q: debe empezar por '/'", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isProperPrefix(prefix, path []string) bool {
+	if len(prefix) >= len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex interpreta un token como índice de array; con allowEnd se admite
+// len (posición de inserción al final)
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("índice de array inválido %q", token)
+	}
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 {
+		return 0, fmt.Errorf("índice de array inválido %q", token)
+	}
+	if idx > length || (idx == length && !allowEnd) {
+		return 0, fmt.Errorf("índice de array fuera de rango: %d", idx)
+	}
+	return idx, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	node := doc
+	for _, token := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("la ruta no existe: %q", token)
+			}
+			node = child
+		case []interface{}:
+			idx, err := arrayIndex(token, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			node = n[idx]
+		default:
+			return nil, fmt.Errorf("la ruta no existe: %q", token)
+		}
+	}
+	return node, nil
+}
+
+// pointerUpdate recorre la ruta hasta el contenedor padre y aplica fn sobre él;
+// devuelve el documento con el contenedor actualizado (los arrays pueden reasignarse)
+func pointerUpdate(node interface{}, path []string, fn func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(node, path[0])
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("la ruta no existe: %q", path[0])
+		}
+		updated, err := pointerUpdate(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = updated
+		return n, nil
+	case []interface{}:
+		idx, err := arrayIndex(path[0], len(n), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := pointerUpdate(n[idx], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[idx] = updated
+		return n, nil
+	default:
+		return nil, fmt.Errorf("la ruta no existe: %q", path[0])
+	}
+}
+
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[key] = value
+			return p, nil
+		case []interface{}:
+			if key == "-" {
+				return append(p, value), nil
+			}
+			idx, err := arrayIndex(key, len(p), true)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[idx+1:], p[idx:])
+			p[idx] = value
+			return p, nil
+		default:
+			return nil, fmt.Errorf("el destino %q no es un objeto ni un array", key)
+		}
+	})
+}
+
+func pointerRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("no se puede eliminar el documento completo")
+	}
+	return pointerUpdate(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[key]; !ok {
+				return nil, fmt.Errorf("la ruta no existe: %q", key)
+			}
+			delete(p, key)
+			return p, nil
+		case []interface{}:
+			idx, err := arrayIndex(key, len(p), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(p[:idx], p[idx+1:]...), nil
+		default:
+			return nil, fmt.Errorf("la ruta no existe: %q", key)
+		}
+	})
+}
+
+func deepCopyJSON(v interface{}) (interface{}, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(raw, &out)
+	return out, err
+}
+
+// toJSONDocument convierte un valor Go en su representación JSON genérica
+// (map[string]interface{}, []interface{}, float64...) para poder parchearlo
+func toJSONDocument(v interface{}) (interface{}, error) {
+	return deepCopyJSON(v)
+}
+
+// fromJSONDocument decodifica el documento parcheado en out, rechazando campos desconocidos
+func fromJSONDocument(doc interface{}, out interface{}) error {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(out)
+}
+
+// readOnlyChanges compara dos documentos JSON de un struct T y devuelve un error
+// field_read_only por cada campo `readonly` cuyo valor haya cambiado
+func readOnlyChanges(t reflect.Type, before, after interface{}) []FieldError {
+	beforeObj, _ := before.(map[string]interface{})
+	afterObj, _ := after.(map[string]interface{})
+	var errs []FieldError
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := jsonFieldName(field)
+		if name == "" || !hasRule(field, "readonly") {
+			continue
+		}
+		if !reflect.DeepEqual(beforeObj[name], afterObj[name]) {
+			errs = append(errs, fieldError(name, "field_read_only"))
+		}
+	}
+	return errs
+}
+
+// patchProduct aplica al producto un parche del tipo indicado en contentType y
+// devuelve el resultado. Los campos que gestiona el servidor (id, fechas y versión)
+// no pueden modificarse: un parche que los cambie se rechaza con field_read_only.
+func patchProduct(current models.Product, contentType string, body []byte) (models.Product, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	doc, err := toJSONDocument(current)
+	if err != nil {
+		return models.Product{}, err
+	}
+	original, err := toJSONDocument(current)
+	if err != nil {
+		return models.Product{}, err
+	}
+
+	switch mediaType {
+	case mediaTypeMergePatch:
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return models.Product{}, patchErrorf(http.StatusBadRequest, "invalid_json", "JSON inválido")
+		}
+		doc = applyMergePatch(doc, patch)
+	case mediaTypeJSONPatch:
+		var ops []jsonPatchOp
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return models.Product{}, patchErrorf(http.StatusBadRequest, "patch_invalid", "Documento JSON Patch inválido: debe ser un array de operaciones")
+		}
+		if doc, err = applyJSONPatch(doc, ops); err != nil {
+			return models.Product{}, err
+		}
+	default:
+		return models.Product{}, patchErrorf(http.StatusUnsupportedMediaType, "unsupported_media_type", "Tipo de contenido no soportado para PATCH; usa %s o %s", mediaTypeMergePatch, mediaTypeJSONPatch)
+	}
+
+	if errs := readOnlyChanges(reflect.TypeOf(current), original, doc); len(errs) > 0 {
+		pe := patchErrorf(http.StatusBadRequest, "validation_failed", "")
+		pe.fields = errs
+		return models.Product{}, pe
+	}
+
+	var patched models.Product
+	if err := fromJSONDocument(doc, &patched); err != nil {
+		return models.Product{}, patchErrorf(http.StatusBadRequest, "patch_result_invalid", "El resultado del parche no es un producto válido: %v", err)
+	}
+	return patched, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	models "TiendaSupported/modules"
+)
+
+// Permisos que pueden concederse a un rol o a un token de API
+const (
+	permProductsRead   = "products:read"
+	permProductsWrite  = "products:write"
+	permProductsDelete = "products:delete"
+	permAdmin          = "admin"
+)
+
+// allPermissions es la lista de permisos conocidos, en orden de presentación
+var allPermissions = []string{permProductsRead, permProductsWrite, permProductsDelete, permAdmin}
+
+// rolePermissions define qué puede hacer cada rol
+var rolePermissions = map[string][]string{
+	"Admin":  {permProductsRead, permProductsWrite, permProductsDelete, permAdmin},
+	"Editor": {permProductsRead, permProductsWrite},
+	"User":   {permProductsRead},
+	"user":   {permProductsRead}, // rol por defecto asignado en el registro
+}
+
+// Claves de contexto para el método de autenticación y los permisos del token
+const (
+	authMethodContextKey contextKey = "authMethod"
+	scopesContextKey     contextKey = "scopes"
+)
+
+// Métodos de autenticación aceptados por authMiddleware
+const (
+	authMethodSession = "session"
+	authMethodToken   = "token"
+)
+
+// roleHasPermission indica si el rol concede el permiso
+func roleHasPermission(role, perm string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// can indica si la petición autenticada puede ejercer el permiso: el rol del usuario
+// debe concederlo y, si se autenticó con un token de API, el token también debe incluirlo
+func can(r *http.Request, user *models.User, perm string) bool {
+	if !roleHasPermission(user.Role, perm) {
+		return false
+	}
+	scopes, limited := r.Context().Value(scopesContextKey).([]string)
+	if !limited {
+		return true
+	}
+	for _, s := range scopes {
+		if s == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// authMethod devuelve cómo se autenticó la petición (sesión o token de API)
+func authMethod(r *http.Request) string {
+	method, _ := r.Context().Value(authMethodContextKey).(string)
+	return method
+}
+
+// requirePermission recupera el usuario autenticado del contexto y comprueba que la
+// petición puede ejercer el permiso. Si no, responde el problema correspondiente y
+// devuelve false. También fija el Content-Type JSON de la respuesta.
+func requirePermission(w http.ResponseWriter, r *http.Request, perm string) (*models.User, bool) {
+	w.Header().Set("Content-Type", "application/json")
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	if !ok || user == nil {
+		slog.ErrorContext(r.Context(), "Usuario no encontrado en el contexto")
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return nil, false
+	}
+	if !can(r, user, perm) {
+		writeForbidden(w, r, perm)
+		return nil, false
+	}
+	return user, true
+}
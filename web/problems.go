@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Clave de contexto para el ID de la petición
+const requestIDContextKey contextKey = "requestID"
+
+// problemTypePrefix forma el "type" de cada problema (RFC 7807) a partir de su código estable
+const problemTypePrefix = "urn:tienda:error:"
+
+// defaultLanguage es el idioma de los mensajes si Accept-Language no pide otro soportado
+const defaultLanguage = "es"
+
+// Problem es el cuerpo application/problem+json de todas las respuestas de error
+type Problem struct {
+	Type       string       `json:"type"`
+	Title      string       `json:"title"`
+	Status     int          `json:"status"`
+	Detail     string       `json:"detail,omitempty"`
+	Instance   string       `json:"instance,omitempty"`
+	Code       string       `json:"code"`
+	RequestID  string       `json:"requestId,omitempty"`
+	Permission string       `json:"permission,omitempty"` // permiso que faltaba, en los 403 por permisos
+	Errors     []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describe un error de validación de un campo concreto
+type FieldError struct {
+	Field   string        `json:"field"`
+	Code    string        `json:"code"`
+	Message string        `json:"message"`
+	Args    []interface{} `json:"-"` // argumentos del mensaje localizado
+}
+
+// fieldError crea un error de campo; el mensaje se localiza al escribir la respuesta
+func fieldError(field, code string, args ...interface{}) FieldError {
+	return FieldError{Field: field, Code: code, Args: args}
+}
+
+// problemMessages es el catálogo de mensajes por código e idioma. Los códigos son
+// estables y forman parte de la API: el cliente debe basarse en ellos, no en el texto.
+var problemMessages = map[string]map[string]string{
+	// Genéricos
+	"internal_error":          {"es": "Error interno del servidor", "en": "Internal server error"},
+	"not_found":               {"es": "Recurso no encontrado", "en": "Resource not found"},
+	"method_not_allowed":      {"es": "Método no permitido", "en": "Method not allowed"},
+	"invalid_json":            {"es": "JSON inválido", "en": "Invalid JSON"},
+	"invalid_id":              {"es": "ID inválido", "en": "Invalid ID"},
+	"validation_failed":       {"es": "Los datos enviados no son válidos", "en": "The submitted data is invalid"},
+	"forbidden":               {"es": "Acceso denegado: No tienes permisos para realizar esta acción", "en": "Access denied: You do not have permission to perform this action"},
+	"unsupported_media_type":  {"es": "Tipo de contenido no soportado", "en": "Unsupported content type"},
+	"payload_too_large":       {"es": "El cuerpo de la petición es demasiado grande", "en": "The request body is too large"},
+	"api_version_unsupported": {"es": "Versión de la API no soportada", "en": "Unsupported API version"},
+	"api_version_retired":     {"es": "Esta versión de la API ya no está disponible; usa la versión indicada en la cabecera Link", "en": "This API version has been retired; use the version in the Link header"},
+
+	// Autenticación y sesiones
+	"session_missing":         {"es": "No autorizado: Cookie de sesión no encontrada", "en": "Unauthorized: Session cookie not found"},
+	"session_invalid":         {"es": "Sesión inválida o expirada", "en": "Invalid or expired session"},
+	"session_auth_required":   {"es": "Acceso denegado: Esta operación solo puede realizarse con una sesión iniciada", "en": "Access denied: This operation requires a signed-in session"},
+	"auth_scheme_unsupported": {"es": "No autorizado: Esquema de autorización no soportado", "en": "Unauthorized: Unsupported authorization scheme"},
+	"token_invalid":           {"es": "No autorizado: Token inválido o expirado", "en": "Unauthorized: Invalid or expired token"},
+	"csrf_invalid":            {"es": "Acceso denegado: Token CSRF inválido o ausente", "en": "Access denied: Missing or invalid CSRF token"},
+	"invalid_credentials":     {"es": "Credenciales inválidas", "en": "Invalid credentials"},
+	"username_taken":          {"es": "El usuario ya existe", "en": "The username is already taken"},
+	"too_many_attempts":       {"es": "Demasiados intentos de login. Espera antes de volver a intentarlo", "en": "Too many login attempts. Please wait before trying again"},
+	"rate_limited":            {"es": "Demasiadas peticiones. Espera antes de volver a intentarlo", "en": "Too many requests. Please wait before trying again"},
+	"account_locked":          {"es": "Cuenta bloqueada temporalmente por demasiados intentos fallidos", "en": "Account temporarily locked after too many failed attempts"},
+	"lockout_not_found":       {"es": "La cuenta no tiene intentos fallidos registrados", "en": "The account has no recorded failed attempts"},
+	"current_password_wrong":  {"es": "La contraseña actual no es correcta", "en": "The current password is incorrect"},
+	"external_account":        {"es": "Esta cuenta usa el login corporativo; la contraseña se gestiona en el proveedor de identidad", "en": "This account uses corporate sign-in; its password is managed by the identity provider"},
+	"reset_token_invalid":     {"es": "Token de restablecimiento inválido o expirado", "en": "Invalid or expired reset token"},
+
+	// Modo JWT
+	"jwt_mode_disabled":     {"es": "El modo de sesión JWT no está activo", "en": "JWT session mode is not enabled"},
+	"refresh_token_missing": {"es": "No autorizado: Refresh token no encontrado", "en": "Unauthorized: Refresh token not found"},
+	"refresh_token_invalid": {"es": "No autorizado: Refresh token inválido", "en": "Unauthorized: Invalid refresh token"},
+	"refresh_token_expired": {"es": "No autorizado: Refresh token revocado o expirado", "en": "Unauthorized: Refresh token revoked or expired"},
+	"refresh_token_reused":  {"es": "No autorizado: Refresh token reutilizado; la sesión ha sido revocada", "en": "Unauthorized: Refresh token reused; the session has been revoked"},
+
+	// Verificación en dos pasos
+	"mfa_pending":                {"es": "Verificación en dos pasos pendiente", "en": "Two-step verification pending"},
+	"mfa_not_pending":            {"es": "No hay una verificación en dos pasos pendiente", "en": "There is no pending two-step verification"},
+	"mfa_enrollment_required":    {"es": "Acceso denegado: Debes activar la verificación en dos pasos", "en": "Access denied: You must enable two-step verification"},
+	"mfa_required_by_policy":     {"es": "La política de seguridad exige la verificación en dos pasos para tu rol", "en": "The security policy requires two-step verification for your role"},
+	"mfa_already_enabled":        {"es": "La verificación en dos pasos ya está activada", "en": "Two-step verification is already enabled"},
+	"mfa_not_enabled":            {"es": "La verificación en dos pasos no está activada", "en": "Two-step verification is not enabled"},
+	"mfa_enrollment_not_started": {"es": "Primero debes iniciar el alta de la verificación en dos pasos", "en": "You must start two-step verification enrollment first"},
+	"mfa_code_invalid":           {"es": "Código de verificación incorrecto", "en": "Incorrect verification code"},
+
+	// Login corporativo (OIDC)
+	"oidc_disabled":             {"es": "El login corporativo no está configurado", "en": "Corporate sign-in is not configured"},
+	"oidc_state_invalid":        {"es": "Estado OIDC inválido o expirado", "en": "Invalid or expired OIDC state"},
+	"oidc_provider_unavailable": {"es": "El proveedor de identidad no está disponible", "en": "The identity provider is unavailable"},
+	"oidc_login_rejected":       {"es": "El proveedor de identidad rechazó el inicio de sesión", "en": "The identity provider rejected the sign-in"},
+	"oidc_login_failed":         {"es": "No se pudo completar el inicio de sesión corporativo", "en": "Corporate sign-in could not be completed"},
+	"oidc_identity_invalid":     {"es": "No se pudo verificar la identidad corporativa", "en": "The corporate identity could not be verified"},
+
+	// Usuarios y roles
+	"user_not_found":          {"es": "Usuario no encontrado", "en": "User not found"},
+	"role_change_self":        {"es": "No puedes cambiar tu propio rol", "en": "You cannot change your own role"},
+	"role_change_last_admin":  {"es": "No se puede quitar el rol Admin al último administrador", "en": "The last administrator cannot lose the Admin role"},
+	"role_managed_externally": {"es": "El rol de esta cuenta lo asigna el proveedor de identidad", "en": "This account's role is assigned by the identity provider"},
+
+	// Productos y tokens
+	"product_not_found":    {"es": "Producto no encontrado", "en": "Product not found"},
+	"product_not_deleted":  {"es": "El producto no está en la papelera", "en": "The product is not in the trash"},
+	"revision_not_found":   {"es": "Revisión no encontrada", "en": "Revision not found"},
+	"sku_taken":            {"es": "Ya existe un producto con ese SKU", "en": "A product with that SKU already exists"},
+	"import_invalid":       {"es": "El archivo de importación no es válido", "en": "The import file is invalid"},
+	"import_empty":         {"es": "El archivo de importación no contiene filas", "en": "The import file contains no rows"},
+	"import_too_many_rows": {"es": "El archivo de importación tiene demasiadas filas", "en": "The import file has too many rows"},
+	"import_failed":        {"es": "La importación no se aplicó porque hay filas con errores", "en": "The import was not applied because some rows have errors"},
+	"import_job_not_found": {"es": "Importación no encontrada", "en": "Import not found"},
+	"token_not_found":      {"es": "Token no encontrado", "en": "Token not found"},
+	"if_match_required":    {"es": "Se requiere la cabecera If-Match con el ETag del producto", "en": "The If-Match header with the product ETag is required"},
+	"version_conflict":     {"es": "El producto ha sido modificado por otro usuario", "en": "The product has been modified by another user"},
+	"patch_invalid":        {"es": "Documento de parche inválido", "en": "Invalid patch document"},
+	"patch_test_failed":    {"es": "Una operación 'test' del parche no se cumple", "en": "A patch 'test' operation failed"},
+	"patch_not_applicable": {"es": "El parche no puede aplicarse al producto", "en": "The patch cannot be applied to the product"},
+	"patch_result_invalid": {"es": "El resultado del parche no es un producto válido", "en": "The patch result is not a valid product"},
+
+	// Imágenes de productos
+	"image_not_found":            {"es": "Imagen no encontrada", "en": "Image not found"},
+	"image_invalid":              {"es": "El archivo no es una imagen válida", "en": "The file is not a valid image"},
+	"image_type_unsupported":     {"es": "Formato de imagen no soportado; usa JPEG, PNG o GIF", "en": "Unsupported image format; use JPEG, PNG or GIF"},
+	"image_too_large":            {"es": "La imagen supera el tamaño máximo permitido", "en": "The image exceeds the maximum allowed size"},
+	"image_dimensions_too_large": {"es": "La imagen tiene demasiados píxeles", "en": "The image has too many pixels"},
+	"multipart_invalid":          {"es": "Formulario multipart inválido", "en": "Invalid multipart form"},
+
+	// Errores de campo genéricos (reglas `validate`)
+	"field_required":       {"es": "Este campo es obligatorio", "en": "This field is required"},
+	"field_too_short":      {"es": "Debe tener al menos %s caracteres", "en": "Must be at least %s characters long"},
+	"field_too_long":       {"es": "No puede superar los %s caracteres", "en": "Cannot exceed %s characters"},
+	"field_too_long_bytes": {"es": "No puede superar los %s bytes", "en": "Cannot exceed %s bytes"},
+	"field_too_small":      {"es": "Debe ser mayor o igual que %s", "en": "Must be greater than or equal to %s"},
+	"field_too_large":      {"es": "Debe ser menor o igual que %s", "en": "Must be less than or equal to %s"},
+	"field_invalid_chars":  {"es": "Contiene caracteres no permitidos", "en": "Contains characters that are not allowed"},
+	"field_read_only":      {"es": "Este campo lo gestiona el servidor y no puede enviarse", "en": "This field is managed by the server and cannot be sent"},
+	"field_unknown":        {"es": "Campo desconocido", "en": "Unknown field"},
+	"field_invalid_type":   {"es": "Tipo inválido: se esperaba %s", "en": "Invalid type: expected %s"},
+	"field_invalid_date":   {"es": "Fecha inválida: se esperaba el formato RFC 3339", "en": "Invalid date: expected RFC 3339 format"},
+	"field_invalid_choice": {"es": "Debe ser uno de: %s", "en": "Must be one of: %s"},
+
+	// Errores de campo específicos
+	"token_scope_not_allowed":    {"es": "Permiso no válido o no concedido a tu rol: %s", "en": "Invalid permission or not granted to your role: %s"},
+	"token_expiry_in_past":       {"es": "La fecha de caducidad debe estar en el futuro", "en": "The expiry date must be in the future"},
+	"image_single":               {"es": "Sube una sola imagen por petición", "en": "Upload a single image per request"},
+	"import_row_invalid_json":    {"es": "La línea no es un objeto JSON", "en": "The line is not a JSON object"},
+	"import_sku_repeated":        {"es": "El SKU ya aparece en la fila %d del archivo", "en": "The SKU already appears in row %d of the file"},
+	"import_sku_in_trash":        {"es": "El producto con este SKU está en la papelera; restáuralo antes de importarlo", "en": "The product with this SKU is in the trash; restore it before importing"},
+	"image_primary_required":     {"es": "Debe haber una imagen principal; marca otra como principal en su lugar", "en": "There must be a primary image; mark another one as primary instead"},
+	"password_too_short":         {"es": "La contraseña debe tener al menos %d caracteres", "en": "The password must be at least %d characters long"},
+	"password_too_long":          {"es": "La contraseña no puede superar los %d bytes", "en": "The password cannot exceed %d bytes"},
+	"password_missing_lowercase": {"es": "La contraseña debe incluir al menos una letra minúscula", "en": "The password must include at least one lowercase letter"},
+	"password_missing_uppercase": {"es": "La contraseña debe incluir al menos una letra mayúscula", "en": "The password must include at least one uppercase letter"},
+	"password_missing_digit":     {"es": "La contraseña debe incluir al menos un número", "en": "The password must include at least one digit"},
+	"password_missing_symbol":    {"es": "La contraseña debe incluir al menos un símbolo", "en": "The password must include at least one symbol"},
+	"password_contains_username": {"es": "La contraseña no puede contener el nombre de usuario", "en": "The password cannot contain the username"},
+	"password_breached":          {"es": "La contraseña es demasiado común o aparece en filtraciones conocidas", "en": "The password is too common or appears in known breaches"},
+}
+
+// negotiateLanguage elige el idioma soportado con mayor peso en Accept-Language
+func negotiateLanguage(r *http.Request) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		primary, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if primary == "" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		candidates = append(candidates, candidate{primary, q})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	for _, c := range candidates {
+		if c.q <= 0 {
+			continue
+		}
+		if _, ok := problemMessages["internal_error"][c.lang]; ok {
+			return c.lang
+		}
+	}
+	return defaultLanguage
+}
+
+// localize devuelve el mensaje del código en el idioma de la petición
+func localize(r *http.Request, code string, args ...interface{}) string {
+	messages, ok := problemMessages[code]
+	if !ok {
+		slog.ErrorContext(r.Context(), "Código de error sin mensaje en el catálogo", "code", code)
+		return code
+	}
+	message, ok := messages[negotiateLanguage(r)]
+	if !ok {
+		message = messages[defaultLanguage]
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
+
+// requestID devuelve el ID asignado a la petición por requestIDMiddleware
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// validRequestID acepta IDs entrantes cortos y sin caracteres problemáticos para logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware asigna a cada petición un ID (reutilizando X-Request-ID si el
+// cliente o un proxy lo envían), lo devuelve en la respuesta y convierte los pánicos
+// de los handlers en un problema internal_error
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id))
+
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				slog.ErrorContext(r.Context(), "Pánico atendiendo la petición", "panic", fmt.Sprint(err), "stack", string(debug.Stack()))
+				writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeProblemResponse serializa el problema con su estado y cabeceras
+func writeProblemResponse(w http.ResponseWriter, r *http.Request, p Problem) {
+	p.Type = problemTypePrefix + p.Code
+	p.Title = localize(r, p.Code)
+	p.Instance = r.URL.Path
+	p.RequestID = requestID(r)
+	for i := range p.Errors {
+		p.Errors[i].Message = localize(r, p.Errors[i].Code, p.Errors[i].Args...)
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/problem+json")
+	h.Set("Content-Language", negotiateLanguage(r))
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeProblem responde un error RFC 7807 con el código estable indicado
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code string) {
+	writeProblemResponse(w, r, Problem{Status: status, Code: code})
+}
+
+// writeProblemDetail añade un detalle específico de esta ocurrencia (no localizado)
+func writeProblemDetail(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	writeProblemResponse(w, r, Problem{Status: status, Code: code, Detail: detail})
+}
+
+// writeForbidden responde 403 indicando el permiso que faltaba
+func writeForbidden(w http.ResponseWriter, r *http.Request, permission string) {
+	writeProblemResponse(w, r, Problem{Status: http.StatusForbidden, Code: "forbidden", Permission: permission})
+}
+
+// writeValidationProblem responde 400 con los errores de cada campo
+func writeValidationProblem(w http.ResponseWriter, r *http.Request, errs ...FieldError) {
+	writeProblemResponse(w, r, Problem{Status: http.StatusBadRequest, Code: "validation_failed", Errors: errs})
+}
@@ -7,6 +7,9 @@ import { validateProduct } from '/static/js/validators.js'; // Ruta corregida y
 window.editProduct = null;
 window.deleteProduct = null;
 
+// Versión de la API de recursos que usa la SPA
+const API_BASE = '/api/v2';
+
 document.addEventListener('DOMContentLoaded', async () => {
     // Referencias a elementos del DOM
     const authSection = document.getElementById('auth-section');
@@ -17,9 +20,24 @@ document.addEventListener('DOMContentLoaded', async () => {
     const toggleLoginBtn = document.getElementById('toggle-login');
     const loginDiv = document.getElementById('login-form');
     const registerDiv = document.getElementById('register-form');
+    const forgotDiv = document.getElementById('forgot-form');
+    const resetDiv = document.getElementById('reset-form');
+    const forgotForm = document.getElementById('forgot');
+    const resetForm = document.getElementById('reset');
+    const toggleForgotBtn = document.getElementById('toggle-forgot');
+    const backToLoginLinks = document.querySelectorAll('.back-to-login');
+    const mfaDiv = document.getElementById('mfa-form');
+    const mfaForm = document.getElementById('mfa');
+    const mfaEnrollInfo = document.getElementById('mfa-enroll-info');
+    const mfaCodeLabel = document.getElementById('mfa-code-label');
+    const toggleRecoveryBtn = document.getElementById('toggle-recovery');
+    const mfaRecoveryCodes = document.getElementById('mfa-recovery-codes');
+    const mfaContinueBtn = document.getElementById('mfa-continue');
     const productsTbody = document.getElementById('products-tbody'); // Referencia a la tabla de productos
     const editModal = document.getElementById('edit-modal');
     const editForm = document.getElementById('edit-form');
+    const editGallery = document.getElementById('edit-gallery');
+    const editImageInput = document.getElementById('edit-image');
     const closeModalButtons = document.querySelectorAll('.close-modal');
     const searchInput = document.getElementById('search-input');
     const sortBySelect = document.getElementById('sort-by');
@@ -73,19 +91,94 @@ document.addEventListener('DOMContentLoaded', async () => {
         loginDiv.style.display = 'block';
     });
 
+    // Toggle hacia el formulario de recuperación de contraseña
+    toggleForgotBtn?.addEventListener('click', (e) => {
+        e.preventDefault();
+        loginDiv.style.display = 'none';
+        forgotDiv.style.display = 'block';
+    });
+
+    backToLoginLinks.forEach(link => {
+        link.addEventListener('click', (e) => {
+            e.preventDefault();
+            forgotDiv.style.display = 'none';
+            resetDiv.style.display = 'none';
+            mfaDiv.style.display = 'none';
+            loginDiv.style.display = 'block';
+        });
+    });
+
+    // Token de restablecimiento recibido en el enlace (?reset_token=...)
+    const resetToken = new URLSearchParams(window.location.search).get('reset_token');
+
     // Función para manejar errores de fetch
+    // Los errores llegan como application/problem+json: { code, title, detail, errors, requestId }
     const handleFetchError = async (response) => {
         const data = await response.json().catch(() => ({ 
-            message: response.status === 409 ? 
-                'El usuario ya existe' : 
-                'Error de respuesta del servidor.' 
+            title: 'Error de respuesta del servidor.' 
         }));
         if (!response.ok) {
-            throw new Error(data.message || `Error ${response.status}: ${response.statusText}`);
+            // Los errores de validación traen la lista de campos incumplidos en data.errors
+            const message = Array.isArray(data.errors) && data.errors.length
+                ? data.errors.map(err => `${err.field}: ${err.message}`).join('. ')
+                : data.title || `Error ${response.status}: ${response.statusText}`;
+            const error = new Error(message);
+            error.code = data.code;
+            error.requestId = data.requestId;
+            throw error;
         }
         return data;
     };
 
+    // Token CSRF de la sesión actual; cambia con cada login, así que se descarta al entrar o salir
+    let csrfToken = null;
+
+    const getCsrfToken = async () => {
+        if (!csrfToken) {
+            const response = await fetch('/api/auth/csrf', { credentials: 'include' });
+            if (response.ok) {
+                csrfToken = (await response.json()).csrfToken;
+            }
+        }
+        return csrfToken;
+    };
+
+    // fetch con cookie de sesión: las peticiones que cambian estado llevan la cabecera
+    // X-CSRF-Token; si el servidor lo rechaza (csrf_invalid) se pide uno nuevo y se repite una vez
+    const csrfFetch = async (url, options = {}) => {
+        const method = (options.method || 'GET').toUpperCase();
+        if (['GET', 'HEAD', 'OPTIONS'].includes(method)) {
+            return fetch(url, { credentials: 'include', ...options });
+        }
+        const request = async () => fetch(url, {
+            credentials: 'include',
+            ...options,
+            headers: { ...options.headers, 'X-CSRF-Token': await getCsrfToken() || '' }
+        });
+        const response = await request();
+        if (response.status !== 403) {
+            return response;
+        }
+        const problem = await response.clone().json().catch(() => ({}));
+        if (problem.code !== 'csrf_invalid') {
+            return response;
+        }
+        csrfToken = null;
+        return request();
+    };
+
+    // fetch para la API: en modo de sesión JWT el access token caduca pronto, así que ante
+    // un 401 se intenta rotar el refresh token una vez y se repite la petición
+    const apiFetch = async (url, options = {}) => {
+        const request = () => csrfFetch(url, options);
+        const response = await request();
+        if (response.status !== 401) {
+            return response;
+        }
+        const refreshed = await fetch('/api/auth/refresh', { method: 'POST', credentials: 'include' });
+        return refreshed.ok ? request() : response;
+    };
+
     // Función de confirmación personalizada (reemplaza alert/confirm)
     const confirmAction = (message) => {
         return new Promise((resolve) => {
@@ -162,13 +255,16 @@ document.addEventListener('DOMContentLoaded', async () => {
             });
 
             const userData = await handleFetchError(response); // El backend devuelve datos de usuario
-            showMessage('Inicio de sesión exitoso');
-            authSection.style.display = 'none';
-            productsSection.style.display = 'block';
             e.target.reset();
-            await loadProducts();
-            // Aquí puedes usar userData.role para mostrar/ocultar elementos si es necesario
-            console.log("Usuario logeado:", userData.username, "Rol:", userData.role);
+            csrfToken = null;
+
+            // Segundo paso: verificar el código o completar el alta obligatoria de 2FA
+            if (userData.mfaRequired || userData.mfaEnrollmentRequired) {
+                await startTwoFactor(userData.mfaEnrollmentRequired);
+                return;
+            }
+
+            await enterApp(userData);
 
         } catch (error) {
             showMessage(error.message, true);
@@ -176,24 +272,161 @@ document.addEventListener('DOMContentLoaded', async () => {
         }
     });
 
+    // Muestra la aplicación tras un login completo
+    const enterApp = async (userData) => {
+        showMessage('Inicio de sesión exitoso');
+        authSection.style.display = 'none';
+        mfaDiv.style.display = 'none';
+        productsSection.style.display = 'block';
+        await loadProducts();
+        // Aquí puedes usar userData.role para mostrar/ocultar elementos si es necesario
+        console.log("Usuario logeado:", userData.username, "Rol:", userData.role);
+    };
+
+    // Estado del segundo paso: 'verify' (código existente) o 'activate' (alta obligatoria)
+    let mfaMode = 'verify';
+    let useRecoveryCode = false;
+    let pendingUserData = null;
+
+    const startTwoFactor = async (enrollmentRequired) => {
+        mfaMode = enrollmentRequired ? 'activate' : 'verify';
+        useRecoveryCode = false;
+        mfaCodeLabel.textContent = 'Código de 6 dígitos';
+        loginDiv.style.display = 'none';
+        mfaDiv.style.display = 'block';
+        mfaForm.style.display = 'block';
+        mfaRecoveryCodes.style.display = 'none';
+        mfaEnrollInfo.style.display = 'none';
+        toggleRecoveryBtn.style.display = enrollmentRequired ? 'none' : 'inline';
+
+        if (enrollmentRequired) {
+            try {
+                const response = await csrfFetch('/api/auth/2fa/enroll', { method: 'POST' });
+                const enrollment = await handleFetchError(response);
+                document.getElementById('mfa-secret').textContent = enrollment.secret;
+                document.getElementById('mfa-uri').href = enrollment.otpauthUri;
+                mfaEnrollInfo.style.display = 'block';
+            } catch (error) {
+                showMessage(error.message, true);
+                console.error('Error iniciando alta de 2FA:', error);
+            }
+        }
+    };
+
+    toggleRecoveryBtn?.addEventListener('click', (e) => {
+        e.preventDefault();
+        useRecoveryCode = !useRecoveryCode;
+        mfaCodeLabel.textContent = useRecoveryCode ? 'Código de recuperación' : 'Código de 6 dígitos';
+        toggleRecoveryBtn.textContent = useRecoveryCode ? 'Usar el código de la app' : 'Usar un código de recuperación';
+    });
+
+    mfaForm?.addEventListener('submit', async (e) => {
+        e.preventDefault();
+        const code = new FormData(e.target).get('code');
+        const endpoint = mfaMode === 'activate' ? '/api/auth/2fa/activate' : '/api/auth/2fa/verify';
+        const body = useRecoveryCode ? { recoveryCode: code } : { code };
+
+        try {
+            const response = await csrfFetch(endpoint, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify(body)
+            });
+            const userData = await handleFetchError(response);
+            e.target.reset();
+            csrfToken = null; // la sesión parcial se sustituye por una completa
+
+            // Tras el alta se muestran los códigos de recuperación antes de entrar
+            if (mfaMode === 'activate') {
+                pendingUserData = userData;
+                document.getElementById('recovery-codes-list').textContent = userData.recoveryCodes.join('\n');
+                mfaForm.style.display = 'none';
+                mfaEnrollInfo.style.display = 'none';
+                mfaRecoveryCodes.style.display = 'block';
+                return;
+            }
+
+            await enterApp(userData);
+        } catch (error) {
+            showMessage(error.message, true);
+            console.error('Error en verificación de dos pasos:', error);
+        }
+    });
+
+    mfaContinueBtn?.addEventListener('click', async () => {
+        await enterApp(pendingUserData);
+    });
+
+    // Solicitud de enlace de restablecimiento
+    forgotForm?.addEventListener('submit', async (e) => {
+        e.preventDefault();
+        const formData = new FormData(e.target);
+
+        try {
+            const response = await fetch('/api/auth/password-reset/request', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ username: formData.get('username') })
+            });
+
+            const data = await handleFetchError(response);
+            showMessage(data.message);
+            forgotDiv.style.display = 'none';
+            loginDiv.style.display = 'block';
+            e.target.reset();
+        } catch (error) {
+            showMessage(error.message, true);
+            console.error('Error solicitando restablecimiento:', error);
+        }
+    });
+
+    // Confirmación de la nueva contraseña
+    resetForm?.addEventListener('submit', async (e) => {
+        e.preventDefault();
+        const formData = new FormData(e.target);
+
+        try {
+            const response = await fetch('/api/auth/password-reset/confirm', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({
+                    token: resetToken,
+                    password: formData.get('password')
+                })
+            });
+
+            await handleFetchError(response);
+            showMessage('Contraseña actualizada. Por favor, inicia sesión.');
+            // Quitar el token de la URL para que no se reutilice al recargar
+            window.history.replaceState({}, '', '/');
+            resetDiv.style.display = 'none';
+            loginDiv.style.display = 'block';
+            e.target.reset();
+        } catch (error) {
+            showMessage(error.message, true);
+            console.error('Error restableciendo contraseña:', error);
+        }
+    });
+
     // Eventos para productos
     logoutBtn?.addEventListener('click', async () => {
         try {
             const confirmed = await confirmAction('¿Estás seguro de que deseas cerrar sesión?');
             if (!confirmed) return;
 
-            const response = await fetch('/api/auth/logout', {
+            const response = await csrfFetch('/api/auth/logout', {
                 method: 'POST'
             });
             
             if (response.ok) {
+                csrfToken = null;
                 showMessage('Sesión cerrada exitosamente');
                 productsSection.style.display = 'none';
                 authSection.style.display = 'block';
                 loginDiv.style.display = 'block'; // Mostrar el formulario de login por defecto
             } else {
                 const errorData = await response.json();
-                showMessage(errorData.message || 'Error al cerrar sesión', true);
+                showMessage(errorData.title || 'Error al cerrar sesión', true);
             }
         } catch (error) {
             showMessage('Error de conexión al cerrar sesión', true);
@@ -237,7 +470,7 @@ document.addEventListener('DOMContentLoaded', async () => {
         }
 
         try {
-            const response = await fetch('/api/v1/products', {
+            const response = await apiFetch(`${API_BASE}/products`, {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
                 body: JSON.stringify(product)
@@ -255,15 +488,22 @@ document.addEventListener('DOMContentLoaded', async () => {
 
     async function loadProducts() {
         try {
-            const response = await fetch('/api/v1/products', {
-                credentials: 'include' // Incluir credenciales en todas las peticiones
-            });
-            allProducts = await handleFetchError(response);
+            // v2 pagina el listado: se piden páginas hasta tener todos los productos
+            const products = [];
+            for (let page = 1; ; page++) {
+                const response = await apiFetch(`${API_BASE}/products?page=${page}&limit=100`, {
+                    credentials: 'include' // Incluir credenciales en todas las peticiones
+                });
+                const data = await handleFetchError(response);
+                products.push(...data.items);
+                if (data.items.length === 0 || products.length >= data.total) break;
+            }
+            allProducts = products;
             renderProducts(filterProducts(allProducts));
         } catch (error) {
             showMessage(error.message, true);
             console.error('Error cargando productos:', error);
-            productsTbody.innerHTML = '<tr><td colspan="6" class="text-center">Error al cargar productos.</td></tr>';
+            productsTbody.innerHTML = '<tr><td colspan="7" class="text-center">Error al cargar productos.</td></tr>';
         }
     }
 
@@ -324,6 +564,9 @@ document.addEventListener('DOMContentLoaded', async () => {
         productsTbody.innerHTML = paginatedProducts.map((product, index) => `
             <tr style="animation-delay: ${index * 0.05}s">
                 <td>${product.id}</td>
+                <td class="image-column">
+                    ${product.imageUrl ? `<img src="${product.imageUrl}" alt="" class="product-thumb" loading="lazy">` : ''}
+                </td>
                 <td>${product.name}</td>
                 <td>${product.description}</td>
                 <td class="price-column">$${product.price.toFixed(2)}</td>
@@ -339,7 +582,7 @@ document.addEventListener('DOMContentLoaded', async () => {
                     </div>
                 </td>
             </tr>
-        `).join('') || '<tr><td colspan="6" class="text-center">No hay productos disponibles</td></tr>';
+        `).join('') || '<tr><td colspan="7" class="text-center">No hay productos disponibles</td></tr>';
     }
 
     // Event listeners para paginación
@@ -381,11 +624,20 @@ document.addEventListener('DOMContentLoaded', async () => {
         renderProducts(filterProducts(allProducts));
     });
 
+    // ETag del producto abierto en el modal; se envía en If-Match al guardar
+    let editingETag = null;
+
+    // Otro usuario modificó el producto: ofrecer recargar la versión actual
+    const showConflictDialog = async (message) => {
+        return confirmAction(`${message} ¿Quieres cargar la versión actual? Tus cambios sin guardar se perderán.`);
+    };
+
     // Asignar las implementaciones a las funciones globales
     window.editProduct = async (id) => {
         try {
-            const response = await fetch(`/api/v1/products/${id}`, { credentials: 'include' });
+            const response = await apiFetch(`${API_BASE}/products/${id}`, { credentials: 'include' });
             const product = await handleFetchError(response);
+            editingETag = response.headers.get('ETag');
             
             // Llenar el formulario del modal
             document.getElementById('edit-id').value = product.id;
@@ -393,6 +645,7 @@ document.addEventListener('DOMContentLoaded', async () => {
             document.getElementById('edit-description').value = product.description;
             document.getElementById('edit-price').value = product.price;
             document.getElementById('edit-stock').value = product.stock;
+            await loadGallery(product.id);
             
             // Mostrar modal
             editModal.classList.add('show');
@@ -407,11 +660,19 @@ document.addEventListener('DOMContentLoaded', async () => {
             const confirmed = await confirmAction('¿Estás seguro de que deseas eliminar este producto?');
             if (!confirmed) return;
 
-            const response = await fetch(`/api/v1/products/${id}`, {
+            // Se borra la versión que el usuario tiene en pantalla, no la que haya en el servidor
+            const product = allProducts.find(p => p.id === id);
+            const response = await apiFetch(`${API_BASE}/products/${id}`, {
                 method: 'DELETE',
+                headers: product ? { 'If-Match': `"${product.version}"` } : {},
                 credentials: 'include'
             });
 
+            if (response.status === 412) {
+                showMessage('El producto fue modificado por otro usuario; revisa los cambios antes de eliminarlo', true);
+                await loadProducts();
+                return;
+            }
             await handleFetchError(response);
             showMessage('Producto eliminado exitosamente');
             await loadProducts(); // Recargar productos después de eliminar
@@ -421,6 +682,93 @@ document.addEventListener('DOMContentLoaded', async () => {
         }
     };
 
+    // --- Galería de imágenes del producto en edición ---
+
+    // La galería cambia la imagen principal del producto y con ella su versión:
+    // se actualiza el ETag para que el guardado posterior no dé un falso conflicto
+    const refreshEditingETag = async (id) => {
+        const response = await apiFetch(`${API_BASE}/products/${id}`, { credentials: 'include' });
+        if (response.ok) {
+            editingETag = response.headers.get('ETag');
+        }
+    };
+
+    async function loadGallery(productId) {
+        editGallery.dataset.productId = productId;
+        try {
+            const response = await apiFetch(`${API_BASE}/products/${productId}/images`, { credentials: 'include' });
+            const images = await handleFetchError(response);
+            editGallery.innerHTML = images.map(image => `
+                <figure class="gallery-item ${image.primary ? 'primary' : ''}">
+                    <img src="${image.urls.small}" alt="${image.filename}" loading="lazy">
+                    <figcaption>
+                        ${image.primary
+                            ? '<span class="primary-badge">Principal</span>'
+                            : `<button type="button" class="btn btn-secondary btn-sm" data-action="primary" data-image-id="${image.id}">Principal</button>`}
+                        <button type="button" class="btn btn-danger btn-sm" data-action="delete" data-image-id="${image.id}">Eliminar</button>
+                    </figcaption>
+                </figure>
+            `).join('') || '<p class="gallery-empty">Este producto no tiene imágenes</p>';
+        } catch (error) {
+            editGallery.innerHTML = '<p class="gallery-empty">No se pudieron cargar las imágenes</p>';
+            console.error('Error cargando imágenes:', error);
+        }
+    }
+
+    editImageInput?.addEventListener('change', async () => {
+        const file = editImageInput.files[0];
+        const productId = editGallery.dataset.productId;
+        if (!file || !productId) return;
+
+        // Sin Content-Type: el navegador añade el boundary del multipart
+        const body = new FormData();
+        body.append('image', file);
+        try {
+            const response = await apiFetch(`${API_BASE}/products/${productId}/images`, {
+                method: 'POST',
+                body,
+                credentials: 'include'
+            });
+            await handleFetchError(response);
+            showMessage('Imagen subida exitosamente');
+            await Promise.all([loadGallery(productId), refreshEditingETag(productId)]);
+            await loadProducts();
+        } catch (error) {
+            showMessage(error.message, true);
+            console.error('Error subiendo imagen:', error);
+        } finally {
+            editImageInput.value = '';
+        }
+    });
+
+    editGallery?.addEventListener('click', async (e) => {
+        const button = e.target.closest('[data-action]');
+        if (!button) return;
+        const productId = editGallery.dataset.productId;
+        const url = `${API_BASE}/products/${productId}/images/${button.dataset.imageId}`;
+
+        try {
+            let response;
+            if (button.dataset.action === 'primary') {
+                response = await apiFetch(url, {
+                    method: 'PATCH',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ primary: true }),
+                    credentials: 'include'
+                });
+            } else {
+                if (!await confirmAction('¿Eliminar esta imagen?')) return;
+                response = await apiFetch(url, { method: 'DELETE', credentials: 'include' });
+            }
+            await handleFetchError(response);
+            await Promise.all([loadGallery(productId), refreshEditingETag(productId)]);
+            await loadProducts();
+        } catch (error) {
+            showMessage(error.message, true);
+            console.error('Error actualizando la galería:', error);
+        }
+    });
+
     // Cerrar modal
     closeModalButtons.forEach(button => {
         button.addEventListener('click', () => {
@@ -466,13 +814,19 @@ document.addEventListener('DOMContentLoaded', async () => {
         }
 
         try {
-            const response = await fetch(`/api/v1/products/${id}`, {
+            const response = await apiFetch(`${API_BASE}/products/${id}`, {
                 method: 'PUT',
-                headers: { 'Content-Type': 'application/json' },
+                headers: { 'Content-Type': 'application/json', 'If-Match': editingETag || '' },
                 body: JSON.stringify(updatedProduct),
                 credentials: 'include'
             });
 
+            if (response.status === 412) {
+                if (await showConflictDialog('Otro usuario ha modificado este producto mientras lo editabas.')) {
+                    await window.editProduct(id);
+                }
+                return;
+            }
             await handleFetchError(response);
             showMessage('Producto actualizado exitosamente');
             editModal.classList.remove('show');
@@ -517,4 +871,30 @@ document.addEventListener('DOMContentLoaded', async () => {
 
     // Llamar a checkSession al cargar la página
     await checkSession();
+
+    // Mostrar el botón de login corporativo si el servidor tiene OIDC configurado
+    try {
+        const oidcResponse = await fetch('/api/auth/oidc/config');
+        const oidcConfig = await oidcResponse.json();
+        const oidcButton = document.getElementById('oidc-login');
+        if (oidcConfig.enabled && oidcButton) {
+            oidcButton.href = oidcConfig.loginUrl;
+            oidcButton.style.display = 'block';
+        }
+    } catch (error) {
+        console.error('Error obteniendo configuración OIDC:', error);
+    }
+
+    // Tras el login corporativo puede quedar pendiente el segundo factor (?mfa=verify|enroll)
+    const mfaParam = new URLSearchParams(window.location.search).get('mfa');
+    if (mfaParam && authSection.style.display !== 'none') {
+        history.replaceState(null, '', window.location.pathname);
+        await startTwoFactor(mfaParam === 'enroll');
+    }
+
+    // Si se llegó desde un enlace de restablecimiento, mostrar el formulario correspondiente
+    if (resetToken && authSection.style.display !== 'none') {
+        loginDiv.style.display = 'none';
+        resetDiv.style.display = 'block';
+    }
 });
@@ -0,0 +1,370 @@
+// Visor de la especificación OpenAPI al estilo Swagger UI, sin dependencias externas.
+// Uso: <api-docs src="/api/openapi.json"></api-docs>
+class ApiDocs extends HTMLElement {
+    constructor() {
+        super();
+        this.attachShadow({ mode: 'open' });
+        this.spec = null;
+        this.error = null;
+    }
+
+    static get styles() {
+        return `
+            :host {
+                display: block;
+                font-family: 'Inter', system-ui, -apple-system, sans-serif;
+                color: var(--text-color, #4B5563);
+            }
+
+            h2 {
+                margin: 2rem 0 0.75rem;
+                font-size: 1.25rem;
+                font-weight: 600;
+            }
+
+            details {
+                background-color: var(--card-background, #FFFFFF);
+                border: 1px solid var(--border-color, #E2E8F0);
+                border-radius: 0.75rem;
+                margin-bottom: 0.5rem;
+                overflow: hidden;
+            }
+
+            summary {
+                display: flex;
+                gap: 1rem;
+                align-items: center;
+                padding: 0.75rem 1rem;
+                cursor: pointer;
+                list-style: none;
+            }
+
+            summary:hover {
+                background-color: var(--hover-background, #F1F5F9);
+            }
+
+            .method {
+                min-width: 4.5rem;
+                padding: 0.2rem 0.5rem;
+                border-radius: 0.375rem;
+                color: #FFFFFF;
+                font-size: 0.75rem;
+                font-weight: 600;
+                text-align: center;
+            }
+
+            .get { background-color: #3B82F6; }
+            .post { background-color: #10B981; }
+            .put { background-color: #F59E0B; }
+            .patch { background-color: #8B5CF6; }
+            .delete { background-color: #EF4444; }
+
+            .path {
+                font-family: monospace;
+                font-weight: 600;
+            }
+
+            .lock {
+                margin-left: auto;
+                font-size: 0.75rem;
+                color: var(--text-light, #94A3B8);
+            }
+
+            .body {
+                padding: 1rem;
+                border-top: 1px solid var(--border-color, #E2E8F0);
+            }
+
+            h3 {
+                margin: 1rem 0 0.5rem;
+                font-size: 0.875rem;
+                text-transform: uppercase;
+                letter-spacing: 0.05em;
+            }
+
+            table {
+                width: 100%;
+                border-collapse: collapse;
+                font-size: 0.875rem;
+            }
+
+            td, th {
+                text-align: left;
+                padding: 0.375rem 0.5rem;
+                border-bottom: 1px solid var(--border-color, #E2E8F0);
+            }
+
+            pre, textarea {
+                width: 100%;
+                background-color: #1E293B;
+                color: #E2E8F0;
+                border-radius: 0.5rem;
+                padding: 0.75rem;
+                font-family: monospace;
+                font-size: 0.8125rem;
+                overflow-x: auto;
+            }
+
+            textarea {
+                min-height: 8rem;
+                border: none;
+            }
+
+            input {
+                width: 100%;
+                padding: 0.25rem 0.5rem;
+                border: 1px solid var(--border-color, #E2E8F0);
+                border-radius: 0.375rem;
+            }
+
+            button {
+                margin-top: 0.75rem;
+                padding: 0.5rem 1rem;
+                border: none;
+                border-radius: 0.5rem;
+                background-color: var(--primary-color, #6366F1);
+                color: #FFFFFF;
+                cursor: pointer;
+            }
+
+            button:hover {
+                background-color: var(--primary-hover, #4F46E5);
+            }
+
+            .error {
+                color: var(--error-color, #F87171);
+            }
+        `;
+    }
+
+    async connectedCallback() {
+        try {
+            const response = await fetch(this.getAttribute('src') || '/api/openapi.json');
+            if (!response.ok) {
+                throw new Error(`HTTP ${response.status}`);
+            }
+            this.spec = await response.json();
+        } catch (error) {
+            this.error = `No se pudo cargar la especificación: ${error.message}`;
+        }
+        this.render();
+    }
+
+    // Resuelve un $ref local (#/components/schemas/...)
+    resolve(schema) {
+        if (schema && schema.$ref) {
+            return schema.$ref.replace('#/', '').split('/').reduce((node, key) => node[key], this.spec);
+        }
+        return schema || {};
+    }
+
+    // Construye un ejemplo a partir del esquema, omitiendo los campos de solo lectura
+    example(schema, depth = 0) {
+        schema = this.resolve(schema);
+        if (depth > 5) return null;
+        if (schema.anyOf) return this.example(schema.anyOf[0], depth + 1);
+        const type = Array.isArray(schema.type) ? schema.type[0] : schema.type;
+        switch (type) {
+            case 'object': {
+                const result = {};
+                Object.entries(schema.properties || {}).forEach(([name, prop]) => {
+                    if (!this.resolve(prop).readOnly) {
+                        result[name] = this.example(prop, depth + 1);
+                    }
+                });
+                return result;
+            }
+            case 'array':
+                return [this.example(schema.items, depth + 1)];
+            case 'string':
+                return schema.format === 'date-time' ? new Date().toISOString() : '';
+            case 'integer':
+            case 'number':
+                return schema.minimum || 0;
+            case 'boolean':
+                return false;
+            default:
+                return {};
+        }
+    }
+
+    schemaRows(schema) {
+        schema = this.resolve(schema);
+        if (schema.type === 'array') {
+            return this.schemaRows(schema.items);
+        }
+        const required = schema.required || [];
+        return Object.entries(schema.properties || {}).map(([name, prop]) => {
+            const resolved = this.resolve(prop);
+            const type = prop.$ref ? prop.$ref.split('/').pop() : [].concat(resolved.type || 'any').join(' | ');
+            const rules = [];
+            if (required.includes(name)) rules.push('obligatorio');
+            if (resolved.readOnly) rules.push('solo lectura');
+            if (resolved.maxLength !== undefined) rules.push(`máx. ${resolved.maxLength}`);
+            if (resolved.minimum !== undefined) rules.push(`≥ ${resolved.minimum}`);
+            if (resolved.maximum !== undefined) rules.push(`≤ ${resolved.maximum}`);
+            if (resolved.pattern) rules.push(resolved.pattern);
+            if (resolved.description) rules.push(resolved.description);
+            return `<tr><td><code>${name}</code></td><td>${type}</td><td>${rules.join(', ')}</td></tr>`;
+        }).join('');
+    }
+
+    // Campos de un formulario multipart: los binarios se eligen con un selector de archivo
+    formInputs(schema) {
+        const properties = this.resolve(schema).properties || {};
+        return `<table>${Object.entries(properties).map(([name, prop]) => `
+            <tr>
+                <td><code>${name}</code></td>
+                <td><input data-form="${name}" type="${this.resolve(prop).format === 'binary' ? 'file' : 'text'}"></td>
+            </tr>`).join('')}</table>`;
+    }
+
+    renderOperation(path, method, op, index) {
+        const params = op.parameters || [];
+        const body = op.requestBody ? Object.entries(op.requestBody.content)[0] : null;
+        const bodySchema = body ? body[1].schema : null;
+        const exampleBody = bodySchema ? JSON.stringify(this.example(bodySchema), null, 2) : '';
+        const responses = Object.entries(op.responses).map(([status, response]) => {
+            const content = response.content ? Object.values(response.content)[0] : null;
+            const ref = content && content.schema.$ref ? content.schema.$ref.split('/').pop() : '';
+            return `<tr><td>${status}</td><td>${response.description}</td><td>${ref}</td></tr>`;
+        }).join('');
+
+        return `
+            <details data-index="${index}">
+                <summary>
+                    <span class="method ${method}">${method.toUpperCase()}</span>
+                    <span class="path">${path}</span>
+                    <span>${op.summary}</span>
+                    ${op.security ? `<span class="lock">🔒 ${op['x-permission'] || 'autenticado'}</span>` : ''}
+                </summary>
+                <div class="body">
+                    ${op.description ? `<p>${op.description}</p>` : ''}
+                    ${params.length ? `
+                        <h3>Parámetros</h3>
+                        <table>
+                            ${params.map(p => `
+                                <tr>
+                                    <td><code>${p.name}</code> (${p.in})</td>
+                                    <td><input data-param="${p.name}" data-in="${p.in}" placeholder="${p.required ? 'obligatorio' : 'opcional'}"></td>
+                                </tr>`).join('')}
+                        </table>` : ''}
+                    ${body ? `
+                        <h3>Cuerpo (${body[0]})</h3>
+                        <table>${this.schemaRows(bodySchema)}</table>
+                        ${body[0] === 'multipart/form-data'
+                            ? this.formInputs(bodySchema)
+                            : `<textarea data-body data-type="${body[0]}">${exampleBody}</textarea>`}` : ''}
+                    <h3>Respuestas</h3>
+                    <table>${responses}</table>
+                    <button data-try>Probar</button>
+                    <pre data-result hidden></pre>
+                </div>
+            </details>
+        `;
+    }
+
+    render() {
+        let html = `<style>${ApiDocs.styles}</style>`;
+        if (this.error) {
+            this.shadowRoot.innerHTML = html + `<p class="error">${this.error}</p>`;
+            return;
+        }
+
+        // Agrupar las operaciones por etiqueta, en el orden de la especificación
+        this.operations = [];
+        const byTag = new Map((this.spec.tags || []).map(tag => [tag.name, []]));
+        Object.entries(this.spec.paths).forEach(([path, item]) => {
+            Object.entries(item).forEach(([method, op]) => {
+                const tag = (op.tags || ['Otros'])[0];
+                if (!byTag.has(tag)) byTag.set(tag, []);
+                this.operations.push({ path, method, op });
+                byTag.get(tag).push(this.operations.length - 1);
+            });
+        });
+
+        byTag.forEach((indexes, tag) => {
+            html += `<h2>${tag}</h2>`;
+            indexes.forEach(i => {
+                const { path, method, op } = this.operations[i];
+                html += this.renderOperation(path, method, op, i);
+            });
+        });
+
+        this.shadowRoot.innerHTML = html;
+        this.addEventListeners();
+    }
+
+    addEventListeners() {
+        this.shadowRoot.querySelectorAll('details').forEach(details => {
+            details.querySelector('[data-try]').addEventListener('click', () => this.tryOperation(details));
+        });
+    }
+
+    async tryOperation(details) {
+        const { path, method } = this.operations[parseInt(details.dataset.index)];
+        const result = details.querySelector('[data-result]');
+        const headers = {};
+        let url = path;
+
+        details.querySelectorAll('[data-param]').forEach(input => {
+            if (!input.value) return;
+            if (input.dataset.in === 'path') {
+                url = url.replace(`{${input.dataset.param}}`, encodeURIComponent(input.value));
+            } else if (input.dataset.in === 'header') {
+                headers[input.dataset.param] = input.value;
+            }
+        });
+
+        const bodyInput = details.querySelector('[data-body]');
+        const formInputs = details.querySelectorAll('[data-form]');
+        const options = { method: method.toUpperCase(), headers, credentials: 'same-origin' };
+        if (bodyInput) {
+            headers['Content-Type'] = bodyInput.dataset.type;
+            options.body = bodyInput.value;
+        } else if (formInputs.length) {
+            // Sin Content-Type: el navegador añade el boundary del multipart
+            const form = new FormData();
+            formInputs.forEach(input => {
+                if (input.type === 'file' && input.files[0]) {
+                    form.append(input.dataset.form, input.files[0]);
+                } else if (input.type !== 'file' && input.value) {
+                    form.append(input.dataset.form, input.value);
+                }
+            });
+            options.body = form;
+        }
+
+        // Con la sesión del navegador, los métodos que cambian estado necesitan el token CSRF
+        if (!['GET', 'HEAD', 'OPTIONS'].includes(options.method) && !headers['X-CSRF-Token']) {
+            const csrf = await fetch('/api/auth/csrf', { credentials: 'same-origin' });
+            if (csrf.ok) {
+                headers['X-CSRF-Token'] = (await csrf.json()).csrfToken;
+            }
+        }
+
+        try {
+            const response = await fetch(url, options);
+            const type = response.headers.get('Content-Type') || '';
+            if (type.startsWith('image/')) {
+                const blob = await response.blob();
+                result.textContent = `${response.status} ${response.statusText}\n\n(${type}, ${blob.size} bytes)`;
+                result.hidden = false;
+                return;
+            }
+            const text = await response.text();
+            let pretty = text;
+            try {
+                pretty = JSON.stringify(JSON.parse(text), null, 2);
+            } catch (e) {
+                // La respuesta no es JSON; se muestra tal cual
+            }
+            result.textContent = `${response.status} ${response.statusText}\n\n${pretty}`;
+        } catch (error) {
+            result.textContent = `Error de red: ${error.message}`;
+        }
+        result.hidden = false;
+    }
+}
+
+customElements.define('api-docs', ApiDocs);
@@ -17,7 +17,7 @@ export const debounce = (func, wait) => {
     };
 };
 
-const API_BASE_URL = '/api/v1';
+const API_BASE_URL = '/api/v2';
 
 export const api = {
     async get(endpoint) {
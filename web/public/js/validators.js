@@ -8,6 +8,10 @@ const validators = {
     minLength: (value, min) => {
         return value.toString().length >= min;
     },
+
+    maxLength: (value, max) => {
+        return [...value.toString()].length <= max;
+    },
     
     number: (value) => {
         return !isNaN(parseFloat(value)) && isFinite(value);
@@ -30,18 +34,26 @@ export const validateProduct = (product) => {
         errors.name = 'El nombre es requerido';
     } else if (!validators.minLength(product.name, 3)) {
         errors.name = 'El nombre debe tener al menos 3 caracteres';
+    } else if (!validators.maxLength(product.name, 120)) {
+        errors.name = 'El nombre no puede superar los 120 caracteres';
     }
     
     if (!validators.required(product.description)) {
         errors.description = 'La descripción es requerida';
+    } else if (!validators.maxLength(product.description, 2000)) {
+        errors.description = 'La descripción no puede superar los 2000 caracteres';
     }
     
     if (!validators.positiveNumber(product.price)) {
         errors.price = 'El precio debe ser un número positivo';
+    } else if (parseFloat(product.price) > 1000000) {
+        errors.price = 'El precio no puede superar 1.000.000';
     }
     
     if (!validators.integer(product.stock) || product.stock < 0) {
         errors.stock = 'El stock debe ser un número entero positivo';
+    } else if (product.stock > 1000000) {
+        errors.stock = 'El stock no puede superar 1.000.000';
     }
     
     return {
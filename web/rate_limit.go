@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// Limitación de peticiones con cubetas de tokens. Cada operación de la tabla de rutas
+// tiene una política (apiOperation.RateLimit); la cubeta se comparte entre todas las
+// rutas con la misma política y el mismo cliente (IP o usuario autenticado).
+//
+//	TIENDA_RATE_LIMIT_ENABLED  true (por defecto) | false
+//	TIENDA_RATE_LIMITS         ajustes por política, p. ej. "login=20/1m,api=1000/1m"
+//	TIENDA_RATE_LIMIT_BACKEND  memory (por defecto)
+//	TIENDA_TRUSTED_PROXIES     IPs o redes CIDR de los proxies cuyo X-Forwarded-For se acepta
+
+// rateLimitKey indica a quién se atribuyen las peticiones
+type rateLimitKey int
+
+const (
+	rateLimitByIP   rateLimitKey = iota
+	rateLimitByUser              // usuario autenticado; sin usuario en el contexto, la IP
+)
+
+// rateLimitPolicy permite Limit peticiones seguidas; la cubeta se rellena entera en Window
+type rateLimitPolicy struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	Key    rateLimitKey
+}
+
+// Políticas por defecto de las rutas sin RateLimit explícito
+const (
+	rateLimitPublic = "public"
+	rateLimitAPI    = "api"
+)
+
+var rateLimitPolicies = map[string]*rateLimitPolicy{
+	// Operaciones con bcrypt o que envían correo: pocas y por IP
+	"login":    {Name: "login", Limit: 10, Window: time.Minute, Key: rateLimitByIP},
+	"register": {Name: "register", Limit: 5, Window: time.Hour, Key: rateLimitByIP},
+	// Subidas de imágenes: decodificar y escalar es caro
+	"upload": {Name: "upload", Limit: 30, Window: time.Minute, Key: rateLimitByUser},
+	// Resto de rutas, sin y con autenticación
+	rateLimitPublic: {Name: rateLimitPublic, Limit: 120, Window: time.Minute, Key: rateLimitByIP},
+	rateLimitAPI:    {Name: rateLimitAPI, Limit: 600, Window: time.Minute, Key: rateLimitByUser},
+}
+
+// rateLimitResult es el estado de la cubeta tras intentar tomar un token
+type rateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	Reset      time.Duration // hasta que la cubeta vuelva a estar llena
+	RetryAfter time.Duration // hasta que haya un token (solo si !Allowed)
+}
+
+// rateLimitBackend guarda las cubetas. La implementación en memoria sirve para una
+// sola instancia; con varias réplicas haría falta un almacén compartido.
+type rateLimitBackend interface {
+	Take(key string, policy *rateLimitPolicy, now time.Time) rateLimitResult
+}
+
+var (
+	rateLimitEnabled = envBool("TIENDA_RATE_LIMIT_ENABLED", true)
+	rateLimiter      rateLimitBackend
+
+	// trustedProxies son los proxies inversos de confianza (ver clientIP)
+	trustedProxies []*net.IPNet
+)
+
+// setupRateLimiting aplica TIENDA_RATE_LIMITS y elige el backend
+func setupRateLimiting() error {
+	proxies, err := parseTrustedProxies(getEnv("TIENDA_TRUSTED_PROXIES", ""))
+	if err != nil {
+		return err
+	}
+	trustedProxies = proxies
+
+	if err := applyRateLimitOverrides(getEnv("TIENDA_RATE_LIMITS", "")); err != nil {
+		return err
+	}
+	switch kind := getEnv("TIENDA_RATE_LIMIT_BACKEND", "memory"); kind {
+	case "memory":
+		rateLimiter = newMemoryRateLimitBackend()
+	default:
+		return fmt.Errorf("TIENDA_RATE_LIMIT_BACKEND desconocido: %s (usa memory)", kind)
+	}
+	if !rateLimitEnabled {
+		slog.Warn("Limitación de peticiones desactivada (TIENDA_RATE_LIMIT_ENABLED=false)")
+	}
+	return nil
+}
+
+// applyRateLimitOverrides interpreta "nombre=límite/ventana" separados por comas
+func applyRateLimitOverrides(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		limitText, windowText, ok2 := strings.Cut(value, "/")
+		policy, known := rateLimitPolicies[strings.TrimSpace(name)]
+		if !ok || !ok2 || !known {
+			return fmt.Errorf("TIENDA_RATE_LIMITS: entrada inválida %q (usa política=límite/ventana)", item)
+		}
+		limit, err := strconv.Atoi(limitText)
+		if err != nil || limit < 1 {
+			return fmt.Errorf("TIENDA_RATE_LIMITS: límite inválido en %q", item)
+		}
+		window, err := time.ParseDuration(windowText)
+		if err != nil || window <= 0 {
+			return fmt.Errorf("TIENDA_RATE_LIMITS: ventana inválida en %q", item)
+		}
+		policy.Limit, policy.Window = limit, window
+	}
+	return nil
+}
+
+// rateLimitPolicyName devuelve la política de una operación
+func (op apiOperation) rateLimitPolicyName(route apiRoute) string {
+	switch {
+	case op.RateLimit != "":
+		return op.RateLimit
+	case route.Auth:
+		return rateLimitAPI
+	default:
+		return rateLimitPublic
+	}
+}
+
+// rateLimitMiddleware rechaza con 429 las peticiones que superan la política. Se
+// aplica dentro de authMiddleware para poder limitar por usuario.
+func rateLimitMiddleware(policy *rateLimitPolicy) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !rateLimitEnabled {
+				next(w, r)
+				return
+			}
+			subject := rateLimitSubject(r, policy)
+			res := rateLimiter.Take(policy.Name+"|"+subject, policy, time.Now())
+			setRateLimitHeaders(w, policy, res)
+			if !res.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+				rateLimitedTotal.inc(policy.Name)
+				slog.WarnContext(r.Context(), "Petición rechazada por límite de peticiones", "policy", policy.Name, "subject", subject)
+				writeProblem(w, r, http.StatusTooManyRequests, "rate_limited")
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// rateLimitSubject identifica al cliente según la política
+func rateLimitSubject(r *http.Request, policy *rateLimitPolicy) string {
+	if policy.Key == rateLimitByUser {
+		if user, ok := r.Context().Value(userContextKey).(*models.User); ok && user != nil {
+			return "user:" + strconv.Itoa(user.ID)
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// setRateLimitHeaders escribe las cabeceras RateLimit-* del borrador del IETF
+func setRateLimitHeaders(w http.ResponseWriter, policy *rateLimitPolicy, res rateLimitResult) {
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Limit, ceilSeconds(policy.Window)))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(policy.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// --- IP del cliente ---
+
+// clientIP devuelve la IP del cliente. Si la conexión llega de un proxy de confianza,
+// recorre X-Forwarded-For de derecha a izquierda (cada proxy añade al final la IP de
+// quien le habló) y devuelve la primera que no es de confianza. Sin proxies
+// configurados la cabecera se ignora: cualquiera podría falsificarla.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break // cabecera mal formada: quedarse con el último salto fiable
+		}
+		host = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies interpreta una lista de IPs o redes CIDR separadas por comas
+func parseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("TIENDA_TRUSTED_PROXIES: %v", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// --- Backend en memoria ---
+
+// rateLimitSweepInterval es cada cuánto se descartan las cubetas llenas
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	window time.Duration
+}
+
+type memoryRateLimitBackend struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newMemoryRateLimitBackend() *memoryRateLimitBackend {
+	return &memoryRateLimitBackend{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+func (b *memoryRateLimitBackend) Take(key string, policy *rateLimitPolicy, now time.Time) rateLimitResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sweep(now)
+
+	limit := float64(policy.Limit)
+	perSecond := limit / policy.Window.Seconds()
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: limit, last: now}
+		b.buckets[key] = bucket
+	}
+	bucket.window = policy.Window
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(limit, bucket.tokens+elapsed*perSecond)
+	}
+	bucket.last = now
+
+	res := rateLimitResult{Allowed: bucket.tokens >= 1}
+	if res.Allowed {
+		bucket.tokens--
+	} else {
+		res.RetryAfter = secondsToDuration((1 - bucket.tokens) / perSecond)
+	}
+	res.Remaining = int(bucket.tokens)
+	res.Reset = secondsToDuration((limit - bucket.tokens) / perSecond)
+	return res
+}
+
+// sweep descarta las cubetas que ya se habrían rellenado: equivalen a una nueva
+func (b *memoryRateLimitBackend) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	b.lastSweep = now
+	for key, bucket := range b.buckets {
+		if now.Sub(bucket.last) >= bucket.window {
+			delete(b.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	saved := trustedProxies
+	t.Cleanup(func() { trustedProxies = saved })
+
+	for _, tc := range []struct {
+		name       string
+		proxies    string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{"sin proxy", "", "203.0.113.7:4000", nil, "203.0.113.7"},
+		{"X-Forwarded-For falsificado sin proxies de confianza", "", "203.0.113.7:4000", []string{"198.51.100.9"}, "203.0.113.7"},
+		{"X-Forwarded-For desde una IP que no es proxy", "10.0.0.0/8", "203.0.113.7:4000", []string{"198.51.100.9"}, "203.0.113.7"},
+		{"un proxy de confianza", "10.0.0.1", "10.0.0.1:4000", []string{"198.51.100.9"}, "198.51.100.9"},
+		{"proxies encadenados", "10.0.0.0/8", "10.0.0.1:4000", []string{"198.51.100.9, 10.0.0.2, 10.0.0.3"}, "198.51.100.9"},
+		{"salto falsificado por el cliente", "10.0.0.0/8", "10.0.0.1:4000", []string{"6.6.6.6, 198.51.100.9, 10.0.0.2"}, "198.51.100.9"},
+		{"varias cabeceras", "10.0.0.0/8", "10.0.0.1:4000", []string{"6.6.6.6", "198.51.100.9"}, "198.51.100.9"},
+		{"salto mal formado", "10.0.0.0/8", "10.0.0.1:4000", []string{"198.51.100.9, no-es-una-ip, 10.0.0.2"}, "10.0.0.2"},
+		{"cabecera mal formada", "10.0.0.0/8", "10.0.0.1:4000", []string{"no-es-una-ip"}, "10.0.0.1"},
+		{"cabecera vacía", "10.0.0.0/8", "10.0.0.1:4000", nil, "10.0.0.1"},
+		{"todos los saltos de confianza", "10.0.0.0/8", "10.0.0.1:4000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"IPv6", "::1", "[::1]:4000", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"RemoteAddr sin puerto", "", "203.0.113.7", nil, "203.0.113.7"},
+	} {
+		proxies, err := parseTrustedProxies(tc.proxies)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		trustedProxies = proxies
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		for _, v := range tc.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("%s: clientIP = %q, se esperaba %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMemoryRateLimitTake(t *testing.T) {
+	// 3 peticiones seguidas; la cubeta recupera un token por segundo
+	policy := &rateLimitPolicy{Name: "prueba", Limit: 3, Window: 3 * time.Second}
+	backend := newMemoryRateLimitBackend()
+	start := time.Now()
+
+	for i, tc := range []struct {
+		at         time.Duration
+		key        string
+		allowed    bool
+		remaining  int
+		reset      time.Duration
+		retryAfter time.Duration
+	}{
+		{0, "a", true, 2, time.Second, 0},
+		{0, "a", true, 1, 2 * time.Second, 0},
+		{0, "a", true, 0, 3 * time.Second, 0},
+		{0, "a", false, 0, 3 * time.Second, time.Second},
+		{0, "b", true, 2, time.Second, 0}, // otra clave, otra cubeta
+		{500 * time.Millisecond, "a", false, 0, 2500 * time.Millisecond, 500 * time.Millisecond},
+		{time.Second, "a", true, 0, 3 * time.Second, 0},
+		{4 * time.Second, "a", true, 2, time.Second, 0}, // pasada la ventana, la cubeta está llena
+	} {
+		res := backend.Take(tc.key, policy, start.Add(tc.at))
+		want := rateLimitResult{Allowed: tc.allowed, Remaining: tc.remaining, Reset: tc.reset, RetryAfter: tc.retryAfter}
+		if res != want {
+			t.Errorf("paso %d (%s, +%v): %+v, se esperaba %+v", i, tc.key, tc.at, res, want)
+		}
+	}
+}
+
+func TestRateLimitMiddlewareHeaders(t *testing.T) {
+	previous, enabled := rateLimiter, rateLimitEnabled
+	rateLimiter, rateLimitEnabled = newMemoryRateLimitBackend(), true
+	t.Cleanup(func() { rateLimiter, rateLimitEnabled = previous, enabled })
+
+	policy := &rateLimitPolicy{Name: "prueba", Limit: 1, Window: time.Minute}
+	handler := rateLimitMiddleware(policy)(func(w http.ResponseWriter, r *http.Request) {})
+	send := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec
+	}
+
+	first := send()
+	if first.Code != http.StatusOK || first.Header().Get("RateLimit-Remaining") != "0" || first.Header().Get("Retry-After") != "" {
+		t.Errorf("primera petición: %d, cabeceras %v", first.Code, first.Header())
+	}
+	second := send()
+	expectProblem(t, second, http.StatusTooManyRequests, "rate_limited")
+	for header, want := range map[string]string{
+		"Retry-After":         "60",
+		"RateLimit-Limit":     "1",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Policy":    "1;w=60",
+		"RateLimit-Reset":     "60", // en segundos, redondeado hacia arriba
+	} {
+		if got := second.Header().Get(header); got != want {
+			t.Errorf("%s = %q, se esperaba %q", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// Historial de revisiones de productos. Cada cambio que incrementa Product.Version
+// guarda una copia completa del producto, de modo que cualquier versión puede
+// consultarse, compararse con otra o restaurarse. Se guarda en productRevisions,
+// protegido por catalogMu, y se descarta al purgar el producto de la papelera.
+
+// Acciones de las revisiones
+const (
+	revisionCreate   = "create"
+	revisionUpdate   = "update"
+	revisionDelete   = "delete"
+	revisionRestore  = "restore"
+	revisionImage    = "image" // cambio de la imagen principal
+	revisionRollback = "rollback"
+)
+
+var productRevisions = make([]models.ProductRevision, 0)
+
+// revisionIgnoredFields cambian en cada revisión y no aportan nada al diff
+var revisionIgnoredFields = []string{"updatedAt", "version"}
+
+// recordRevision guarda el estado actual del producto como nueva revisión, con el
+// usuario autenticado de la petición como autor. Debe llamarse con catalogMu tomado.
+func recordRevision(r *http.Request, p models.Product, action string) {
+	author, _ := r.Context().Value(userContextKey).(*models.User)
+	appendRevision(p, author, action, 0)
+}
+
+func appendRevision(p models.Product, author *models.User, action string, rollbackOf int) {
+	rev := models.ProductRevision{
+		ProductID:  p.ID,
+		Version:    p.Version,
+		Action:     action,
+		AuthorName: auditSystemActor,
+		CreatedAt:  p.UpdatedAt,
+		RollbackOf: rollbackOf,
+		Product:    p,
+	}
+	if author != nil {
+		rev.AuthorID, rev.AuthorName = author.ID, author.Username
+	}
+	productRevisions = append(productRevisions, rev)
+}
+
+// revisionsOf devuelve las revisiones de un producto de la más antigua a la más reciente
+func revisionsOf(productID int) []models.ProductRevision {
+	revs := make([]models.ProductRevision, 0)
+	for _, rev := range productRevisions {
+		if rev.ProductID == productID {
+			revs = append(revs, rev)
+		}
+	}
+	return revs
+}
+
+// deleteProductRevisions descarta el historial de un producto que se purga
+func deleteProductRevisions(productID int) {
+	kept := productRevisions[:0]
+	for _, rev := range productRevisions {
+		if rev.ProductID != productID {
+			kept = append(kept, rev)
+		}
+	}
+	productRevisions = kept
+}
+
+// revisionDiff devuelve los campos que cambian de una revisión a otra; sin from, todos
+func revisionDiff(from *models.ProductRevision, to models.ProductRevision) map[string]models.AuditChange {
+	var before interface{}
+	if from != nil {
+		before = from.Product
+	}
+	changes := auditDiff(before, to.Product)
+	for _, field := range revisionIgnoredFields {
+		delete(changes, field)
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// revisionView es una revisión con sus cambios respecto a otra (por defecto, la anterior)
+type revisionView struct {
+	models.ProductRevision
+	ComparedTo int                           `json:"comparedTo,omitempty"`
+	Changes    map[string]models.AuditChange `json:"changes,omitempty"`
+}
+
+func newRevisionView(revs []models.ProductRevision, i int, compareTo *models.ProductRevision) revisionView {
+	if compareTo == nil && i > 0 {
+		compareTo = &revs[i-1]
+	}
+	view := revisionView{ProductRevision: revs[i], Changes: revisionDiff(compareTo, revs[i])}
+	if compareTo != nil {
+		view.ComparedTo = compareTo.Version
+	}
+	return view
+}
+
+// revisionPage es la respuesta paginada de GET /products/{id}/revisions
+type revisionPage struct {
+	Items []revisionView `json:"items"`
+	Page  int            `json:"page"`
+	Limit int            `json:"limit"`
+	Total int            `json:"total"`
+}
+
+// revisionIndex busca la versión en el historial; si no existe responde 404 y devuelve -1
+func revisionIndex(w http.ResponseWriter, r *http.Request, revs []models.ProductRevision, version int) int {
+	for i, rev := range revs {
+		if rev.Version == version {
+			return i
+		}
+	}
+	writeProblem(w, r, http.StatusNotFound, "revision_not_found")
+	return -1
+}
+
+// Handler de GET /products/{id}/revisions: historial, de la revisión más reciente a la más antigua
+func listProductRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsRead); !ok {
+		return
+	}
+	page, limit, errs := parsePagination(r)
+	if len(errs) > 0 {
+		writeValidationProblem(w, r, errs...)
+		return
+	}
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	productIndex := productIndexFromPath(w, r)
+	if productIndex == -1 {
+		return
+	}
+
+	revs := revisionsOf(products[productIndex].ID)
+	views := make([]revisionView, 0, len(revs))
+	for i := len(revs) - 1; i >= 0; i-- {
+		views = append(views, newRevisionView(revs, i, nil))
+	}
+	json.NewEncoder(w).Encode(revisionPage{Items: paginate(views, page, limit), Page: page, Limit: limit, Total: len(views)})
+}
+
+// Handler de GET /products/{id}/revisions/{version}: una revisión completa y sus
+// cambios respecto a la anterior o a la indicada en ?compare=
+func getProductRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsRead); !ok {
+		return
+	}
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	productIndex := productIndexFromPath(w, r)
+	if productIndex == -1 {
+		return
+	}
+	revs := revisionsOf(products[productIndex].ID)
+	i := revisionIndex(w, r, revs, pathInt(r, "version"))
+	if i == -1 {
+		return
+	}
+
+	var compareTo *models.ProductRevision
+	if value := r.URL.Query().Get("compare"); value != "" {
+		version, err := strconv.Atoi(value)
+		if err != nil || version < 1 {
+			writeValidationProblem(w, r, fieldError("compare", "field_too_small", "1"))
+			return
+		}
+		j := revisionIndex(w, r, revs, version)
+		if j == -1 {
+			return
+		}
+		compareTo = &revs[j]
+	}
+	json.NewEncoder(w).Encode(newRevisionView(revs, i, compareTo))
+}
+
+// Handler de POST /products/{id}/revisions/{version}/rollback: devuelve los campos
+// editables del producto a los de esa revisión. Es un cambio más: exige If-Match,
+// incrementa la versión y queda como una nueva revisión.
+func rollbackProductHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requirePermission(w, r, permProductsWrite)
+	if !ok {
+		return
+	}
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	productIndex := productIndexFromPath(w, r)
+	if productIndex == -1 {
+		return
+	}
+	if !checkIfMatch(w, r, products[productIndex]) {
+		return
+	}
+	revs := revisionsOf(products[productIndex].ID)
+	i := revisionIndex(w, r, revs, pathInt(r, "version"))
+	if i == -1 {
+		return
+	}
+
+	// Solo se restauran los campos que el cliente puede editar; la imagen principal
+	// depende de la galería actual
+	before := products[productIndex]
+	restored := before
+	target := revs[i].Product
+	restored.SKU, restored.Name, restored.Description, restored.Price, restored.Stock = target.SKU, target.Name, target.Description, target.Price, target.Stock
+	if errs := validateStruct(&restored); len(errs) > 0 {
+		writeValidationProblem(w, r, errs...)
+		return
+	}
+	if skuTaken(restored) {
+		writeProblem(w, r, http.StatusConflict, "sku_taken")
+		return
+	}
+	restored.UpdatedAt = time.Now()
+	restored.Version++
+
+	products[productIndex] = restored
+	appendRevision(restored, user, revisionRollback, target.Version)
+	recordAudit(r, user, auditEvent{Action: "product.rollback", TargetType: auditTargetProduct, TargetID: strconv.Itoa(restored.ID), Before: before, After: restored})
+	slog.InfoContext(r.Context(), "Producto restaurado a una revisión anterior", "product_id", restored.ID, "revision", target.Version, "version", restored.Version)
+
+	w.Header().Set("ETag", productETag(restored))
+	json.NewEncoder(w).Encode(restored)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Clave de contexto para los parámetros de ruta ({id}, {imageId}...)
+const pathParamsContextKey contextKey = "pathParams"
+
+// middleware envuelve un handler (authMiddleware, versionMiddleware...)
+type middleware func(http.HandlerFunc) http.HandlerFunc
+
+// router despacha las peticiones por ruta y método. Las rutas se declaran con
+// segmentos fijos y parámetros tipados, p. ej. /products/{id:int}/images/{imageId:int}.
+// Si la ruta existe pero no para ese método responde 405 con la cabecera Allow, las
+// peticiones OPTIONS (preflight de CORS) se contestan automáticamente y una barra
+// final se normaliza redirigiendo a la ruta sin ella.
+type router struct {
+	routes []*routerRoute
+}
+
+type routerRoute struct {
+	pattern  string
+	segments []routeSegment
+	handlers map[string]http.HandlerFunc // por método
+}
+
+// routeSegment es un tramo de la ruta: un literal o un parámetro con su tipo
+type routeSegment struct {
+	literal string
+	param   string
+	kind    string // "int" o "string"
+}
+
+// serveMux es el mux raíz del servidor. Recuerda los patrones montados para que las
+// pruebas puedan recorrer lo que se sirve y compararlo con la especificación OpenAPI.
+type serveMux struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func (m *serveMux) Handle(pattern string, handler http.Handler) {
+	m.patterns = append(m.patterns, pattern)
+	m.ServeMux.Handle(pattern, handler)
+}
+
+func (m *serveMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.Handle(pattern, http.HandlerFunc(handler))
+}
+
+func newRouter() *router {
+	return &router{}
+}
+
+func parseRoutePattern(pattern string) []routeSegment {
+	parts := strings.Split(strings.Trim(pattern, "/"), "/")
+	segments := make([]routeSegment, 0, len(parts))
+	for _, part := range parts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			name, kind, found := strings.Cut(part[1:len(part)-1], ":")
+			if !found {
+				kind = "string"
+			}
+			if kind != "int" && kind != "string" {
+				panic("tipo de parámetro de ruta desconocido en " + pattern + ": " + kind)
+			}
+			segments = append(segments, routeSegment{param: name, kind: kind})
+		} else {
+			segments = append(segments, routeSegment{literal: part})
+		}
+	}
+	return segments
+}
+
+// openAPIPattern quita los tipos de los parámetros: /products/{id:int} -> /products/{id}
+func openAPIPattern(pattern string) string {
+	segments := parseRoutePattern(pattern)
+	parts := make([]string, len(segments))
+	for i, s := range segments {
+		if s.param != "" {
+			parts[i] = "{" + s.param + "}"
+		} else {
+			parts[i] = s.literal
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// handle registra el handler de un método; una misma ruta puede tener varios métodos
+func (rt *router) handle(method, pattern string, handler http.HandlerFunc) {
+	for _, route := range rt.routes {
+		if route.pattern == pattern {
+			if _, exists := route.handlers[method]; exists {
+				panic("ruta registrada dos veces: " + method + " " + pattern)
+			}
+			route.handlers[method] = handler
+			return
+		}
+	}
+	rt.routes = append(rt.routes, &routerRoute{
+		pattern:  pattern,
+		segments: parseRoutePattern(pattern),
+		handlers: map[string]http.HandlerFunc{method: handler},
+	})
+}
+
+// match compara la ruta con un patrón. Devuelve los parámetros y, si un parámetro
+// no tiene el tipo esperado, el nombre de ese parámetro en badParam.
+func (route *routerRoute) match(parts []string) (params map[string]string, badParam string, ok bool) {
+	if len(parts) != len(route.segments) {
+		return nil, "", false
+	}
+	params = make(map[string]string)
+	for i, s := range route.segments {
+		if s.param == "" {
+			if s.literal != parts[i] {
+				return nil, "", false
+			}
+			continue
+		}
+		if s.kind == "int" {
+			if _, ok := parsePathInt(parts[i]); !ok && badParam == "" {
+				badParam = s.param
+			}
+		}
+		params[s.param] = parts[i]
+	}
+	return params, badParam, true
+}
+
+// staticCount ordena las coincidencias: gana la ruta con más segmentos literales
+func (route *routerRoute) staticCount() int {
+	n := 0
+	for _, s := range route.segments {
+		if s.param == "" {
+			n++
+		}
+	}
+	return n
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if len(path) > 1 && strings.HasSuffix(path, "/") {
+		target := strings.TrimRight(path, "/")
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		// 308 conserva el método y el cuerpo, a diferencia de 301
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	var best *routerRoute
+	var bestParams map[string]string
+	var bestBad string
+	for _, route := range rt.routes {
+		params, bad, ok := route.match(parts)
+		if ok && (best == nil || route.staticCount() > best.staticCount()) {
+			best, bestParams, bestBad = route, params, bad
+		}
+	}
+	if best == nil {
+		writeProblem(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+
+	if info := logInfo(r); info != nil {
+		info.route = best.pattern
+	}
+	allow := best.allowedMethods()
+	if r.Method == http.MethodOptions {
+		if _, ok := best.handlers[http.MethodOptions]; !ok {
+			writePreflight(w, allow)
+			return
+		}
+	}
+	handler, ok := best.handlers[r.Method]
+	if !ok && r.Method == http.MethodHead {
+		handler, ok = best.handlers[http.MethodGet]
+	}
+	if !ok {
+		w.Header().Set("Allow", allow)
+		writeProblem(w, r, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	if bestBad != "" {
+		writeProblemDetail(w, r, http.StatusBadRequest, "invalid_id", bestBad+": se esperaba un número entero")
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), pathParamsContextKey, bestParams)
+	handler(w, r.WithContext(ctx))
+}
+
+func (route *routerRoute) allowedMethods() string {
+	methods := []string{http.MethodOptions}
+	for method := range route.handlers {
+		methods = append(methods, method)
+	}
+	if _, ok := route.handlers[http.MethodGet]; ok {
+		methods = append(methods, http.MethodHead)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// writePreflight responde un preflight de CORS con los métodos de la ruta
+func writePreflight(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Allow-Methods", allow)
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-CSRF-Token, X-Request-ID, If-Match, If-None-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Request-ID, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Grupos de rutas ---
+
+// routeGroup registra rutas bajo un prefijo común y con los mismos middlewares
+type routeGroup struct {
+	router     *router
+	prefix     string
+	middleware []middleware
+}
+
+// group crea un grupo de rutas en la raíz del router
+func (rt *router) group(prefix string, mw ...middleware) *routeGroup {
+	return &routeGroup{router: rt, prefix: prefix, middleware: mw}
+}
+
+// group crea un subgrupo que hereda el prefijo y los middlewares del grupo
+func (g *routeGroup) group(prefix string, mw ...middleware) *routeGroup {
+	return &routeGroup{
+		router:     g.router,
+		prefix:     g.prefix + prefix,
+		middleware: append(append([]middleware{}, g.middleware...), mw...),
+	}
+}
+
+// handle registra el handler envuelto en los middlewares del grupo; el primero
+// declarado es el más externo
+func (g *routeGroup) handle(method, pattern string, handler http.HandlerFunc) {
+	for i := len(g.middleware) - 1; i >= 0; i-- {
+		handler = g.middleware[i](handler)
+	}
+	g.router.handle(method, g.prefix+pattern, handler)
+}
+
+// --- Parámetros de ruta ---
+
+// pathParam devuelve el parámetro de ruta con ese nombre ("" si no existe)
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsContextKey).(map[string]string)
+	return params[name]
+}
+
+// pathInt devuelve un parámetro de ruta declarado como {name:int}; el router ya ha
+// comprobado que es un entero
+func pathInt(r *http.Request, name string) int {
+	n, _ := parsePathInt(pathParam(r, name))
+	return n
+}
+
+// parsePathInt interpreta un parámetro {name:int}: solo dígitos, sin signo ni espacios
+// (strconv.Atoi aceptaría "+5" y "-1")
+func parsePathInt(s string) (int, bool) {
+	if s == "" {
+		return 0, false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
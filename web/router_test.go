@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRouterIntParams(t *testing.T) {
+	rt := newRouter()
+	rt.handle(http.MethodGet, "/products/{id:int}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(pathInt(r, "id"))))
+	})
+
+	for _, tc := range []struct {
+		id     string
+		status int
+		body   string
+	}{
+		{"5", http.StatusOK, "5"},
+		{"007", http.StatusOK, "7"},
+		{"+5", http.StatusBadRequest, ""},
+		{"-1", http.StatusBadRequest, ""},
+		{"1e3", http.StatusBadRequest, ""},
+		{"abc", http.StatusBadRequest, ""},
+		{"99999999999999999999", http.StatusBadRequest, ""}, // no cabe en un int
+	} {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/products/"+tc.id, nil))
+		if rec.Code != tc.status || (tc.body != "" && rec.Body.String() != tc.body) {
+			t.Errorf("/products/%s: %d %s, se esperaba %d %s", tc.id, rec.Code, rec.Body, tc.status, tc.body)
+		}
+		if tc.status == http.StatusBadRequest {
+			expectProblem(t, rec, http.StatusBadRequest, "invalid_id")
+		}
+	}
+}
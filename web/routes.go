@@ -0,0 +1,266 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// Formas de las respuestas que los handlers construyen con mapas; solo se usan para
+// generar la especificación OpenAPI
+type (
+	messageResponse struct {
+		Message string `json:"message"`
+	}
+	// sessionResponse es la respuesta de login, 2FA y check-session: datos del usuario
+	// y, en modo JWT, los tokens emitidos
+	sessionResponse struct {
+		Message               string `json:"message"`
+		ID                    int    `json:"id,omitempty"`
+		Username              string `json:"username,omitempty"`
+		Role                  string `json:"role,omitempty"`
+		MFARequired           bool   `json:"mfaRequired,omitempty"`
+		MFAEnrollmentRequired bool   `json:"mfaEnrollmentRequired,omitempty"`
+		jwtTokensResponse
+	}
+	jwtTokensResponse struct {
+		Token        string `json:"token,omitempty"`
+		TokenType    string `json:"tokenType,omitempty"`
+		ExpiresIn    int    `json:"expiresIn,omitempty"`
+		RefreshToken string `json:"refreshToken,omitempty"`
+	}
+	totpEnrollResponse struct {
+		Secret     string `json:"secret"`
+		OtpauthURI string `json:"otpauthUri"`
+		Digits     int    `json:"digits"`
+		Period     int    `json:"period"`
+	}
+	totpActivateResponse struct {
+		sessionResponse
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	csrfResponse struct {
+		CSRFToken string `json:"csrfToken"`
+	}
+	oidcConfigResponse struct {
+		Enabled  bool   `json:"enabled"`
+		LoginURL string `json:"loginUrl"`
+	}
+	jwksResponse struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	jwtRotateResponse struct {
+		Kid       string    `json:"kid"`
+		Alg       string    `json:"alg"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+	probeResponse struct {
+		Status string `json:"status"`
+	}
+	readinessResponse struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+)
+
+// apiRouteTable es la tabla de rutas de la API. Es la única fuente de verdad: de ella
+// salen tanto el registro en el router como la especificación OpenAPI. Los patrones
+// son relativos a /api; las rutas de autenticación no tienen versión y los recursos
+// se publican en /api/v1 y /api/v2. Al final van las rutas de la raíz del servidor.
+func apiRouteTable() []apiRoute {
+	v1 := v1Routes()
+	routes := []apiRoute{
+		// Autenticación
+		{Pattern: "/auth/register", Tag: "Autenticación", Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Registrar un usuario", Handler: registerHandler, Request: models.Credentials{}, Response: messageResponse{}, Status: http.StatusCreated, Errors: []int{400, 409, 413}, RateLimit: "register"},
+		}},
+		{Pattern: "/auth/login", Tag: "Autenticación", Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Iniciar sesión", Handler: loginHandler, Request: models.Credentials{}, Response: sessionResponse{}, Errors: []int{400, 401, 413, 429}, RateLimit: "login"},
+		}},
+		{Pattern: "/auth/logout", Tag: "Autenticación", Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Cerrar sesión", Handler: logoutHandler, Response: messageResponse{}, Headers: []string{csrfHeader}, Errors: []int{403}},
+		}},
+		{Pattern: "/auth/check-session", Tag: "Autenticación", Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Comprobar la sesión actual", Handler: checkSessionHandler, Response: sessionResponse{}, Errors: []int{401}},
+		}},
+		{Pattern: "/auth/csrf", Tag: "Autenticación", Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Obtener el token CSRF de la sesión", Handler: csrfTokenHandler, Response: csrfResponse{}, Errors: []int{401}},
+		}},
+		{Pattern: "/auth/password-reset/request", Tag: "Autenticación", Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Solicitar el restablecimiento de contraseña", Handler: passwordResetRequestHandler, Request: passwordResetRequest{}, Response: messageResponse{}, Status: http.StatusAccepted, Errors: []int{400, 413}, RateLimit: "login"},
+		}},
+		{Pattern: "/auth/password-reset/confirm", Tag: "Autenticación", Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Confirmar el restablecimiento de contraseña", Handler: passwordResetConfirmHandler, Request: passwordResetConfirm{}, Response: messageResponse{}, Errors: []int{400, 413}, RateLimit: "login"},
+		}},
+		{Pattern: "/auth/change-password", Tag: "Autenticación", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Cambiar la contraseña", Handler: changePasswordHandler, Request: changePasswordRequest{}, Response: messageResponse{}, Errors: []int{400, 413}},
+		}},
+		{Pattern: "/auth/refresh", Tag: "Autenticación", Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Rotar el refresh token (modo JWT)", Handler: refreshHandler, Request: refreshRequest{}, Response: jwtTokensResponse{}, Errors: []int{401, 404}},
+		}},
+		{Pattern: "/auth/jwks.json", Tag: "Autenticación", Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Claves públicas de firma JWT", Handler: jwksHandler, Response: jwksResponse{}, Errors: []int{404}},
+		}},
+
+		// Verificación en dos pasos
+		{Pattern: "/auth/2fa/enroll", Tag: "Verificación en dos pasos", Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Iniciar el alta de TOTP", Handler: twoFactorEnrollHandler, Response: totpEnrollResponse{}, Headers: []string{csrfHeader}, Errors: []int{401, 403, 409}},
+		}},
+		{Pattern: "/auth/2fa/activate", Tag: "Verificación en dos pasos", Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Activar TOTP con el primer código", Handler: twoFactorActivateHandler, Request: totpActivateRequest{}, Response: totpActivateResponse{}, Headers: []string{csrfHeader}, Errors: []int{400, 401, 403}},
+		}},
+		{Pattern: "/auth/2fa/verify", Tag: "Verificación en dos pasos", Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Completar el login con el segundo factor", Handler: twoFactorVerifyHandler, Request: totpCodeRequest{}, Response: sessionResponse{}, Headers: []string{csrfHeader}, Errors: []int{400, 401, 403, 429}, RateLimit: "login"},
+		}},
+		{Pattern: "/auth/2fa/disable", Tag: "Verificación en dos pasos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Desactivar TOTP", Handler: twoFactorDisableHandler, Request: totpCodeRequest{}, Response: messageResponse{}, Errors: []int{400}},
+		}},
+
+		// Login corporativo (OIDC)
+		{Pattern: "/auth/oidc/config", Tag: "Login corporativo", Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Consultar si el login corporativo está activo", Handler: oidcConfigHandler, Response: oidcConfigResponse{}},
+		}},
+		{Pattern: "/auth/oidc/login", Tag: "Login corporativo", Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Iniciar el login OIDC (redirige al proveedor)", Handler: oidcLoginHandler, Status: http.StatusFound, Errors: []int{404, 502}},
+		}},
+		{Pattern: "/auth/oidc/callback", Tag: "Login corporativo", Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Retorno del proveedor OIDC (redirige a la SPA)", Handler: oidcCallbackHandler, Status: http.StatusFound, Errors: []int{400, 401, 404, 502}},
+		}},
+
+		// Documentación
+		{Pattern: "/openapi.json", Tag: "Documentación", Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Especificación OpenAPI 3.1 de esta API", Handler: openAPIHandler, Response: map[string]interface{}{}},
+		}},
+	}
+	routes = append(routes, withVersion("v1", v1)...)
+	routes = append(routes, withVersion("v2", inheritRoutes(v1, v2Routes()))...)
+	routes = append(routes, serverRoutes()...)
+	return routes
+}
+
+// serverRoutes son las rutas de la raíz del servidor: las sondas del orquestador
+// (health.go) y las métricas de Prometheus (metrics.go). No tienen versión ni límite
+// de peticiones.
+func serverRoutes() []apiRoute {
+	return []apiRoute{
+		{Pattern: "/healthz", Root: true, Tag: "Operación", Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Sonda de vida", Handler: healthzHandler, Response: probeResponse{}},
+		}},
+		{Pattern: "/readyz", Root: true, Tag: "Operación", Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Sonda de disponibilidad", Handler: readyzHandler, Response: readinessResponse{}, Errors: []int{503}},
+		}},
+		{Pattern: "/version", Root: true, Tag: "Operación", Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Versión del binario", Handler: versionHandler, Response: buildInfo{}},
+		}},
+		{Pattern: "/metrics", Root: true, Tag: "Operación", Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Métricas en formato de texto de Prometheus", Handler: metricsHandler, Response: "", ResponseType: "text/plain", Errors: []int{401}},
+		}},
+	}
+}
+
+// v1Routes son las rutas de /api/v1/, relativas a la versión
+func v1Routes() []apiRoute {
+	return []apiRoute{
+		// Productos
+		{Pattern: "/products", Tag: "Productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Listar productos", Handler: listProductsHandler, Permission: permProductsRead, Response: []models.Product{}},
+			{Method: http.MethodPost, Summary: "Crear un producto", Handler: createProductHandler, Permission: permProductsWrite, Request: models.Product{}, Response: models.Product{}, Status: http.StatusCreated, Errors: []int{400, 409, 413}},
+		}},
+		{Pattern: "/products/{id:int}", Tag: "Productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Obtener un producto", Handler: getProductHandler, Permission: permProductsRead, Response: models.Product{}, Headers: []string{"If-None-Match"}, Errors: []int{304, 400, 404}},
+			{Method: http.MethodPut, Summary: "Reemplazar un producto", Handler: replaceProductHandler, Permission: permProductsWrite, Request: models.Product{}, Response: models.Product{}, Headers: []string{"If-Match"}, Errors: []int{400, 404, 409, 412, 413, 428}},
+			{Method: http.MethodPatch, Summary: "Modificar parcialmente un producto (Merge Patch o JSON Patch)", Handler: patchProductHandler, Permission: permProductsWrite, Request: map[string]interface{}{}, MediaTypes: []string{mediaTypeMergePatch, mediaTypeJSONPatch}, Response: models.Product{}, Headers: []string{"If-Match"}, Errors: []int{400, 404, 409, 412, 413, 415, 422, 428}},
+			{Method: http.MethodDelete, Summary: "Enviar un producto a la papelera", Handler: deleteProductHandler, Permission: permProductsDelete, Response: messageResponse{}, Headers: []string{"If-Match"}, Errors: []int{400, 404, 412, 428}},
+		}},
+
+		// Importación masiva de productos
+		{Pattern: "/products/import", Tag: "Productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Importar productos desde CSV o JSON Lines (alta o actualización por SKU)", Handler: importProductsHandler, Permission: permProductsWrite, Request: []byte{}, MediaTypes: []string{mediaTypeCSV, mediaTypeNDJSON, mediaTypeJSONL}, Query: []string{"mapping:string", "mode:string", "dryRun:boolean", "async:boolean"}, Response: importReport{}, Errors: []int{400, 413, 415, 422}, RateLimit: "upload"},
+		}},
+		{Pattern: "/products/import/{jobId:int}", Tag: "Productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Consultar el estado de una importación", Handler: getImportJobHandler, Permission: permProductsWrite, Response: importReport{}, Errors: []int{400, 404}},
+		}},
+
+		// Revisiones de productos
+		{Pattern: "/products/{id:int}/revisions", Tag: "Productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Listar las revisiones de un producto con sus cambios", Handler: listProductRevisionsHandler, Permission: permProductsRead, Query: []string{"page", "limit"}, Response: revisionPage{}, Errors: []int{400, 404}},
+		}},
+		{Pattern: "/products/{id:int}/revisions/{version:int}", Tag: "Productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Obtener una revisión y compararla con otra", Handler: getProductRevisionHandler, Permission: permProductsRead, Query: []string{"compare"}, Response: revisionView{}, Errors: []int{400, 404}},
+		}},
+		{Pattern: "/products/{id:int}/revisions/{version:int}/rollback", Tag: "Productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Volver a una revisión anterior", Handler: rollbackProductHandler, Permission: permProductsWrite, Response: models.Product{}, Headers: []string{"If-Match"}, Errors: []int{400, 404, 409, 412, 428}},
+		}},
+
+		// Papelera de productos
+		{Pattern: "/products/trash", Tag: "Productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Listar los productos en la papelera", Handler: listTrashHandler, Permission: permAdmin, Query: []string{"page", "limit"}, Response: productPage{}, Errors: []int{400}},
+		}},
+		{Pattern: "/products/{id:int}/restore", Tag: "Productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Restaurar un producto de la papelera", Handler: restoreProductHandler, Permission: permAdmin, Response: models.Product{}, Errors: []int{400, 404, 409}},
+		}},
+
+		// Imágenes de productos
+		{Pattern: "/products/{id:int}/images", Tag: "Imágenes de productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Listar las imágenes de un producto", Handler: listProductImagesHandler, Permission: permProductsRead, Response: []models.ProductImage{}, Errors: []int{400, 404}},
+			{Method: http.MethodPost, Summary: "Subir una imagen (JPEG, PNG o GIF)", Handler: uploadProductImageHandler, Permission: permProductsWrite, Request: imageUploadForm{}, MediaTypes: []string{"multipart/form-data"}, Response: models.ProductImage{}, Status: http.StatusCreated, Errors: []int{400, 404, 413, 415}, RateLimit: "upload"},
+		}},
+		{Pattern: "/products/{id:int}/images/{imageId:int}", Tag: "Imágenes de productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Obtener los datos de una imagen", Handler: getProductImageHandler, Permission: permProductsRead, Response: models.ProductImage{}, Errors: []int{400, 404}},
+			{Method: http.MethodPatch, Summary: "Cambiar la posición de una imagen o marcarla como principal", Handler: updateProductImageHandler, Permission: permProductsWrite, Request: imageUpdateRequest{}, Response: models.ProductImage{}, Errors: []int{400, 404, 413}},
+			{Method: http.MethodDelete, Summary: "Eliminar una imagen", Handler: deleteProductImageHandler, Permission: permProductsWrite, Response: messageResponse{}, Errors: []int{400, 404}},
+		}},
+		{Pattern: "/products/{id:int}/images/{imageId:int}/{size}", Tag: "Imágenes de productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Descargar la imagen (original) o una miniatura (large, medium, small)", Handler: productImageContentHandler, Permission: permProductsRead, Errors: []int{304, 400, 404}},
+		}},
+
+		// Tokens de API
+		{Pattern: "/tokens", Tag: "Tokens de API", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Listar mis tokens de API", Handler: listAPITokensHandler, Response: []models.APIToken{}},
+			{Method: http.MethodPost, Summary: "Crear un token de API", Handler: createAPITokenHandler, Request: apiTokenRequest{}, Response: apiTokenCreated{}, Status: http.StatusCreated, Errors: []int{400, 413}},
+		}},
+		{Pattern: "/tokens/{id:int}", Tag: "Tokens de API", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodDelete, Summary: "Revocar un token de API", Handler: revokeAPITokenHandler, Response: messageResponse{}, Errors: []int{400, 404}},
+		}},
+
+		// Administración
+		{Pattern: "/admin/lockouts", Tag: "Administración", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Listar cuentas bloqueadas", Handler: adminLockoutsHandler, Permission: permAdmin, Response: []LockoutInfo{}},
+		}},
+		{Pattern: "/admin/unlock", Tag: "Administración", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Desbloquear una cuenta", Handler: adminUnlockHandler, Permission: permAdmin, Request: unlockRequest{}, Response: messageResponse{}, Errors: []int{400, 404, 413}},
+		}},
+		{Pattern: "/admin/2fa-policy", Tag: "Administración", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Consultar la política de 2FA", Handler: getTwoFactorPolicyHandler, Permission: permAdmin, Response: TwoFactorPolicy{}},
+			{Method: http.MethodPut, Summary: "Cambiar la política de 2FA", Handler: updateTwoFactorPolicyHandler, Permission: permAdmin, Request: TwoFactorPolicy{}, Response: TwoFactorPolicy{}, Errors: []int{400, 413}},
+		}},
+		{Pattern: "/admin/jwt/rotate", Tag: "Administración", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodPost, Summary: "Rotar la clave de firma JWT", Handler: adminJWTRotateHandler, Permission: permAdmin, Response: jwtRotateResponse{}, Errors: []int{404}},
+		}},
+
+		// Usuarios
+		{Pattern: "/users/{id:int}/role", Tag: "Usuarios", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodPut, Summary: "Cambiar el rol de un usuario", Handler: changeUserRoleHandler, Permission: permAdmin, Request: roleChangeRequest{}, Response: models.User{}, Errors: []int{400, 404, 409, 413}},
+		}},
+
+		// Auditoría
+		{Pattern: "/audit", Tag: "Auditoría", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Consultar el historial de auditoría", Handler: listAuditHandler, Permission: permAdmin, Query: []string{"actorId", "action:string", "targetType:string", "targetId:string", "since:date-time", "until:date-time", "page", "limit"}, Response: auditPage{}, Errors: []int{400}},
+		}},
+		{Pattern: "/audit/verify", Tag: "Auditoría", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Comprobar la integridad de la cadena de auditoría", Handler: verifyAuditHandler, Permission: permAdmin, Response: auditVerification{}},
+		}},
+	}
+}
+
+// v2Routes son las rutas que cambian en /api/v2/; el resto se heredan de v1
+func v2Routes() []apiRoute {
+	return []apiRoute{
+		// Productos: listado paginado y envuelto en un objeto
+		{Pattern: "/products", Tag: "Productos", Auth: true, Operations: []apiOperation{
+			{Method: http.MethodGet, Summary: "Listar productos (paginado)", Handler: listProductsPageHandler, Permission: permProductsRead, Query: []string{"page", "limit"}, Response: productPage{}, Errors: []int{400}},
+			{Method: http.MethodPost, Summary: "Crear un producto", Handler: createProductHandler, Permission: permProductsWrite, Request: models.Product{}, Response: models.Product{}, Status: http.StatusCreated, Errors: []int{400, 409, 413}},
+		}},
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// newTestServer arranca el servidor completo (mux y middlewares en el mismo orden que
+// main) sobre httptest, con la especificación OpenAPI generada y los límites de
+// peticiones en memoria
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	routes := apiRouteTable()
+	if err := setupOpenAPI(routes); err != nil {
+		t.Fatalf("setupOpenAPI: %v", err)
+	}
+	previous := rateLimiter
+	rateLimiter = newMemoryRateLimitBackend()
+	t.Cleanup(func() { rateLimiter = previous })
+
+	srv := httptest.NewServer(accessLogMiddleware(metricsMiddleware(tracingMiddleware(requestIDMiddleware(newServeMux(routes))))))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// addTestUser da de alta un usuario con el rol indicado; users y sessions vuelven a su
+// estado al terminar la prueba
+func addTestUser(t *testing.T, role string) models.User {
+	t.Helper()
+	savedUsers, savedSessions := users, sessions
+	t.Cleanup(func() { users, sessions = savedUsers, savedSessions })
+
+	user := models.User{ID: 9000 + len(users), Username: "prueba-" + strings.ToLower(role), Role: role, CreatedAt: time.Now()}
+	users = append(append([]models.User(nil), users...), user)
+	sessions = append([]models.Session(nil), sessions...)
+	return user
+}
+
+// testSessionCookie crea un usuario con el rol dado y una sesión completa para él
+func testSessionCookie(t *testing.T, role string) *http.Cookie {
+	t.Helper()
+	user := addTestUser(t, role)
+	session := startSession(httptest.NewRecorder(), user.ID, false)
+	return &http.Cookie{Name: "session_token", Value: string(session.ID)}
+}
+
+// testResponse es una respuesta del servidor de pruebas con el cuerpo JSON decodificado
+type testResponse struct {
+	status int
+	header http.Header
+	body   map[string]interface{}
+}
+
+// code es el código de un problem+json ("" si la respuesta no lo es)
+func (r testResponse) code() string {
+	code, _ := r.body["code"].(string)
+	return code
+}
+
+// sendJSON envía una petición con body codificado como JSON (nil para ninguno)
+func sendJSON(t *testing.T, method, url string, body interface{}, cookie *http.Cookie, headers map[string]string) testResponse {
+	t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	res := testResponse{status: resp.StatusCode, header: resp.Header}
+	json.NewDecoder(resp.Body).Decode(&res.body)
+	return res
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Trazas distribuidas compatibles con OpenTelemetry, sin dependencias externas: el
+// contexto se propaga con la cabecera W3C traceparent y los spans se exportan en el
+// formato OTLP/HTTP JSON (o por stdout).
+//
+//	TIENDA_TRACE_EXPORTER      none (por defecto) | stdout | otlp
+//	TIENDA_OTLP_ENDPOINT       destino OTLP/HTTP (por defecto http://localhost:4318/v1/traces)
+//	TIENDA_TRACE_SAMPLE_RATIO  fracción de trazas nuevas que se muestrean (por defecto 1)
+//	TIENDA_SERVICE_NAME        atributo service.name (por defecto tienda)
+
+// Clave de contexto del span en curso
+const spanContextKey contextKey = "span"
+
+// Tipos de span de OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// Estados de span de OTLP
+const (
+	spanStatusUnset = 0
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+// spanExporter recibe los spans muestreados al terminar
+type spanExporter interface {
+	ExportSpans(spans []spanData)
+}
+
+// tracer guarda la configuración de trazas; con exporter nil los spans se siguen
+// creando (para propagar el contexto) pero no se exportan
+var tracer = struct {
+	exporter    spanExporter
+	sampleRatio float64
+	serviceName string
+}{sampleRatio: 1, serviceName: "tienda"}
+
+// setupTracing elige el exportador según TIENDA_TRACE_EXPORTER
+func setupTracing() error {
+	ratio, err := strconv.ParseFloat(getEnv("TIENDA_TRACE_SAMPLE_RATIO", "1"), 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		return fmt.Errorf("TIENDA_TRACE_SAMPLE_RATIO debe estar entre 0 y 1")
+	}
+	tracer.sampleRatio = ratio
+	tracer.serviceName = getEnv("TIENDA_SERVICE_NAME", "tienda")
+
+	switch kind := getEnv("TIENDA_TRACE_EXPORTER", "none"); kind {
+	case "none":
+		tracer.exporter = nil
+	case "stdout":
+		tracer.exporter = &stdoutSpanExporter{enc: json.NewEncoder(os.Stdout)}
+	case "otlp":
+		endpoint := getEnv("TIENDA_OTLP_ENDPOINT", "http://localhost:4318/v1/traces")
+		tracer.exporter = newOTLPSpanExporter(endpoint)
+		slog.Info("Trazas exportadas por OTLP", "endpoint", endpoint, "sample_ratio", ratio)
+		return nil
+	default:
+		return fmt.Errorf("TIENDA_TRACE_EXPORTER desconocido: %s (usa none, stdout u otlp)", kind)
+	}
+	if tracer.exporter != nil {
+		slog.Info("Trazas activadas", "exporter", getEnv("TIENDA_TRACE_EXPORTER", "none"), "sample_ratio", ratio)
+	}
+	return nil
+}
+
+// --- Spans ---
+
+type traceID [16]byte
+type spanID [8]byte
+
+// spanData es un span terminado tal como lo reciben los exportadores
+type spanData struct {
+	TraceID    string                 `json:"traceId"`
+	SpanID     string                 `json:"spanId"`
+	ParentID   string                 `json:"parentSpanId,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       int                    `json:"kind"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Status     int                    `json:"status"`
+	StatusMsg  string                 `json:"statusMessage,omitempty"`
+}
+
+// span es una operación en curso. Todos los métodos admiten un span nil, de modo
+// que el código instrumentado no necesita comprobar si hay traza.
+type span struct {
+	mu      sync.Mutex
+	traceID traceID
+	spanID  spanID
+	parent  *span
+	sampled bool
+	ended   bool
+	data    spanData
+}
+
+// startSpan crea un span hijo del que haya en ctx (o la raíz de una traza nueva)
+func startSpan(ctx context.Context, name string, attrs ...interface{}) (context.Context, *span) {
+	return startSpanKind(ctx, name, spanKindInternal, attrs...)
+}
+
+func startSpanKind(ctx context.Context, name string, kind int, attrs ...interface{}) (context.Context, *span) {
+	parent := spanFromContext(ctx)
+	s := &span{parent: parent}
+	if parent != nil {
+		s.traceID, s.sampled = parent.traceID, parent.sampled
+		s.data.ParentID = hex.EncodeToString(parent.spanID[:])
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = sampleTrace(s.traceID)
+	}
+	return startSpanWith(ctx, s, name, kind, attrs...)
+}
+
+func startSpanWith(ctx context.Context, s *span, name string, kind int, attrs ...interface{}) (context.Context, *span) {
+	rand.Read(s.spanID[:])
+	s.data.TraceID = hex.EncodeToString(s.traceID[:])
+	s.data.SpanID = hex.EncodeToString(s.spanID[:])
+	s.data.Name = name
+	s.data.Kind = kind
+	s.data.Start = time.Now()
+	s.setAttributes(attrs...)
+	return context.WithValue(ctx, spanContextKey, s), s
+}
+
+// sampleTrace decide el muestreo de una traza nueva a partir de su ID, como el
+// muestreador TraceIDRatioBased de OpenTelemetry
+func sampleTrace(id traceID) bool {
+	if tracer.sampleRatio >= 1 {
+		return true
+	}
+	bound := uint64(tracer.sampleRatio * math.MaxUint64)
+	return binary.BigEndian.Uint64(id[8:]) < bound
+}
+
+// spanFromContext devuelve el span en curso o nil
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey).(*span)
+	return s
+}
+
+// setAttributes añade atributos como pares clave/valor
+func (s *span) setAttributes(kv ...interface{}) {
+	if s == nil || len(kv) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{}, len(kv)/2)
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if key, ok := kv[i].(string); ok {
+			s.data.Attributes[key] = kv[i+1]
+		}
+	}
+}
+
+// setName cambia el nombre (el span del servidor se renombra al conocer la ruta)
+func (s *span) setName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Name = name
+	s.mu.Unlock()
+}
+
+// recordError marca el span como fallido
+func (s *span) recordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Status, s.data.StatusMsg = spanStatusError, err.Error()
+	s.mu.Unlock()
+}
+
+// end termina el span y lo exporta si está muestreado; las llamadas repetidas no hacen nada
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if s.sampled && tracer.exporter != nil {
+		tracer.exporter.ExportSpans([]spanData{data})
+	}
+}
+
+// traceparent devuelve la cabecera W3C que identifica este span
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// parseTraceparent interpreta la cabecera W3C traceparent (versión 00). Devuelve
+// un span remoto que hace de padre, o nil si la cabecera falta o no es válida.
+func parseTraceparent(header string) *span {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return nil
+	}
+	var remote span
+	tid, err1 := hex.DecodeString(parts[1])
+	sid, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(tid) != 16 || len(sid) != 8 || len(flags) != 1 {
+		return nil
+	}
+	copy(remote.traceID[:], tid)
+	copy(remote.spanID[:], sid)
+	if remote.traceID == (traceID{}) || remote.spanID == (spanID{}) {
+		return nil
+	}
+	remote.sampled = flags[0]&1 == 1
+	remote.ended = true // no es nuestro: nunca se exporta
+	return &remote
+}
+
+// --- Middleware y envoltorios ---
+
+// tracingMiddleware abre el span del servidor de cada petición, continuando la traza
+// de la cabecera traceparent si la trae. Va dentro de accessLogMiddleware, que crea el
+// requestLogInfo donde el router deja la ruta con la que se renombra el span.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if remote := parseTraceparent(r.Header.Get("traceparent")); remote != nil {
+			ctx = context.WithValue(ctx, spanContextKey, remote)
+		}
+		ctx, s := startSpanKind(ctx, "HTTP "+r.Method, spanKindServer,
+			"http.request.method", r.Method,
+			"url.path", r.URL.Path,
+			"client.address", clientIP(r),
+			"user_agent.original", r.UserAgent(),
+		)
+		defer s.end()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.setAttributes("http.response.status_code", rec.status, "request_id", w.Header().Get("X-Request-ID"))
+		if info := logInfo(r); info != nil {
+			if info.route != "" {
+				s.setName(r.Method + " " + info.route)
+				s.setAttributes("http.route", info.route)
+			}
+			if info.userID != 0 {
+				s.setAttributes("user.id", info.userID)
+			}
+		}
+		if rec.status >= 500 {
+			s.recordError(fmt.Errorf("estado %d", rec.status))
+		}
+	})
+}
+
+// tracedMiddleware mide un middleware del router en su propio span, que termina al
+// pasar el control al handler (o al responder, si el middleware corta la petición)
+func tracedMiddleware(name string, mw middleware) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		inner := mw(func(w http.ResponseWriter, r *http.Request) {
+			s := spanFromContext(r.Context())
+			s.end()
+			// El handler cuelga del span padre, no del middleware ya terminado
+			next(w, r.WithContext(context.WithValue(r.Context(), spanContextKey, s.parent)))
+		})
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx, s := startSpan(r.Context(), name)
+			defer s.end()
+			inner(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// tracedHandler abre un span con el nombre de la función del handler
+func tracedHandler(handler http.HandlerFunc) http.HandlerFunc {
+	name := handlerName(handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, s := startSpan(r.Context(), name, "code.function", name)
+		defer s.end()
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// handlerName devuelve el nombre de la función sin el paquete (p. ej. loginHandler)
+func handlerName(handler http.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// tracingTransport propaga la traza en las peticiones salientes (p. ej. al proveedor
+// OIDC) con un span de cliente. Sin span en el contexto no traza nada.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if spanFromContext(req.Context()) == nil {
+		return t.base.RoundTrip(req)
+	}
+	_, s := startSpanKind(req.Context(), "HTTP "+req.Method, spanKindClient,
+		"http.request.method", req.Method,
+		"server.address", req.URL.Host,
+		"url.full", req.URL.Scheme+"://"+req.URL.Host+req.URL.Path, // sin query: puede llevar códigos
+	)
+	defer s.end()
+
+	req = req.Clone(req.Context())
+	req.Header.Set("traceparent", s.traceparent())
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		s.recordError(err)
+		return nil, err
+	}
+	s.setAttributes("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		s.recordError(fmt.Errorf("estado %d", resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// --- Exportadores ---
+
+// stdoutSpanExporter escribe cada span como una línea JSON en la salida estándar
+type stdoutSpanExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (e *stdoutSpanExporter) ExportSpans(spans []spanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range spans {
+		e.enc.Encode(s)
+	}
+}
+
+// Parámetros del envío por lotes a OTLP
+const (
+	otlpBatchSize     = 256
+	otlpQueueSize     = 4096
+	otlpFlushInterval = 5 * time.Second
+)
+
+// otlpSpanExporter envía los spans por lotes, en segundo plano, a un colector
+// OTLP/HTTP con codificación JSON. Si la cola se llena, los spans se descartan.
+type otlpSpanExporter struct {
+	endpoint string
+	client   *http.Client
+	queue    chan spanData
+}
+
+func newOTLPSpanExporter(endpoint string) *otlpSpanExporter {
+	e := &otlpSpanExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan spanData, otlpQueueSize),
+	}
+	go e.run()
+	return e
+}
+
+func (e *otlpSpanExporter) ExportSpans(spans []spanData) {
+	for _, s := range spans {
+		select {
+		case e.queue <- s:
+		default:
+			slog.Warn("Cola de trazas OTLP llena; se descarta un span", "trace_id", s.TraceID)
+		}
+	}
+}
+
+func (e *otlpSpanExporter) run() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	batch := make([]spanData, 0, otlpBatchSize)
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := e.send(batch); err != nil {
+			slog.Warn("No se pudieron exportar las trazas", "spans", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+}
+
+func (e *otlpSpanExporter) send(batch []spanData) error {
+	body, err := json.Marshal(otlpTraceRequest(batch))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("el colector respondió %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// otlpTraceRequest construye el cuerpo ExportTraceServiceRequest en JSON
+func otlpTraceRequest(batch []spanData) map[string]interface{} {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		span := map[string]interface{}{
+			"traceId":           s.TraceID,
+			"spanId":            s.SpanID,
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes),
+			"status":            map[string]interface{}{"code": s.Status, "message": s.StatusMsg},
+		}
+		if s.ParentID != "" {
+			span["parentSpanId"] = s.ParentID
+		}
+		spans = append(spans, span)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": tracer.serviceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "TiendaSupported/web"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes convierte los atributos a la lista KeyValue de OTLP
+func otlpAttributes(attrs map[string]interface{}) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(attrs))
+	for _, key := range sortedKeys(attrs) {
+		var value map[string]interface{}
+		switch v := attrs[key].(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)} // int64 viaja como cadena en JSON
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		list = append(list, map[string]interface{}{"key": key, "value": value})
+	}
+	return list
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memorySpanExporter guarda en memoria los spans exportados
+type memorySpanExporter struct {
+	mu    sync.Mutex
+	spans []spanData
+}
+
+func (e *memorySpanExporter) ExportSpans(spans []spanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+}
+
+// Spans devuelve una copia de los spans exportados hasta ahora
+func (e *memorySpanExporter) Spans() []spanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]spanData(nil), e.spans...)
+}
+
+// useMemoryExporter exporta a memoria todas las trazas durante la prueba
+func useMemoryExporter(t *testing.T) *memorySpanExporter {
+	t.Helper()
+	exporter := &memorySpanExporter{}
+	previous, ratio := tracer.exporter, tracer.sampleRatio
+	tracer.exporter, tracer.sampleRatio = exporter, 1
+	t.Cleanup(func() { tracer.exporter, tracer.sampleRatio = previous, ratio })
+	return exporter
+}
+
+// spansByName indexa los spans por nombre; falla si alguno se repite
+func spansByName(t *testing.T, spans []spanData) map[string]spanData {
+	t.Helper()
+	byName := make(map[string]spanData, len(spans))
+	for _, s := range spans {
+		if _, dup := byName[s.Name]; dup {
+			t.Fatalf("span %q exportado dos veces", s.Name)
+		}
+		byName[s.Name] = s
+	}
+	return byName
+}
+
+// getWithHeaders hace un GET al servidor de pruebas y descarta la respuesta
+func getWithHeaders(t *testing.T, url string, cookie *http.Cookie, headers map[string]string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestTracingSpanHierarchy(t *testing.T) {
+	srv := newTestServer(t)
+	exporter := useMemoryExporter(t)
+	cookie := testSessionCookie(t, "User")
+
+	if status := getWithHeaders(t, srv.URL+"/api/v2/products", cookie, nil); status != http.StatusOK {
+		t.Fatalf("GET /api/v2/products = %d", status)
+	}
+	spans := spansByName(t, exporter.Spans())
+
+	server, ok := spans["GET /api/v2/products"]
+	if !ok {
+		t.Fatalf("falta el span del servidor con la ruta; spans: %v", spanNames(spans))
+	}
+	if server.Kind != spanKindServer || server.ParentID != "" {
+		t.Errorf("span del servidor: kind %d, padre %q; se esperaba una raíz de tipo servidor", server.Kind, server.ParentID)
+	}
+	if server.Attributes["http.route"] != "/api/v2/products" || server.Attributes["http.response.status_code"] != http.StatusOK {
+		t.Errorf("atributos del span del servidor: %v", server.Attributes)
+	}
+
+	// Los middlewares y el handler cuelgan del servidor; el handler no cuelga del
+	// authMiddleware, que termina al pasarle el control
+	handler := ""
+	for name, s := range spans {
+		if s.Attributes["code.function"] != nil {
+			handler = name
+		}
+	}
+	if handler == "" {
+		t.Fatalf("falta el span del handler; spans: %v", spanNames(spans))
+	}
+	for _, name := range []string{"versionMiddleware", "authMiddleware", handler} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("falta el span %s", name)
+			continue
+		}
+		if s.TraceID != server.TraceID || s.ParentID != server.SpanID {
+			t.Errorf("%s: traza %s padre %s; se esperaba traza %s padre %s", name, s.TraceID, s.ParentID, server.TraceID, server.SpanID)
+		}
+		if s.End.Before(s.Start) || s.End.After(server.End) {
+			t.Errorf("%s termina fuera del span del servidor", name)
+		}
+	}
+	if lookup, ok := spans["sessions.lookup"]; !ok || lookup.ParentID != spans["authMiddleware"].SpanID {
+		t.Errorf("sessions.lookup debería colgar de authMiddleware")
+	}
+}
+
+func TestTracingIncomingTraceparent(t *testing.T) {
+	srv := newTestServer(t)
+	exporter := useMemoryExporter(t)
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+
+	getWithHeaders(t, srv.URL+"/api/auth/csrf", nil, map[string]string{"traceparent": "00-" + traceID + "-" + parentID + "-01"})
+	spans := exporter.Spans()
+	if len(spans) == 0 {
+		t.Fatal("no se exportó ningún span")
+	}
+	for _, s := range spans {
+		if s.TraceID != traceID {
+			t.Errorf("%s: traza %s, se esperaba la de la cabecera %s", s.Name, s.TraceID, traceID)
+		}
+	}
+	server := spansByName(t, spans)["GET /api/auth/csrf"]
+	if server.ParentID != parentID {
+		t.Errorf("el span del servidor cuelga de %q, se esperaba el padre remoto %s", server.ParentID, parentID)
+	}
+
+	// Sin el indicador de muestreo, la traza se propaga pero no se exporta
+	before := len(exporter.Spans())
+	getWithHeaders(t, srv.URL+"/api/auth/csrf", nil, map[string]string{"traceparent": "00-" + traceID + "-" + parentID + "-00"})
+	if got := len(exporter.Spans()); got != before {
+		t.Errorf("se exportaron %d spans de una traza no muestreada", got-before)
+	}
+
+	// Una cabecera no válida abre una traza nueva
+	before = len(exporter.Spans())
+	getWithHeaders(t, srv.URL+"/api/auth/csrf", nil, map[string]string{"traceparent": "00-" + strings.Repeat("0", 32) + "-" + parentID + "-01"})
+	for _, s := range exporter.Spans()[before:] {
+		if s.Name == "GET /api/auth/csrf" && (s.ParentID != "" || s.TraceID == traceID) {
+			t.Errorf("una cabecera traceparent no válida no debería usarse como padre")
+		}
+	}
+}
+
+func TestTracingTransportPropagation(t *testing.T) {
+	exporter := useMemoryExporter(t)
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("traceparent"))
+	}))
+	defer upstream.Close()
+	client := &http.Client{Transport: tracingTransport{http.DefaultTransport}}
+
+	ctx, parent := startSpan(context.Background(), "padre")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL+"/token?code=secreto", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	parent.end()
+
+	spans := spansByName(t, exporter.Spans())
+	outgoing := spans["HTTP GET"]
+	if outgoing.Kind != spanKindClient || outgoing.ParentID != spans["padre"].SpanID || outgoing.TraceID != spans["padre"].TraceID {
+		t.Errorf("span de cliente: kind %d padre %s traza %s", outgoing.Kind, outgoing.ParentID, outgoing.TraceID)
+	}
+	if want := "00-" + outgoing.TraceID + "-" + outgoing.SpanID + "-01"; len(received) != 1 || received[0] != want {
+		t.Errorf("traceparent enviado = %v, se esperaba %s", received, want)
+	}
+	if url, _ := outgoing.Attributes["url.full"].(string); strings.Contains(url, "secreto") {
+		t.Errorf("url.full no debería incluir la query: %s", url)
+	}
+
+	// Sin span en el contexto no se traza ni se propaga nada
+	resp, err = client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(received) != 2 || received[1] != "" {
+		t.Errorf("sin traza en curso no debería enviarse traceparent: %v", received)
+	}
+}
+
+func spanNames(spans map[string]spanData) []string {
+	names := make([]string, 0, len(spans))
+	for name := range spans {
+		names = append(names, name)
+	}
+	return names
+}
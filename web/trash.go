@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// Papelera de productos. DELETE solo marca el producto con DeletedAt; un Admin puede
+// consultarlo en GET /products/trash y recuperarlo con POST /products/{id}/restore
+// hasta que el purgado lo elimina definitivamente, junto con sus imágenes.
+//
+//	TIENDA_TRASH_RETENTION       tiempo en la papelera antes de purgar (por defecto 720h; 0 no purga)
+//	TIENDA_TRASH_PURGE_INTERVAL  cada cuánto se revisa la papelera (por defecto 1h)
+var (
+	trashRetention     = envDuration("TIENDA_TRASH_RETENTION", 30*24*time.Hour)
+	trashPurgeInterval = envDuration("TIENDA_TRASH_PURGE_INTERVAL", time.Hour)
+)
+
+// startTrashPurger lanza el purgado periódico de la papelera
+func startTrashPurger() {
+	if trashRetention <= 0 {
+		slog.Info("Purgado de la papelera desactivado (TIENDA_TRASH_RETENTION=0)")
+		return
+	}
+	if trashPurgeInterval <= 0 {
+		slog.Warn("TIENDA_TRASH_PURGE_INTERVAL debe ser positivo; se usa 1h", "value", trashPurgeInterval.String())
+		trashPurgeInterval = time.Hour
+	}
+	go func() {
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			purgeTrash(context.Background(), now)
+		}
+	}()
+}
+
+// purgeTrash elimina los productos que llevan en la papelera más de trashRetention
+// y devuelve cuántos se purgaron
+func purgeTrash(ctx context.Context, now time.Time) int {
+	ctx, sp := startSpan(ctx, "trash.purge")
+	defer sp.end()
+
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	kept := products[:0]
+	purged := 0
+	for _, p := range products {
+		if p.DeletedAt == nil || now.Sub(*p.DeletedAt) < trashRetention {
+			kept = append(kept, p)
+			continue
+		}
+		deleteProductImages(ctx, p.ID)
+		deleteProductRevisions(p.ID)
+		recordSystemAudit(ctx, auditEvent{Action: "product.purge", TargetType: auditTargetProduct, TargetID: strconv.Itoa(p.ID), Before: p})
+		purged++
+	}
+	products = kept
+	if purged > 0 {
+		slog.InfoContext(ctx, "Papelera purgada", "products", purged, "retention", trashRetention.String())
+	}
+	sp.setAttributes("products.purged", purged)
+	return purged
+}
+
+// Handler de GET /products/trash: productos en la papelera, los más recientes primero (solo Admin)
+func listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permAdmin); !ok {
+		return
+	}
+	page, limit, errs := parsePagination(r)
+	if len(errs) > 0 {
+		writeValidationProblem(w, r, errs...)
+		return
+	}
+
+	catalogMu.RLock()
+	trashed := make([]models.Product, 0)
+	for _, p := range products {
+		if p.DeletedAt != nil {
+			trashed = append(trashed, p)
+		}
+	}
+	catalogMu.RUnlock()
+	sort.SliceStable(trashed, func(i, j int) bool { return trashed[i].DeletedAt.After(*trashed[j].DeletedAt) })
+
+	json.NewEncoder(w).Encode(productPage{Items: paginate(trashed, page, limit), Page: page, Limit: limit, Total: len(trashed)})
+}
+
+// Handler de POST /products/{id}/restore: saca un producto de la papelera (solo Admin)
+func restoreProductHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permAdmin); !ok {
+		return
+	}
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	i := findProductIndex(pathInt(r, "id"))
+	if i == -1 {
+		writeProblem(w, r, http.StatusNotFound, "product_not_found")
+		return
+	}
+	if products[i].DeletedAt == nil {
+		writeProblem(w, r, http.StatusConflict, "product_not_deleted")
+		return
+	}
+
+	before := products[i]
+	products[i].DeletedAt = nil
+	products[i].UpdatedAt = time.Now()
+	products[i].Version++
+	recordRevision(r, products[i], revisionRestore)
+	recordAudit(r, nil, auditEvent{Action: "product.restore", TargetType: auditTargetProduct, TargetID: strconv.Itoa(before.ID), Before: before, After: products[i]})
+	slog.InfoContext(r.Context(), "Producto restaurado", "product_id", before.ID)
+
+	w.Header().Set("ETag", productETag(products[i]))
+	json.NewEncoder(w).Encode(products[i])
+}
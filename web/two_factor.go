@@ -0,0 +1,473 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+const (
+	totpIssuer            = "TiendaSupported"
+	totpDigits            = 6
+	totpPeriod            = 30 // segundos por intervalo (RFC 6238)
+	totpSkew              = 1  // intervalos de tolerancia antes y después por desfase de reloj
+	recoveryCodeCount     = 10
+	mfaPendingSessionTTL  = 5 * time.Minute
+	totpSecretSizeInBytes = 20
+)
+
+// TwoFactorPolicy define qué roles están obligados a usar 2FA
+type TwoFactorPolicy struct {
+	RequireForAdmin bool `json:"requireForAdmin"`
+}
+
+// twoFactorPolicy es la política activa; el Admin puede cambiarla en caliente
+var twoFactorPolicy = TwoFactorPolicy{
+	RequireForAdmin: envBool("TIENDA_REQUIRE_2FA_ADMIN", false),
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// requiresTwoFactor indica si la política obliga al usuario a tener 2FA activo
+func requiresTwoFactor(user *models.User) bool {
+	return twoFactorPolicy.RequireForAdmin && user.Role == "Admin"
+}
+
+// newTOTPSecret genera un secreto aleatorio codificado en base32
+func newTOTPSecret() (string, error) {
+	buf := make([]byte, totpSecretSizeInBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// totpCode calcula el código HOTP (RFC 4226) para un intervalo dado
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// verifyTOTP comprueba el código dentro de la ventana de tolerancia. Los intervalos
+// ya usados (<= lastStep) se rechazan para que un código no pueda reutilizarse.
+func verifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI construye la URI otpauth:// que importan las apps de autenticación
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// newRecoveryCodes genera códigos de un solo uso y devuelve los valores en claro y sus hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 6)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(buf)) // 10 caracteres
+		code := raw[:5] + "-" + raw[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// useRecoveryCode consume un código de recuperación si es válido
+func useRecoveryCode(user *models.User, code string) bool {
+	hash := hashToken(strings.ToLower(strings.TrimSpace(code)))
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i], user.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// sessionFromCookie devuelve la sesión vigente (completa o parcial) y su usuario
+func sessionFromCookie(r *http.Request) (*models.Session, *models.User) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return nil, nil
+	}
+	// En modo JWT la sesión completa es el access token; se representa con su familia (sid)
+	if looksLikeJWT(cookie.Value) {
+		user, claims := userFromJWT(cookie.Value)
+		if user == nil {
+			return nil, nil
+		}
+		return &models.Session{ID: models.SessionID(claims.SessionID), UserID: user.ID, ExpiresAt: time.Unix(claims.ExpiresAt, 0)}, user
+	}
+	for i := range sessions {
+		session := &sessions[i]
+		if session.ID == models.SessionID(cookie.Value) && session.ExpiresAt.After(time.Now()) {
+			for j := range users {
+				if users[j].ID == session.UserID {
+					return session, &users[j]
+				}
+			}
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+// deleteSession elimina una sesión concreta
+func deleteSession(id models.SessionID) {
+	for i := range sessions {
+		if sessions[i].ID == id {
+			sessions = append(sessions[:i], sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// completeTwoFactorLogin sustituye la sesión parcial por una completa y devuelve
+// los campos de token que se añaden a la respuesta en modo JWT
+func completeTwoFactorLogin(w http.ResponseWriter, r *http.Request, pending *models.Session, user *models.User) (map[string]interface{}, error) {
+	deleteSession(pending.ID)
+	tokens, err := establishSession(w, user)
+	if err != nil {
+		return nil, err
+	}
+	setLogUser(r, user.ID)
+	recordLogin("totp", loginResultSuccess)
+	recordAudit(r, user, auditEvent{Action: "session.login", TargetType: auditTargetSession, TargetID: strconv.Itoa(user.ID), After: map[string]string{"method": "totp"}})
+	slog.InfoContext(r.Context(), "Login exitoso con segundo factor", "user_id", user.ID)
+	return tokens, nil
+}
+
+// Handler para iniciar el alta de TOTP: genera un secreto pendiente de verificar
+func twoFactorEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	// Configurar CORS
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-CSRF-Token")
+
+	// Se admite una sesión parcial solo para el alta obligatoria de 2FA
+	session, user := sessionFromCookie(r)
+	if session == nil {
+		writeProblem(w, r, http.StatusUnauthorized, "session_invalid")
+		return
+	}
+	if !checkCSRF(w, r) {
+		return
+	}
+	if user.TOTPEnabled {
+		writeProblem(w, r, http.StatusConflict, "mfa_already_enabled")
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error generando el secreto TOTP", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	user.TOTPPendingSecret = secret
+	slog.InfoContext(r.Context(), "Alta de 2FA iniciada", "user_id", user.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"secret":     secret,
+		"otpauthUri": totpURI(user.Username, secret),
+		"digits":     totpDigits,
+		"period":     totpPeriod,
+	})
+}
+
+// Cuerpo de la activación de TOTP con el primer código
+type totpActivateRequest struct {
+	Code string `json:"code" validate:"required,max=10"`
+}
+
+// Handler para activar TOTP verificando el primer código generado por la app
+func twoFactorActivateHandler(w http.ResponseWriter, r *http.Request) {
+	// Configurar CORS
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-CSRF-Token")
+
+	session, user := sessionFromCookie(r)
+	if session == nil {
+		writeProblem(w, r, http.StatusUnauthorized, "session_invalid")
+		return
+	}
+	if !checkCSRF(w, r) {
+		return
+	}
+	if user.TOTPEnabled {
+		writeProblem(w, r, http.StatusConflict, "mfa_already_enabled")
+		return
+	}
+	if user.TOTPPendingSecret == "" {
+		writeProblem(w, r, http.StatusBadRequest, "mfa_enrollment_not_started")
+		return
+	}
+
+	var req totpActivateRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	step, ok := verifyTOTP(user.TOTPPendingSecret, req.Code, time.Now(), 0)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "mfa_code_invalid")
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error generando los códigos de recuperación", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+
+	before := *user
+	user.TOTPSecret = user.TOTPPendingSecret
+	user.TOTPPendingSecret = ""
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	user.RecoveryCodes = hashes
+	recordAudit(r, user, auditEvent{Action: "user.2fa_enable", TargetType: auditTargetUser, TargetID: strconv.Itoa(user.ID), Before: before, After: *user})
+	slog.InfoContext(r.Context(), "2FA activada", "user_id", user.ID)
+
+	response := map[string]interface{}{
+		"message":       "Verificación en dos pasos activada. Guarda los códigos de recuperación en un lugar seguro",
+		"recoveryCodes": codes,
+		"id":            user.ID,
+		"username":      user.Username,
+		"role":          user.Role,
+	}
+
+	// Si el alta era obligatoria para completar el login, la sesión parcial pasa a ser completa
+	if session.MFAPending {
+		loginGuard.recordSuccess(user.Username)
+		tokens, err := completeTwoFactorLogin(w, r, session, user)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error creando la sesión", "user_id", user.ID, "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+			return
+		}
+		for k, v := range tokens {
+			response[k] = v
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Cuerpo de la verificación y la desactivación de 2FA: un código TOTP o uno de recuperación
+type totpCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// verifySecondFactor comprueba un código TOTP o de recuperación con la misma protección
+// que el login: respeta la espera y el bloqueo de la cuenta y la IP, cuenta los códigos
+// incorrectos como fallos (frenan la fuerza bruta de 6 dígitos) y no acepta un código TOTP
+// ya usado. Si el código no se acepta responde el error y devuelve el resultado para las
+// métricas (loginResultThrottled o loginResultFailure).
+func verifySecondFactor(w http.ResponseWriter, r *http.Request, user *models.User, req totpCodeRequest) (string, bool) {
+	ip := clientIP(r)
+	if wait, locked := loginGuard.retryAfter(user.Username, ip, time.Now()); wait > 0 {
+		writeTooManyAttempts(w, r, wait, locked)
+		return loginResultThrottled, false
+	}
+
+	verified := false
+	if strings.TrimSpace(req.RecoveryCode) != "" {
+		verified = useRecoveryCode(user, req.RecoveryCode)
+		if verified {
+			slog.InfoContext(r.Context(), "Código de recuperación usado", "user_id", user.ID, "remaining", len(user.RecoveryCodes))
+		}
+	} else if step, ok := verifyTOTP(user.TOTPSecret, req.Code, time.Now(), user.TOTPLastStep); ok {
+		user.TOTPLastStep = step
+		verified = true
+	}
+
+	if !verified {
+		loginGuard.recordFailure(user.Username, ip, time.Now())
+		slog.InfoContext(r.Context(), "Código de segundo factor incorrecto", "user_id", user.ID)
+		writeProblem(w, r, http.StatusUnauthorized, "mfa_code_invalid")
+		return loginResultFailure, false
+	}
+	return loginResultSuccess, true
+}
+
+// Handler para el segundo paso del login: valida el código TOTP o un código de recuperación
+func twoFactorVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	// Configurar CORS
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-CSRF-Token")
+
+	session, user := sessionFromCookie(r)
+	if session == nil || !session.MFAPending || !user.TOTPEnabled {
+		writeProblem(w, r, http.StatusUnauthorized, "mfa_not_pending")
+		return
+	}
+	if !checkCSRF(w, r) {
+		return
+	}
+
+	var req totpCodeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if result, ok := verifySecondFactor(w, r, user, req); !ok {
+		recordLogin("totp", result)
+		return
+	}
+	loginGuard.recordSuccess(user.Username)
+
+	tokens, err := completeTwoFactorLogin(w, r, session, user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creando la sesión", "user_id", user.ID, "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+
+	response := map[string]interface{}{
+		"message":                "Login exitoso",
+		"id":                     user.ID,
+		"username":               user.Username,
+		"role":                   user.Role,
+		"remainingRecoveryCodes": len(user.RecoveryCodes),
+	}
+	for k, v := range tokens {
+		response[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Handler para desactivar TOTP; exige un código válido y respeta la política de roles
+func twoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	if !ok || user == nil {
+		slog.ErrorContext(r.Context(), "Usuario no encontrado en el contexto")
+		writeProblem(w, r, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	if authMethod(r) != authMethodSession {
+		writeProblem(w, r, http.StatusForbidden, "session_auth_required")
+		return
+	}
+	if !user.TOTPEnabled {
+		writeProblem(w, r, http.StatusConflict, "mfa_not_enabled")
+		return
+	}
+	if requiresTwoFactor(user) {
+		writeProblem(w, r, http.StatusForbidden, "mfa_required_by_policy")
+		return
+	}
+
+	var req totpCodeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if _, ok := verifySecondFactor(w, r, user, req); !ok {
+		return
+	}
+
+	before := *user
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPPendingSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+	recordAudit(r, user, auditEvent{Action: "user.2fa_disable", TargetType: auditTargetUser, TargetID: strconv.Itoa(user.ID), Before: before, After: *user})
+	slog.InfoContext(r.Context(), "2FA desactivada", "user_id", user.ID)
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Verificación en dos pasos desactivada"})
+}
+
+// Handler de administración para consultar la política de 2FA
+func getTwoFactorPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permAdmin); !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(twoFactorPolicy)
+}
+
+// Handler de administración para cambiar la política de 2FA
+func updateTwoFactorPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := requirePermission(w, r, permAdmin)
+	if !ok {
+		return
+	}
+
+	var policy TwoFactorPolicy
+	if !decodeJSON(w, r, &policy) {
+		return
+	}
+
+	recordAudit(r, user, auditEvent{Action: "config.2fa_policy", TargetType: auditTargetConfig, TargetID: "2fa-policy", Before: twoFactorPolicy, After: policy})
+	twoFactorPolicy = policy
+	slog.InfoContext(r.Context(), "Política de 2FA actualizada", "require_for_admin", policy.RequireForAdmin, "user_id", user.ID)
+	json.NewEncoder(w).Encode(twoFactorPolicy)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// addTOTPUser da de alta un usuario con 2FA activo y devuelve su secreto y sus códigos
+// de recuperación en claro
+func addTOTPUser(t *testing.T) (models.User, string, []string) {
+	t.Helper()
+	addTestUser(t, "User")
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := &users[len(users)-1]
+	stored.TOTPEnabled, stored.TOTPSecret, stored.RecoveryCodes = true, secret, hashes
+	return *stored, secret, codes
+}
+
+// useLoginGuard sustituye el control de intentos por uno sin esperas entre fallos, para
+// que un código rechazado no retrase los siguientes pasos de la prueba
+func useLoginGuard(t *testing.T) {
+	t.Helper()
+	previous := loginGuard
+	loginGuard = newLoginThrottle(loginThrottleConfig{MaxAccountFailures: 100, MaxIPFailures: 100, LockoutDuration: time.Minute})
+	t.Cleanup(func() { loginGuard = previous })
+}
+
+// pendingLogin abre una sesión parcial, como la que deja el login con contraseña de un
+// usuario con 2FA, y devuelve su cookie y su token CSRF
+func pendingLogin(t *testing.T, user models.User) (*http.Cookie, map[string]string) {
+	t.Helper()
+	session := startSession(httptest.NewRecorder(), user.ID, true)
+	return &http.Cookie{Name: "session_token", Value: string(session.ID)}, map[string]string{csrfHeader: csrfTokenFor(string(session.ID))}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_800_000_000, 0)
+	current := now.Unix() / totpPeriod
+	codeAt := func(step int64) string {
+		code, err := totpCode(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	for _, tc := range []struct {
+		name     string
+		code     string
+		lastStep int64
+		wantStep int64
+		ok       bool
+	}{
+		{"intervalo actual", codeAt(current), 0, current, true},
+		{"intervalo anterior dentro del desfase", codeAt(current - totpSkew), 0, current - totpSkew, true},
+		{"intervalo siguiente dentro del desfase", codeAt(current + totpSkew), 0, current + totpSkew, true},
+		{"fuera del desfase por detrás", codeAt(current - totpSkew - 1), 0, 0, false},
+		{"fuera del desfase por delante", codeAt(current + totpSkew + 1), 0, 0, false},
+		{"código ya usado", codeAt(current), current, 0, false},
+		{"intervalo anterior al último usado", codeAt(current - 1), current - 1, 0, false},
+		{"con espacios", " " + codeAt(current) + " ", 0, current, true},
+		{"longitud incorrecta", codeAt(current)[:5], 0, 0, false},
+	} {
+		step, ok := verifyTOTP(secret, tc.code, now, tc.lastStep)
+		if ok != tc.ok || step != tc.wantStep {
+			t.Errorf("%s: verifyTOTP = (%d, %v), se esperaba (%d, %v)", tc.name, step, ok, tc.wantStep, tc.ok)
+		}
+	}
+}
+
+func TestTwoFactorVerifyLogin(t *testing.T) {
+	srv := newTestServer(t)
+	useLoginGuard(t)
+	user, secret, _ := addTOTPUser(t)
+	verifyURL := srv.URL + "/api/auth/2fa/verify"
+
+	// La sesión parcial no da acceso a la API ni verifica sin el token CSRF
+	cookie, csrf := pendingLogin(t, user)
+	if res := sendJSON(t, http.MethodGet, srv.URL+"/api/v2/products", nil, cookie, nil); res.status != http.StatusUnauthorized || res.code() != "mfa_pending" {
+		t.Fatalf("API con sesión parcial: %d %s", res.status, res.code())
+	}
+	code, err := totpCode(secret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := sendJSON(t, http.MethodPost, verifyURL, totpCodeRequest{Code: code}, cookie, nil); res.code() != "csrf_invalid" {
+		t.Fatalf("verificación sin CSRF: %d %s", res.status, res.code())
+	}
+
+	// Un código válido sustituye la sesión parcial por una completa
+	res := sendJSON(t, http.MethodPost, verifyURL, totpCodeRequest{Code: code}, cookie, csrf)
+	if res.status != http.StatusOK {
+		t.Fatalf("código válido: %d %s", res.status, res.code())
+	}
+	var full *http.Cookie
+	for _, c := range (&http.Response{Header: res.header}).Cookies() {
+		if c.Name == "session_token" {
+			full = c
+		}
+	}
+	if full == nil || full.Value == cookie.Value {
+		t.Fatalf("la verificación debería emitir una sesión nueva")
+	}
+	if res := sendJSON(t, http.MethodGet, srv.URL+"/api/v2/products", nil, full, nil); res.status != http.StatusOK {
+		t.Errorf("API con la sesión completa: %d %s", res.status, res.code())
+	}
+	if res := sendJSON(t, http.MethodPost, verifyURL, totpCodeRequest{Code: code}, cookie, csrf); res.code() != "mfa_not_pending" {
+		t.Errorf("la sesión parcial debería haberse cerrado: %d %s", res.status, res.code())
+	}
+
+	// El mismo código no sirve para un segundo login (TOTPLastStep)
+	cookie, csrf = pendingLogin(t, user)
+	if res := sendJSON(t, http.MethodPost, verifyURL, totpCodeRequest{Code: code}, cookie, csrf); res.status != http.StatusUnauthorized || res.code() != "mfa_code_invalid" {
+		t.Errorf("código reutilizado: %d %s", res.status, res.code())
+	}
+}
+
+func TestTwoFactorRecoveryCode(t *testing.T) {
+	srv := newTestServer(t)
+	useLoginGuard(t)
+	user, _, codes := addTOTPUser(t)
+	verifyURL := srv.URL + "/api/auth/2fa/verify"
+
+	cookie, csrf := pendingLogin(t, user)
+	res := sendJSON(t, http.MethodPost, verifyURL, totpCodeRequest{RecoveryCode: codes[0]}, cookie, csrf)
+	if res.status != http.StatusOK {
+		t.Fatalf("código de recuperación: %d %s", res.status, res.code())
+	}
+	if remaining := res.body["remainingRecoveryCodes"]; remaining != float64(len(codes)-1) {
+		t.Errorf("remainingRecoveryCodes = %v, se esperaba %d", remaining, len(codes)-1)
+	}
+
+	// Cada código de recuperación se consume al usarlo
+	cookie, csrf = pendingLogin(t, user)
+	if res := sendJSON(t, http.MethodPost, verifyURL, totpCodeRequest{RecoveryCode: codes[0]}, cookie, csrf); res.status != http.StatusUnauthorized || res.code() != "mfa_code_invalid" {
+		t.Errorf("código de recuperación reutilizado: %d %s", res.status, res.code())
+	}
+	if res := sendJSON(t, http.MethodPost, verifyURL, totpCodeRequest{RecoveryCode: codes[1]}, cookie, csrf); res.status != http.StatusOK {
+		t.Errorf("otro código de recuperación: %d %s", res.status, res.code())
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	models "TiendaSupported/modules"
+)
+
+// Cuerpo del cambio de rol
+type roleChangeRequest struct {
+	Role string `json:"role" validate:"required"`
+}
+
+// findUser devuelve el usuario con el ID indicado, o nil
+func findUser(id int) *models.User {
+	for i := range users {
+		if users[i].ID == id {
+			return &users[i]
+		}
+	}
+	return nil
+}
+
+// findUserByName devuelve el usuario con ese nombre, o nil
+func findUserByName(username string) *models.User {
+	for i := range users {
+		if users[i].Username == username {
+			return &users[i]
+		}
+	}
+	return nil
+}
+
+// adminCount cuenta los usuarios con rol Admin
+func adminCount() int {
+	count := 0
+	for _, u := range users {
+		if u.Role == "Admin" {
+			count++
+		}
+	}
+	return count
+}
+
+// Handler de PUT /users/{id}/role: cambia el rol de un usuario (solo Admin). Las
+// sesiones del usuario se cierran para que el nuevo rol se aplique de inmediato.
+func changeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := requirePermission(w, r, permAdmin)
+	if !ok {
+		return
+	}
+	var req roleChangeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if _, known := rolePermissions[req.Role]; !known {
+		writeValidationProblem(w, r, fieldError("role", "field_invalid_choice", strings.Join(sortedKeys(rolePermissions), ", ")))
+		return
+	}
+
+	user := findUser(pathInt(r, "id"))
+	switch {
+	case user == nil:
+		writeProblem(w, r, http.StatusNotFound, "user_not_found")
+		return
+	case user.ID == admin.ID:
+		writeProblem(w, r, http.StatusConflict, "role_change_self")
+		return
+	case user.ExternalSubject != "":
+		writeProblem(w, r, http.StatusConflict, "role_managed_externally")
+		return
+	case user.Role == "Admin" && req.Role != "Admin" && adminCount() == 1:
+		writeProblem(w, r, http.StatusConflict, "role_change_last_admin")
+		return
+	}
+
+	before := *user
+	if user.Role != req.Role {
+		user.Role = req.Role
+		closed := deleteUserSessions(user.ID, "")
+		recordAudit(r, admin, auditEvent{Action: "user.role_change", TargetType: auditTargetUser, TargetID: strconv.Itoa(user.ID), Before: before, After: *user})
+		slog.InfoContext(r.Context(), "Rol de usuario cambiado", "user_id", user.ID, "old_role", before.Role, "role", user.Role, "sessions_closed", closed)
+	}
+	json.NewEncoder(w).Encode(user)
+}
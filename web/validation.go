@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxJSONBodyBytes limita el tamaño de los cuerpos JSON de la API
+var maxJSONBodyBytes = int64(envInt("TIENDA_MAX_BODY_BYTES", 64<<10))
+
+// errBodyTooLarge indica que el cuerpo supera maxJSONBodyBytes
+var errBodyTooLarge = errors.New("cuerpo de la petición demasiado grande")
+
+// readBody lee el cuerpo completo respetando el límite de tamaño
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes))
+	r.Body.Close()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, errBodyTooLarge
+	}
+	return body, err
+}
+
+// writeBodyError responde el problema adecuado a un error de readBody
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errBodyTooLarge) {
+		writeProblemDetail(w, r, http.StatusRequestEntityTooLarge, "payload_too_large",
+			"Máximo "+strconv.FormatInt(maxJSONBodyBytes, 10)+" bytes")
+		return
+	}
+	slog.WarnContext(r.Context(), "Error leyendo el cuerpo", "error", err)
+	writeProblem(w, r, http.StatusBadRequest, "invalid_json")
+}
+
+// decodeJSON lee el cuerpo (con límite de tamaño) en dst, que debe ser un puntero a
+// struct, y aplica las reglas de sus etiquetas `validate`. Rechaza campos desconocidos
+// y campos de solo lectura, y reúne todos los errores de campo en una sola respuesta.
+// Si algo falla escribe el problema correspondiente y devuelve false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	body, err := readBody(w, r)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return false
+	}
+
+	var members map[string]json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if err := dec.Decode(&members); err != nil || members == nil || dec.More() {
+		slog.InfoContext(r.Context(), "JSON inválido", "error", err)
+		writeProblem(w, r, http.StatusBadRequest, "invalid_json")
+		return false
+	}
+
+	if errs := assignMembers(members, dst); len(errs) > 0 {
+		writeValidationProblem(w, r, errs...)
+		return false
+	}
+	return true
+}
+
+// assignMembers asigna cada miembro JSON al campo correspondiente de dst y después
+// valida el struct completo; los campos con errores de tipo no se validan de nuevo
+func assignMembers(members map[string]json.RawMessage, dst interface{}) []FieldError {
+	v := reflect.ValueOf(dst).Elem()
+	t := v.Type()
+
+	byName := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name := jsonFieldName(t.Field(i)); name != "" {
+			byName[name] = i
+		}
+	}
+
+	// Orden estable de los errores, independiente del orden de iteración del mapa
+	keys := make([]string, 0, len(members))
+	for key := range members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []FieldError
+	skip := make(map[string]bool)
+	for _, key := range keys {
+		idx, ok := byName[key]
+		if !ok {
+			errs = append(errs, fieldError(key, "field_unknown"))
+			continue
+		}
+		if hasRule(t.Field(idx), "readonly") {
+			errs = append(errs, fieldError(key, "field_read_only"))
+			skip[key] = true
+			continue
+		}
+		if err := json.Unmarshal(members[key], v.Field(idx).Addr().Interface()); err != nil {
+			errs = append(errs, fieldError(key, "field_invalid_type", jsonTypeName(t.Field(idx).Type)))
+			skip[key] = true
+		}
+	}
+
+	for _, e := range validateStruct(dst) {
+		if !skip[e.Field] {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+// validateStruct aplica las reglas declaradas en las etiquetas `validate` de un struct:
+//
+//	required      el valor no puede estar vacío (texto en blanco, slice vacío)
+//	min=N, max=N  longitud en caracteres (texto) o rango (números)
+//	maxbytes=N    longitud máxima en bytes (texto)
+//	chars=C       caracteres permitidos: line (sin caracteres de control),
+//	              text (admite saltos de línea y tabuladores), username o sku
+//	readonly      lo gestiona el servidor; no puede enviarse en el cuerpo
+func validateStruct(s interface{}) []FieldError {
+	v := reflect.Indirect(reflect.ValueOf(s))
+	t := v.Type()
+	var errs []FieldError
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := jsonFieldName(field)
+		tag := field.Tag.Get("validate")
+		if name == "" || tag == "" {
+			continue
+		}
+		if e, ok := checkRules(name, v.Field(i), strings.Split(tag, ",")); !ok {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+// checkRules devuelve el primer error del campo (una regla incumplida por campo basta)
+func checkRules(name string, value reflect.Value, rules []string) (FieldError, bool) {
+	for _, rule := range rules {
+		rule, arg, _ := strings.Cut(rule, "=")
+		switch rule {
+		case "required":
+			if isEmptyValue(value) {
+				return fieldError(name, "field_required"), false
+			}
+		case "min", "max":
+			limit, _ := strconv.ParseFloat(arg, 64)
+			if value.Kind() == reflect.Ptr {
+				if value.IsNil() {
+					continue
+				}
+				value = value.Elem()
+			}
+			switch value.Kind() {
+			case reflect.String:
+				n := float64(len([]rune(value.String())))
+				if rule == "min" && n < limit && n > 0 {
+					return fieldError(name, "field_too_short", arg), false
+				}
+				if rule == "max" && n > limit {
+					return fieldError(name, "field_too_long", arg), false
+				}
+			case reflect.Int, reflect.Int64, reflect.Float64:
+				var n float64
+				if value.Kind() == reflect.Float64 {
+					n = value.Float()
+				} else {
+					n = float64(value.Int())
+				}
+				if rule == "min" && n < limit {
+					return fieldError(name, "field_too_small", arg), false
+				}
+				if rule == "max" && n > limit {
+					return fieldError(name, "field_too_large", arg), false
+				}
+			}
+		case "maxbytes":
+			limit, _ := strconv.Atoi(arg)
+			if value.Kind() == reflect.String && len(value.String()) > limit {
+				return fieldError(name, "field_too_long_bytes", arg), false
+			}
+		case "chars":
+			if value.Kind() == reflect.String && !allowedChars(value.String(), arg) {
+				return fieldError(name, "field_invalid_chars"), false
+			}
+		}
+	}
+	return FieldError{}, true
+}
+
+func allowedChars(s, class string) bool {
+	for _, c := range s {
+		switch class {
+		case "username":
+			if !(c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c) || c == '.' || c == '_' || c == '-')) {
+				return false
+			}
+		case "sku":
+			if !(c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c) || c == '.' || c == '_' || c == '-' || c == '/')) {
+				return false
+			}
+		case "text":
+			if unicode.IsControl(c) && c != '\n' && c != '\r' && c != '\t' {
+				return false
+			}
+		default: // line
+			if unicode.IsControl(c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(v.String()) == ""
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func hasRule(field reflect.StructField, rule string) bool {
+	for _, r := range strings.Split(field.Tag.Get("validate"), ",") {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFieldName devuelve el nombre JSON del campo ("" si no se serializa)
+func jsonFieldName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// jsonTypeName describe el tipo JSON esperado para un campo, para el mensaje de error
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		return "array"
+	case reflect.Ptr:
+		return jsonTypeName(t.Elem())
+	}
+	if t.String() == "time.Time" {
+		return "string"
+	}
+	return "object"
+}
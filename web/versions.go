@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	models "TiendaSupported/modules"
+)
+
+// apiVersion describe una versión de la API bajo /api/<Name>/
+type apiVersion struct {
+	Name       string
+	Deprecated time.Time // desde cuándo está obsoleta (cero si está vigente)
+	Sunset     time.Time // a partir de esta fecha responde 410 (cero si no tiene fin previsto)
+	Successor  string    // versión que la sustituye, para la cabecera Link
+}
+
+// apiVersions en orden de publicación. Una versión obsoleta sigue funcionando, pero
+// sus respuestas llevan la cabecera Deprecation; las fechas de obsolescencia y de
+// retirada se configuran en el despliegue (setupAPIVersions). v1 sigue vigente hasta
+// que se fije TIENDA_API_V1_DEPRECATED; Successor indica a qué versión migrar.
+var apiVersions = []apiVersion{
+	{Name: "v1", Successor: "v2"},
+	{Name: "v2"},
+}
+
+// Tipo de contenido con el que un cliente puede pedir una versión sin ponerla en la
+// ruta: Accept: application/vnd.tienda.v2+json (o application/json; version=2)
+const versionMediaTypePrefix = "application/vnd.tienda."
+
+// setupAPIVersions aplica las fechas de TIENDA_API_<VERSIÓN>_DEPRECATED y
+// TIENDA_API_<VERSIÓN>_SUNSET (p. ej. TIENDA_API_V1_SUNSET=2027-06-30). Ninguna versión
+// está obsoleta ni tiene fecha de retirada por defecto: hasta que se configure, no
+// responde 410.
+func setupAPIVersions() error {
+	for i := range apiVersions {
+		v := &apiVersions[i]
+		prefix := "TIENDA_API_" + strings.ToUpper(v.Name)
+		deprecated, err := envDate(prefix+"_DEPRECATED", v.Deprecated)
+		if err != nil {
+			return err
+		}
+		sunset, err := envDate(prefix+"_SUNSET", v.Sunset)
+		if err != nil {
+			return err
+		}
+		if !sunset.IsZero() {
+			if deprecated.IsZero() || sunset.Before(deprecated) {
+				return fmt.Errorf("%s_SUNSET debe ser posterior a la fecha de obsolescencia (%s_DEPRECATED)", prefix, prefix)
+			}
+			slog.Info("Versión de la API con fecha de retirada", "version", v.Name, "sunset", sunset.Format("2006-01-02"))
+		}
+		v.Deprecated, v.Sunset = deprecated, sunset
+	}
+	return nil
+}
+
+// envDate lee una fecha AAAA-MM-DD de una variable de entorno; "never" la anula
+func envDate(key string, fallback time.Time) (time.Time, error) {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback, nil
+	}
+	if value == "never" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s debe ser una fecha AAAA-MM-DD o never: %q", key, value)
+	}
+	return t, nil
+}
+
+func findAPIVersion(name string) (apiVersion, bool) {
+	for _, v := range apiVersions {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return apiVersion{}, false
+}
+
+// latestAPIVersion es la versión más reciente no obsoleta; la que se sirve en las
+// rutas sin versión si el cliente no pide otra
+func latestAPIVersion() apiVersion {
+	for i := len(apiVersions) - 1; i >= 0; i-- {
+		if apiVersions[i].Deprecated.IsZero() {
+			return apiVersions[i]
+		}
+	}
+	return apiVersions[len(apiVersions)-1]
+}
+
+// versionMiddleware marca las respuestas con la versión que las atendió y, si está
+// obsoleta, con las cabeceras Deprecation (RFC 9745), Sunset (RFC 8594) y un Link a
+// la versión sucesora. Después de la fecha de retirada, si la tiene, responde 410.
+func versionMiddleware(version apiVersion) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("API-Version", version.Name)
+			w.Header().Add("Vary", "Accept")
+			if !version.Deprecated.IsZero() {
+				w.Header().Set("Deprecation", "@"+strconv.FormatInt(version.Deprecated.Unix(), 10))
+				if !version.Sunset.IsZero() {
+					w.Header().Set("Sunset", version.Sunset.UTC().Format(http.TimeFormat))
+				}
+				if version.Successor != "" {
+					successor := strings.Replace(r.URL.Path, "/api/"+version.Name+"/", "/api/"+version.Successor+"/", 1)
+					w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+				}
+			}
+			if !version.Sunset.IsZero() && !time.Now().Before(version.Sunset) {
+				writeProblem(w, r, http.StatusGone, "api_version_retired")
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// negotiatedVersion devuelve la versión pedida en Accept, o la más reciente si no se
+// pide ninguna. ok es false si se pide una versión que no existe.
+func negotiatedVersion(r *http.Request) (apiVersion, bool) {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		name := ""
+		if strings.HasPrefix(mediaType, versionMediaTypePrefix) && strings.HasSuffix(mediaType, "+json") {
+			name = strings.TrimSuffix(strings.TrimPrefix(mediaType, versionMediaTypePrefix), "+json")
+		} else if v, ok := params["version"]; ok && (mediaType == "application/json" || mediaType == "*/*") {
+			name = "v" + strings.TrimPrefix(v, "v")
+		}
+		if name != "" {
+			return findAPIVersion(name)
+		}
+	}
+	return latestAPIVersion(), true
+}
+
+// versionNegotiationHandler atiende las rutas sin versión (/api/products...): elige la
+// versión según Accept y reenvía la petición a /api/<versión>/... en el mismo router
+func versionNegotiationHandler(rt *router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version, ok := negotiatedVersion(r)
+		if !ok {
+			writeProblem(w, r, http.StatusNotAcceptable, "api_version_unsupported")
+			return
+		}
+		versioned := r.Clone(r.Context())
+		versioned.URL.Path = "/api/" + version.Name + strings.TrimPrefix(r.URL.Path, "/api")
+		versioned.URL.RawPath = ""
+		rt.ServeHTTP(w, versioned)
+	}
+}
+
+// withVersion coloca las rutas bajo /api/<versión>
+func withVersion(version string, routes []apiRoute) []apiRoute {
+	out := make([]apiRoute, len(routes))
+	for i, route := range routes {
+		route.Version = version
+		out[i] = route
+	}
+	return out
+}
+
+// inheritRoutes construye las rutas de una versión a partir de las de la anterior:
+// las de overrides sustituyen a las del mismo patrón y el resto se heredan
+func inheritRoutes(previous, overrides []apiRoute) []apiRoute {
+	byPattern := make(map[string]apiRoute, len(overrides))
+	for _, route := range overrides {
+		byPattern[route.Pattern] = route
+	}
+	out := make([]apiRoute, 0, len(previous)+len(overrides))
+	for _, route := range previous {
+		if override, ok := byPattern[route.Pattern]; ok {
+			route = override
+			delete(byPattern, route.Pattern)
+		}
+		out = append(out, route)
+	}
+	for _, route := range overrides {
+		if _, pending := byPattern[route.Pattern]; pending {
+			out = append(out, route)
+		}
+	}
+	return out
+}
+
+// --- Handlers propios de v2 ---
+
+// productPage es la respuesta paginada de GET /api/v2/products
+type productPage struct {
+	Items []models.Product `json:"items"`
+	Page  int              `json:"page"`
+	Limit int              `json:"limit"`
+	Total int              `json:"total"`
+}
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// parsePagination lee los parámetros page y limit de la consulta
+func parsePagination(r *http.Request) (page, limit int, errs []FieldError) {
+	page, limit = 1, defaultPageLimit
+	if value := r.URL.Query().Get("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			errs = append(errs, fieldError("page", "field_too_small", "1"))
+		}
+		page = n
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			errs = append(errs, fieldError("limit", "field_too_small", "1"))
+		} else if n > maxPageLimit {
+			errs = append(errs, fieldError("limit", "field_too_large", strconv.Itoa(maxPageLimit)))
+		}
+		limit = n
+	}
+	return page, limit, errs
+}
+
+// paginate devuelve los elementos de la página indicada (vacío si se pasa del final)
+func paginate[T any](items []T, page, limit int) []T {
+	start := len(items)
+	if page-1 < len(items)/limit+1 {
+		start = min((page-1)*limit, len(items))
+	}
+	end := min(start+limit, len(items))
+	return append(make([]T, 0, end-start), items[start:end]...)
+}
+
+// Handler del listado de productos en v2: se pagina con ?page=&limit= y se envuelve
+// en un objeto
+func listProductsPageHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permProductsRead); !ok {
+		return
+	}
+
+	page, limit, errs := parsePagination(r)
+	if len(errs) > 0 {
+		writeValidationProblem(w, r, errs...)
+		return
+	}
+
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	active := activeProducts()
+	json.NewEncoder(w).Encode(productPage{
+		Items: paginate(active, page, limit),
+		Page:  page,
+		Limit: limit,
+		Total: len(active),
+	})
+}
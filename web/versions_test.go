@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// restoreAPIVersions devuelve la tabla de versiones a su estado tras la prueba
+func restoreAPIVersions(t *testing.T) {
+	t.Helper()
+	saved := append([]apiVersion(nil), apiVersions...)
+	t.Cleanup(func() { apiVersions = saved })
+}
+
+func TestSetupAPIVersions(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantErr    bool
+		deprecated bool
+		sunset     string
+	}{
+		{name: "por defecto, vigente"},
+		{name: "obsoleta sin retirada", env: map[string]string{"TIENDA_API_V1_DEPRECATED": "2026-10-19"}, deprecated: true},
+		{name: "retirada configurada", env: map[string]string{"TIENDA_API_V1_DEPRECATED": "2026-10-19", "TIENDA_API_V1_SUNSET": "2027-06-30"}, deprecated: true, sunset: "2027-06-30"},
+		{name: "obsolescencia anulada", env: map[string]string{"TIENDA_API_V1_DEPRECATED": "never"}},
+		{name: "fecha no válida", env: map[string]string{"TIENDA_API_V1_DEPRECATED": "19/10/2026"}, wantErr: true},
+		{name: "retirada antes de la obsolescencia", env: map[string]string{"TIENDA_API_V1_DEPRECATED": "2026-10-19", "TIENDA_API_V1_SUNSET": "2026-01-01"}, wantErr: true},
+		{name: "retirada sin obsolescencia", env: map[string]string{"TIENDA_API_V1_SUNSET": "2027-06-30"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			restoreAPIVersions(t)
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			err := setupAPIVersions()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("setupAPIVersions() error = %v, se esperaba error: %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			v1, _ := findAPIVersion("v1")
+			if v1.Deprecated.IsZero() == tc.deprecated {
+				t.Errorf("Deprecated = %v, se esperaba obsoleta: %v", v1.Deprecated, tc.deprecated)
+			}
+			if got := v1.Sunset; (tc.sunset == "" && !got.IsZero()) || (tc.sunset != "" && got.Format("2006-01-02") != tc.sunset) {
+				t.Errorf("Sunset = %v, se esperaba %q", got, tc.sunset)
+			}
+		})
+	}
+}
+
+func TestVersionMiddlewareSunset(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	deprecated := time.Now().Add(-48 * time.Hour)
+	tests := []struct {
+		name   string
+		sunset time.Time
+		want   int
+	}{
+		{name: "sin fecha de retirada", want: http.StatusNoContent},
+		{name: "retirada futura", sunset: time.Now().Add(24 * time.Hour), want: http.StatusNoContent},
+		{name: "retirada pasada", sunset: time.Now().Add(-time.Hour), want: http.StatusGone},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			version := apiVersion{Name: "v1", Deprecated: deprecated, Sunset: tc.sunset, Successor: "v2"}
+			rec := httptest.NewRecorder()
+			versionMiddleware(version)(ok)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/products", nil))
+			if rec.Code != tc.want {
+				t.Errorf("estado %d, se esperaba %d", rec.Code, tc.want)
+			}
+			if rec.Header().Get("Deprecation") == "" || rec.Header().Get("Link") != `</api/v2/products>; rel="successor-version"` {
+				t.Errorf("cabeceras de obsolescencia: %v", rec.Header())
+			}
+			if hasSunset := rec.Header().Get("Sunset") != ""; hasSunset != !tc.sunset.IsZero() {
+				t.Errorf("Sunset = %q con fecha de retirada %v", rec.Header().Get("Sunset"), tc.sunset)
+			}
+		})
+	}
+}
+
+// TestOpenAPIDeprecatedVersions comprueba que las operaciones de v1 solo figuran como
+// deprecated en la especificación si se configura su fecha de obsolescencia
+func TestOpenAPIDeprecatedVersions(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		deprecated string
+	}{
+		{name: "por defecto"},
+		{name: "obsoleta", deprecated: "2026-10-19"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			restoreAPIVersions(t)
+			if tc.deprecated != "" {
+				t.Setenv("TIENDA_API_V1_DEPRECATED", tc.deprecated)
+			}
+			if err := setupAPIVersions(); err != nil {
+				t.Fatal(err)
+			}
+			if err := setupOpenAPI(apiRouteTable()); err != nil {
+				t.Fatalf("setupOpenAPI: %v", err)
+			}
+			var doc struct {
+				Paths map[string]map[string]struct {
+					Deprecated bool `json:"deprecated"`
+				} `json:"paths"`
+			}
+			if err := json.Unmarshal(openAPIDocument, &doc); err != nil {
+				t.Fatal(err)
+			}
+			for path, item := range doc.Paths {
+				for method, op := range item {
+					want := tc.deprecated != "" && strings.HasPrefix(path, "/api/v1/")
+					if op.Deprecated != want {
+						t.Errorf("%s %s: deprecated = %v, se esperaba %v", method, path, op.Deprecated, want)
+					}
+				}
+			}
+		})
+	}
+}